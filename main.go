@@ -44,6 +44,10 @@ var (
 
 	metricsRouter  *metricsrouter.MetricsRouter
 	metricsRunners []*metricsrunner.MetricsRunner
+	canary         *metricsrouter.Canary
+	relay          *metricsrouter.Relay
+	beacon         *metricsrouter.BeaconCollector
+	csp            *metricsrouter.CSPCollector
 )
 
 func terminate() error {
@@ -63,6 +67,52 @@ func terminate() error {
 		}
 	}
 
+	if relay != nil {
+		log.Println("stopping carbon relay")
+		err = relay.Stop()
+		if err != nil {
+			log.Println(fmt.Sprintf("error stopping carbon relay: %s", err))
+			hasError = true
+		}
+	}
+
+	if beacon != nil {
+		log.Println("stopping beacon collector")
+		err = beacon.Stop()
+		if err != nil {
+			log.Println(fmt.Sprintf("error stopping beacon collector: %s", err))
+			hasError = true
+		}
+	}
+
+	if csp != nil {
+		log.Println("stopping csp collector")
+		err = csp.Stop()
+		if err != nil {
+			log.Println(fmt.Sprintf("error stopping csp collector: %s", err))
+			hasError = true
+		}
+	}
+
+	if canary != nil {
+		log.Println("stopping carbon canary")
+		err = canary.Stop()
+		if err != nil {
+			log.Println(fmt.Sprintf("error stopping carbon canary: %s", err))
+			hasError = true
+		}
+	}
+
+	// Last so everything above gets a chance to write its final metrics...
+	if metricsRouter != nil {
+		log.Println("stopping metrics router")
+		err = metricsRouter.Close()
+		if err != nil {
+			log.Println(fmt.Sprintf("error stopping metrics router: %s", err))
+			hasError = true
+		}
+	}
+
 	if hasError {
 		return fmt.Errorf("error attempting to cleanly terminate")
 	}
@@ -132,11 +182,49 @@ func main() {
 	rand.Seed(time.Now().UTC().UnixNano())
 
 	// Start up metrics router...
-	metricsRouter, err = metricsrouter.NewMetricsRouter(config)
+	metricsRouter, err = metricsrouter.NewMetricsRouter(version, config)
 	if err != nil {
 		log.Println(fmt.Sprintf("error initializing metrics router: %s", err))
 	}
 
+	// Start the carbon canary (checks that what we write actually makes it into graphite)...
+	if config.MetricsRouter.Enabled && config.MetricsRouter.Canary.Enabled {
+		canary = metricsrouter.NewCanary(config, metricsRouter)
+		go canary.Start()
+	}
+
+	// Start relaying graphite plaintext from other services...
+	if config.MetricsRouter.Relay.Enabled {
+		relay, err = metricsrouter.NewRelay(config, metricsRouter)
+		if err == nil {
+			err = relay.Start()
+		}
+		if err != nil {
+			log.Println(fmt.Sprintf("error starting carbon relay: %s", err))
+			relay = nil
+		}
+	}
+
+	// Start collecting browser timings...
+	if config.Beacon.Enabled {
+		beacon, err = metricsrouter.NewBeaconCollector(config, metricsRouter)
+		if err != nil {
+			log.Println(fmt.Sprintf("error starting beacon collector: %s", err))
+		} else {
+			go beacon.Start()
+		}
+	}
+
+	// Start collecting csp violations...
+	if config.CSP.Enabled {
+		csp, err = metricsrouter.NewCSPCollector(config, metricsRouter)
+		if err != nil {
+			log.Println(fmt.Sprintf("error starting csp collector: %s", err))
+		} else {
+			go csp.Start()
+		}
+	}
+
 	// Start all the metrics runners...
 	for _, metric := range config.Metrics {
 
@@ -156,11 +244,41 @@ func main() {
 	// Create the router for the primary API...
 	r := mux.NewRouter()
 	routes.InitializeGeneralRoutes(version, config, r)
+	routes.InitializeRunnerRoutes(version, config, metricsRunners, r)
+	routes.InitializeCanaryRoutes(version, config, canary, r)
+	routes.InitializeWebhookRoutes(version, config, metricsRouter, r)
+	routes.InitializeSinkRoutes(version, config, metricsRouter, r)
+	routes.InitializePrometheusRoutes(version, config, metricsRunners, r)
+	if csp != nil {
+		routes.InitializeCSPRoutes(version, config, csp, r)
+	}
 
 	// Assemble all middleware and create master handler...
-	http.Handle("/", context.ClearHandler(alice.New(middleware.ThrottleHandler,
+	api := context.ClearHandler(alice.New(middleware.ThrottleHandler,
 		middleware.NewLoggingHandler(config),
-		handlers.CompressHandler).Then(r)))
+		handlers.CompressHandler).Then(r))
+	http.Handle("/", api)
+
+	// Beacons come from every page view, so they get their own (per ip) throttle...
+	if beacon != nil {
+		beaconRouter := mux.NewRouter()
+		routes.InitializeBeaconRoutes(version, config, beacon, beaconRouter)
+		http.Handle("/api/beacon", context.ClearHandler(alice.New(middleware.NewIPThrottleHandler(config, config.Beacon.RateLimit),
+			middleware.NewLoggingHandler(config)).Then(beaconRouter)))
+	}
+
+	// As do csp reports (though reading them back goes through the api like anything else)...
+	if csp != nil {
+		cspRouter := mux.NewRouter()
+		routes.InitializeCSPReportRoutes(version, config, csp, cspRouter)
+		reports := context.ClearHandler(alice.New(middleware.NewIPThrottleHandler(config, config.CSP.RateLimit),
+			middleware.NewLoggingHandler(config), handlers.CompressHandler).Then(cspRouter))
+
+		cspSplitter := mux.NewRouter()
+		cspSplitter.Methods("GET").Handler(api)
+		cspSplitter.PathPrefix("/").Handler(reports)
+		http.Handle("/api/csp-reports", cspSplitter)
+	}
 
 	// Start up the api...
 	log.Println(fmt.Sprintf("started api (listening on *:%d)", config.Port))
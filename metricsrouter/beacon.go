@@ -0,0 +1,157 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package metricsrouter
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bryancallahan/metrics-runner/models"
+)
+
+// BeaconCollector buckets browser timings by page group and writes their percentiles (and
+// counts) through the metrics router every flush interval.
+type BeaconCollector struct {
+	config        *models.Config
+	metricsRouter *MetricsRouter
+	pageGroups    *models.PageGroups
+	stop          chan struct{}
+	done          chan struct{}
+
+	lock    sync.Mutex
+	samples map[string]*beaconSamples // Keyed by "<group>.<timing>"
+}
+
+// beaconSamples is a reservoir of one interval's values (so memory stays bounded however
+// many beacons turn up).
+type beaconSamples struct {
+	count  int
+	values []float64
+}
+
+func NewBeaconCollector(config *models.Config, metricsRouter *MetricsRouter) (*BeaconCollector, error) {
+
+	pageGroups, err := models.NewPageGroups(config.PageGroups)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BeaconCollector{
+		config:        config,
+		metricsRouter: metricsRouter,
+		pageGroups:    pageGroups,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+		samples:       map[string]*beaconSamples{},
+	}, nil
+}
+
+// Record adds a beacon's timings to its page group's samples.
+func (b *BeaconCollector) Record(beacon *models.Beacon) {
+
+	group := b.pageGroups.Match(beacon.URL)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for timing, value := range beacon.Timings() {
+		key := fmt.Sprintf("%s.%s", group, timing)
+		samples, ok := b.samples[key]
+		if !ok {
+			samples = &beaconSamples{}
+			b.samples[key] = samples
+		}
+
+		samples.count++
+		if len(samples.values) < b.config.Beacon.MaxSamples {
+			samples.values = append(samples.values, value)
+		} else if i := rand.Intn(samples.count); i < len(samples.values) {
+			samples.values[i] = value
+		}
+	}
+}
+
+// Start flushes every flush interval until stopped.
+func (b *BeaconCollector) Start() {
+
+	defer close(b.done)
+
+	for {
+		select {
+		case <-time.After(b.config.Beacon.FlushInterval.Duration):
+		case <-b.stop:
+			b.flush()
+			return
+		}
+		b.flush()
+	}
+}
+
+// Stop flushes whatever we've collected so far.
+func (b *BeaconCollector) Stop() error {
+
+	const stopTimeout = 30 // Seconds
+
+	close(b.stop)
+
+	select {
+	case <-b.done:
+		return nil
+	case <-time.After(stopTimeout * time.Second):
+		return fmt.Errorf("beacon: final flush did not finish within %d seconds", stopTimeout)
+	}
+}
+
+// flush writes the percentiles and count of every page group's timings (then starts over).
+func (b *BeaconCollector) flush() {
+
+	b.lock.Lock()
+	samples := b.samples
+	b.samples = map[string]*beaconSamples{}
+	b.lock.Unlock()
+
+	for key, s := range samples {
+		sort.Float64s(s.values)
+		b.metricsRouter.Write(fmt.Sprintf("beacon.%s.count", key), float64(s.count))
+		for _, percentile := range b.config.Beacon.Percentiles {
+			b.metricsRouter.Write(fmt.Sprintf("beacon.%s.p%s", key, percentileName(percentile)), nearestRank(s.values, percentile))
+		}
+	}
+}
+
+// percentileName formats a percentile for a metric path (e.g. 99.9 becomes "99_9").
+func percentileName(percentile float64) string {
+	return strings.Replace(strconv.FormatFloat(percentile, 'f', -1, 64), ".", "_", -1)
+}
+
+// nearestRank returns the percentile of sorted values using the nearest-rank method.
+func nearestRank(sorted []float64, percentile float64) float64 {
+	rank := int(math.Ceil(percentile / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
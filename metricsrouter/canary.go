@@ -0,0 +1,177 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package metricsrouter
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bryancallahan/metrics-runner/models"
+)
+
+// Canary periodically writes a marker (its own timestamp) through the metrics router and
+// polls graphite's render api until it shows up, measuring how long ingestion takes.
+type Canary struct {
+	wg            sync.WaitGroup
+	config        *models.Config
+	metricsRouter *MetricsRouter
+	stop          chan struct{}
+
+	resultLock sync.RWMutex
+	result     *models.RunResult
+	misses     int // Consecutive markers that never showed up
+}
+
+func NewCanary(config *models.Config, metricsRouter *MetricsRouter) *Canary {
+	return &Canary{
+		config:        config,
+		metricsRouter: metricsRouter,
+		stop:          make(chan struct{}),
+	}
+}
+
+func (c *Canary) run() {
+
+	c.wg.Add(1)
+	defer c.wg.Done()
+
+	canary := c.config.MetricsRouter.Canary
+	result := models.NewRunResult(&models.ConfigMetric{Type: "canary", Name: "carbon-canary"})
+
+	// The marker is its own (whole second) timestamp, so anything at least as large means
+	// this marker (or a later one) made it in...
+	timestamp := time.Now().Truncate(time.Second)
+	marker := float64(timestamp.Unix())
+	written := time.Now()
+	c.metricsRouter.WriteAt("canary.marker", marker, timestamp)
+	result.Details["marker"] = marker
+
+	metric := &models.ConfigMetric{
+		Type:    "tsdb-query",
+		Name:    "carbon-canary",
+		URL:     canary.RenderURL,
+		Timeout: canary.PollInterval,
+		TSDB: models.ConfigMetricTSDB{
+			Backend: "graphite",
+			Query:   c.metricsRouter.Path("canary.marker"),
+			From:    fmt.Sprintf("-%ds", int((canary.Timeout.Duration+time.Minute)/time.Second)),
+			Reduce:  "max",
+			Min:     &marker,
+		},
+	}
+
+	// Poll until it shows up (or we run out of time)...
+	deadline := written.Add(canary.Timeout.Duration)
+	var found bool
+	var err error
+	for {
+		select {
+		case <-time.After(canary.PollInterval.Duration):
+		case <-c.stop:
+			return // Shutting down, don't count this one either way
+		}
+
+		var tsdb *models.TSDBResult
+		tsdb, err = models.QueryTSDBMetric(metric)
+		if err == nil && tsdb.Valid {
+			found = true
+			break
+		}
+		if time.Now().Add(canary.PollInterval.Duration).After(deadline) {
+			break
+		}
+	}
+
+	c.resultLock.Lock()
+	if found {
+		c.misses = 0
+	} else {
+		c.misses++
+	}
+	result.Details["misses"] = c.misses
+	c.resultLock.Unlock()
+
+	if found {
+		delay := time.Since(written)
+		log.Println(fmt.Sprintf("carbon canary %.0f - Delay: %s", marker, delay))
+		c.metricsRouter.Write("canary.delay", float64(delay/time.Microsecond)/1000.0)
+		result.Details["delay"] = models.Duration{Duration: delay}
+		err = nil
+	} else {
+		if err == nil {
+			err = fmt.Errorf("marker never showed up within %s", canary.Timeout)
+		}
+		log.Println(fmt.Sprintf("carbon canary %.0f - Error: %s", marker, err))
+	}
+	if found {
+		c.metricsRouter.Write("canary.valid", 1)
+	} else {
+		c.metricsRouter.Write("canary.valid", 0)
+	}
+	result.Finish(found, err)
+
+	c.resultLock.Lock()
+	c.result = result
+	c.resultLock.Unlock()
+}
+
+func (c *Canary) Start() {
+
+	log.Print(fmt.Sprintf("carbon canary started with a periodicity of %s", c.config.MetricsRouter.Canary.Periodicity))
+
+	for {
+		c.run()
+
+		select {
+		case <-time.After(c.config.MetricsRouter.Canary.Periodicity.Duration):
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *Canary) Stop() error {
+
+	close(c.stop)
+
+	const stopTimeout = 30 // Seconds
+
+	done := make(chan struct{}, 1)
+	go func() {
+		c.wg.Wait()
+		done <- struct{}{}
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(stopTimeout * time.Second):
+		return fmt.Errorf("canary: wait group did not finish within %d seconds", stopTimeout)
+	}
+}
+
+// Result returns a copy of the result of the last canary (nil if we haven't finished one yet).
+func (c *Canary) Result() *models.RunResult {
+	c.resultLock.RLock()
+	defer c.resultLock.RUnlock()
+	if c.result == nil {
+		return nil
+	}
+	return c.result.Copy()
+}
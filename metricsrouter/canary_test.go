@@ -0,0 +1,103 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package metricsrouter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bryancallahan/metrics-runner/models"
+)
+
+// canaryTestGraphite renders whatever the sink was sent for the target, with lag added to
+// every value (so a negative lag plays an old marker back).
+func canaryTestGraphite(t *testing.T, sink *recordingSink, lag float64) string {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/render" || r.URL.Query().Get("format") != "json" || r.URL.Query().Get("from") != "-60s" {
+			t.Errorf("unexpected render request %s", r.URL)
+		}
+		target := r.URL.Query().Get("target")
+		datapoints := [][]*float64{}
+		for _, sample := range sink.waitFor(0) {
+			if sample.Path == target {
+				value, timestamp := sample.Value+lag, float64(sample.Timestamp.Unix())
+				datapoints = append(datapoints, []*float64{&value, &timestamp}, []*float64{nil, &timestamp})
+			}
+		}
+		json.NewEncoder(w).Encode([]map[string]interface{}{{"target": target, "datapoints": datapoints}})
+	}))
+	t.Cleanup(server.Close)
+
+	return server.URL
+}
+
+func TestCanary(t *testing.T) {
+
+	for _, test := range []struct {
+		name  string
+		lag   float64
+		found bool
+	}{
+		{"ingested", 0, true},
+		{"stale", -60, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+
+			config := &models.Config{Name: "metrics-runner", Env: "test", MetricsRouter: models.ConfigMetricsRouter{
+				Canary: models.ConfigCanary{
+					Enabled:      true,
+					Timeout:      models.Duration{Duration: 200 * time.Millisecond},
+					PollInterval: models.Duration{Duration: 20 * time.Millisecond},
+				},
+			}}
+			router, sink := newRecordingRouter(t, config)
+			config.MetricsRouter.Canary.RenderURL = canaryTestGraphite(t, sink, test.lag)
+
+			c := NewCanary(config, router)
+			c.run()
+
+			result := c.Result()
+			if result == nil || result.Valid != test.found || result.Details["misses"] != map[bool]int{true: 0, false: 1}[test.found] {
+				t.Fatalf("unexpected result %+v", result)
+			}
+			if !test.found && !strings.Contains(result.Error, "marker never showed up within 200ms") {
+				t.Errorf("unexpected error %q", result.Error)
+			}
+
+			// The marker went out first, then how it went (with the delay if it showed up)...
+			expected := map[bool]int{true: 3, false: 2}[test.found]
+			written := map[string]float64{}
+			for _, sample := range sink.waitFor(expected) {
+				written[strings.TrimPrefix(sample.Path, "metrics-runner-test.")] = sample.Value
+			}
+			if written["canary.marker"] != result.Details["marker"] {
+				t.Errorf("expected marker %v written, got %v", result.Details["marker"], written)
+			}
+			if valid, ok := written["canary.valid"]; !ok || valid != map[bool]float64{true: 1, false: 0}[test.found] {
+				t.Errorf("unexpected canary.valid in %v", written)
+			}
+			if _, ok := written["canary.delay"]; ok != test.found {
+				t.Errorf("unexpected canary.delay in %v", written)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package metricsrouter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+// carbonPickleMaxLength keeps each pickle under what carbon's receiver accepts in one go.
+const carbonPickleMaxLength = 1 << 20
+
+// carbonPickleMetric is a path with its value (samples are named before they're pickled).
+type carbonPickleMetric struct {
+	name      string
+	value     float64
+	timestamp int64
+}
+
+// carbonPickle encodes metrics for carbon's pickle receiver, which reads a 4 byte (big endian)
+// length followed by a pickled list of (path, (timestamp, value)) tuples. We write the pickle
+// (protocol 2) opcodes ourselves, splitting into several length prefixed pickles if need be.
+func carbonPickle(metrics []carbonPickleMetric) []byte {
+
+	var out bytes.Buffer
+	var pickle bytes.Buffer
+	count := 0
+
+	flush := func() {
+		if count < 1 {
+			return
+		}
+		pickle.WriteByte('e') // APPENDS
+		pickle.WriteByte('.') // STOP
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(pickle.Len()))
+		out.Write(length[:])
+		out.Write(pickle.Bytes())
+		pickle.Reset()
+		count = 0
+	}
+
+	for _, metric := range metrics {
+		item := carbonPickleItem(metric)
+		if count > 0 && pickle.Len()+len(item)+2 > carbonPickleMaxLength {
+			flush()
+		}
+		if count == 0 {
+			pickle.Write([]byte{0x80, 2}) // PROTO 2
+			pickle.WriteByte(']')         // EMPTY_LIST
+			pickle.WriteByte('(')         // MARK
+		}
+		pickle.Write(item)
+		count++
+	}
+	flush()
+
+	return out.Bytes()
+}
+
+// carbonPickleItem pickles one (path, (timestamp, value)) tuple.
+func carbonPickleItem(metric carbonPickleMetric) []byte {
+
+	var item bytes.Buffer
+
+	// BINUNICODE (a 4 byte little endian length and utf-8)...
+	item.WriteByte('X')
+	binary.Write(&item, binary.LittleEndian, uint32(len(metric.name)))
+	item.WriteString(metric.name)
+
+	// BININT (4 byte little endian signed) or LONG1 for anything bigger...
+	if metric.timestamp >= math.MinInt32 && metric.timestamp <= math.MaxInt32 {
+		item.WriteByte('J')
+		binary.Write(&item, binary.LittleEndian, int32(metric.timestamp))
+	} else {
+		item.Write([]byte{0x8a, 8})
+		binary.Write(&item, binary.LittleEndian, metric.timestamp)
+	}
+
+	// BINFLOAT (8 byte big endian)...
+	item.WriteByte('G')
+	binary.Write(&item, binary.BigEndian, math.Float64bits(metric.value))
+
+	item.WriteByte(0x86) // TUPLE2 (timestamp, value)
+	item.WriteByte(0x86) // TUPLE2 (path, (timestamp, value))
+
+	return item.Bytes()
+}
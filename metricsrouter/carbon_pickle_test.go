@@ -0,0 +1,85 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package metricsrouter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestCarbonPickle(t *testing.T) {
+
+	// From python 3.11's pickle.dumps(metrics, protocol=2) (as carbon's senders do), with the
+	// memo opcodes taken out by pickletools.optimize as we don't write them...
+	const golden = "000000a780025d2858240000006d65747269637372756e6e65722e687474702e686f6d652d706167652e656c6170" +
+		"7365644a00f1536547405ee00000000000868658280000006d65747269637372756e6e65722e687474702e686f6d65" +
+		"2d706167652e7374617475732d636f64654a00f15365474069000000000000868658160000006d6574726963737275" +
+		"6e6e65722e6370752e6c6f61644a3cf1536547bfd00000000000008686652e"
+	pickled := carbonPickle([]carbonPickleMetric{
+		{name: "metricsrunner.http.home-page.elapsed", value: 123.5, timestamp: 1700000000},
+		{name: "metricsrunner.http.home-page.status-code", value: 200, timestamp: 1700000000},
+		{name: "metricsrunner.cpu.load", value: -0.25, timestamp: 1700000060},
+	})
+	if hex.EncodeToString(pickled) != golden {
+		t.Errorf("unexpected pickle\n got: %x\nwant: %s", pickled, golden)
+	}
+
+	// Timestamps past 2038 don't fit a BININT (python's pickle.loads gives back
+	// [('metricsrunner.later', (4102444800, 1.0))] for this)...
+	const later = "0000003380025d2858130000006d65747269637372756e6e65722e6c617465728a08005786f400000000473ff00000" +
+		"000000008686652e"
+	pickled = carbonPickle([]carbonPickleMetric{{name: "metricsrunner.later", value: 1, timestamp: 4102444800}})
+	if hex.EncodeToString(pickled) != later {
+		t.Errorf("unexpected pickle\n got: %x\nwant: %s", pickled, later)
+	}
+
+	if pickled := carbonPickle(nil); len(pickled) != 0 {
+		t.Errorf("expected nothing to send, got %x", pickled)
+	}
+}
+
+func TestCarbonPickleSplits(t *testing.T) {
+
+	var metrics []carbonPickleMetric
+	for i := 0; i < 30; i++ {
+		metrics = append(metrics, carbonPickleMetric{name: strings.Repeat("m", 100<<10), value: math.Pi, timestamp: 1700000000})
+	}
+	pickled := carbonPickle(metrics)
+
+	// Each pickle is under the maximum and complete on its own...
+	pickles, count := 0, 0
+	for len(pickled) > 0 {
+		length := int(binary.BigEndian.Uint32(pickled))
+		if length > carbonPickleMaxLength || length+4 > len(pickled) {
+			t.Fatalf("unexpected pickle length %d (of %d left)", length, len(pickled)-4)
+		}
+		pickle := pickled[4 : 4+length]
+		if !bytes.HasPrefix(pickle, []byte{0x80, 2, ']', '('}) || !bytes.HasSuffix(pickle, []byte("e.")) {
+			t.Errorf("pickle %d isn't a complete list", pickles)
+		}
+		count += bytes.Count(pickle, []byte{0x86, 0x86})
+		pickled = pickled[4+length:]
+		pickles++
+	}
+	if pickles != 3 || count != len(metrics) {
+		t.Errorf("expected %d metrics in 3 pickles, got %d in %d", len(metrics), count, pickles)
+	}
+}
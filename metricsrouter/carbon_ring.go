@@ -0,0 +1,138 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package metricsrouter
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// carbonRingReplicas is how many positions each node gets on the ring (as carbon does).
+const carbonRingReplicas = 100
+
+// carbonRing is a consistent hash ring that puts metrics where carbon-relay's
+// ConsistentHashRing (carbon_ch) would, so we can write straight to the caches a relay would.
+//
+// A node's positions are the first 4 hex digits of the md5 of "('server', 'instance'):i" (or
+// "('server', None):i" without an instance) for each replica, moved along one at a time when
+// they collide with a position that's taken, so the order nodes are added in matters.
+type carbonRing struct {
+	positions []int
+	nodes     []int // Node (index) at each position
+	servers   []string
+}
+
+// carbonRingNode is a carbon instance on the ring (the port isn't part of its identity).
+type carbonRingNode struct {
+	server   string
+	instance string // Optional
+}
+
+func newCarbonRing(nodes []carbonRingNode) *carbonRing {
+
+	r := &carbonRing{}
+	taken := map[int]bool{}
+	for i, node := range nodes {
+		r.servers = append(r.servers, node.server)
+		key := node.key()
+		for replica := 0; replica < carbonRingReplicas; replica++ {
+			position := carbonRingPosition(fmt.Sprintf("%s:%d", key, replica))
+			for taken[position] {
+				position++
+			}
+			taken[position] = true
+
+			// Insert keeping the ring sorted...
+			at := sort.SearchInts(r.positions, position)
+			r.positions = append(r.positions, 0)
+			copy(r.positions[at+1:], r.positions[at:])
+			r.positions[at] = position
+			r.nodes = append(r.nodes, 0)
+			copy(r.nodes[at+1:], r.nodes[at:])
+			r.nodes[at] = i
+		}
+	}
+	return r
+}
+
+// key is how python would print the node's (server, instance) tuple.
+func (n carbonRingNode) key() string {
+	instance := "None"
+	if len(n.instance) > 0 {
+		instance = pythonRepr(n.instance)
+	}
+	return fmt.Sprintf("(%s, %s)", pythonRepr(n.server), instance)
+}
+
+func carbonRingPosition(key string) int {
+	sum := md5.Sum([]byte(key))
+	return int(binary.BigEndian.Uint16(sum[:2]))
+}
+
+// getNodes returns the nodes (indexes) a key goes to. Like carbon-relay (with its default of
+// diverse replicas) that's the first distinct nodes clockwise round the ring from the key's
+// position that are on different servers, up to the replication factor. Carbon's walk stops one
+// short of coming all the way round so we do too.
+func (r *carbonRing) getNodes(key string, replicationFactor int) []int {
+
+	if len(r.positions) < 1 {
+		return nil
+	}
+
+	index := sort.SearchInts(r.positions, carbonRingPosition(key)) % len(r.positions)
+	if len(r.servers) == 1 {
+		return []int{r.nodes[index]}
+	}
+
+	var nodes []int
+	seen := map[int]bool{}
+	usedServers := map[string]bool{}
+	last := (index - 1 + len(r.positions)) % len(r.positions)
+	for len(seen) < len(r.servers) && index != last {
+		node := r.nodes[index]
+		index = (index + 1) % len(r.positions)
+		if seen[node] {
+			continue
+		}
+		seen[node] = true
+		if usedServers[r.servers[node]] {
+			continue
+		}
+		usedServers[r.servers[node]] = true
+		nodes = append(nodes, node)
+		if len(nodes) >= replicationFactor {
+			break
+		}
+	}
+	return nodes
+}
+
+// pythonRepr quotes a string the way python's repr does (for plain ascii at least).
+func pythonRepr(s string) string {
+	quote := "'"
+	if strings.Contains(s, "'") && !strings.Contains(s, `"`) {
+		quote = `"`
+	}
+	s = strings.Replace(s, `\`, `\\`, -1)
+	if quote == "'" {
+		s = strings.Replace(s, "'", `\'`, -1)
+	}
+	return quote + s + quote
+}
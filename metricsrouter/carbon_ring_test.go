@@ -0,0 +1,144 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package metricsrouter
+
+import (
+	"reflect"
+	"testing"
+)
+
+// The expected nodes come from carbon's ConsistentHashRing (carbon_ch, 100 replicas) with the
+// relay's diverse replica selection, run in python against the same nodes and keys.
+func TestCarbonRing(t *testing.T) {
+
+	type lookup struct {
+		key               string
+		replicationFactor int
+		nodes             []int
+	}
+	rings := []struct {
+		name    string
+		nodes   []carbonRingNode
+		lookups []lookup
+	}{
+		{
+			// Two of these collide on the ring, so get moved along...
+			name: "instances",
+			nodes: []carbonRingNode{
+				{server: "10.0.0.1", instance: "a"},
+				{server: "10.0.0.1", instance: "b"},
+				{server: "10.0.0.2", instance: "a"},
+				{server: "10.0.0.3"},
+			},
+			lookups: []lookup{
+				{"metricsrunner.http.home-page.elapsed", 1, []int{1}},
+				{"metricsrunner.http.home-page.status-code", 1, []int{3}},
+				{"metricsrunner.dns.example-com.elapsed", 1, []int{1}},
+				{"metricsrunner.cpu.load", 1, []int{0}},
+				{"carbon.agents.a.cpuUsage", 1, []int{1}},
+				{"metricsrunner.tls.example-com.days", 1, []int{3}},
+				{"x", 1, []int{0}},
+				{"metricsrunner.ping.o'brien.elapsed", 1, []int{2}},
+				{"metricsrunner.http.home-page.elapsed", 2, []int{1, 2}},
+				{"metricsrunner.http.home-page.status-code", 2, []int{3, 2}},
+				{"metricsrunner.dns.example-com.elapsed", 2, []int{1, 2}},
+				{"metricsrunner.cpu.load", 2, []int{0, 2}},
+				{"carbon.agents.a.cpuUsage", 2, []int{1, 2}},
+				{"metricsrunner.tls.example-com.days", 2, []int{3, 0}},
+				{"x", 2, []int{0, 2}},
+				{"metricsrunner.ping.o'brien.elapsed", 2, []int{2, 0}},
+			},
+		},
+		{
+			name:  "plain",
+			nodes: []carbonRingNode{{server: "carbon-1"}, {server: "carbon-2"}, {server: "carbon-3"}},
+			lookups: []lookup{
+				{"metricsrunner.http.home-page.elapsed", 1, []int{0}},
+				{"metricsrunner.dns.example-com.elapsed", 1, []int{1}},
+				{"metricsrunner.cpu.load", 1, []int{2}},
+				{"metricsrunner.http.home-page.elapsed", 2, []int{0, 1}},
+				{"metricsrunner.http.home-page.status-code", 2, []int{0, 1}},
+				{"metricsrunner.dns.example-com.elapsed", 2, []int{1, 2}},
+				{"metricsrunner.cpu.load", 2, []int{2, 1}},
+				{"carbon.agents.a.cpuUsage", 2, []int{1, 0}},
+				{"metricsrunner.tls.example-com.days", 2, []int{0, 1}},
+				{"x", 2, []int{0, 1}},
+				{"metricsrunner.ping.o'brien.elapsed", 2, []int{2, 0}},
+			},
+		},
+		{
+			// Instances python has to quote differently...
+			name: "quoting",
+			nodes: []carbonRingNode{
+				{server: "carbon-1", instance: "it's"},
+				{server: "carbon-1", instance: `say "hi"`},
+				{server: "carbon-2", instance: `back\slash`},
+				{server: "carbon-3"},
+			},
+			lookups: []lookup{
+				{"metricsrunner.http.home-page.elapsed", 1, []int{1}},
+				{"metricsrunner.cpu.load", 1, []int{3}},
+				{"x", 1, []int{1}},
+				{"metricsrunner.ping.o'brien.elapsed", 1, []int{3}},
+				{"metricsrunner.http.home-page.elapsed", 2, []int{1, 2}},
+				{"metricsrunner.cpu.load", 2, []int{3, 2}},
+				{"x", 2, []int{1, 3}},
+				{"metricsrunner.ping.o'brien.elapsed", 2, []int{3, 2}},
+				{"metricsrunner.http.home-page.elapsed", 3, []int{1, 2, 3}},
+				{"metricsrunner.cpu.load", 3, []int{3, 2, 1}},
+				{"x", 3, []int{1, 3, 2}},
+				{"metricsrunner.ping.o'brien.elapsed", 3, []int{3, 2, 0}},
+			},
+		},
+		{
+			name:  "single",
+			nodes: []carbonRingNode{{server: "127.0.0.1"}},
+			lookups: []lookup{
+				{"metricsrunner.http.home-page.elapsed", 1, []int{0}},
+				{"metricsrunner.cpu.load", 2, []int{0}},
+			},
+		},
+	}
+
+	for _, ring := range rings {
+		r := newCarbonRing(ring.nodes)
+		for _, l := range ring.lookups {
+			nodes := r.getNodes(l.key, l.replicationFactor)
+			if !reflect.DeepEqual(nodes, l.nodes) {
+				t.Errorf("%s: getNodes(%q, %d) = %v, expected %v", ring.name, l.key, l.replicationFactor, nodes, l.nodes)
+			}
+		}
+	}
+
+	if nodes := newCarbonRing(nil).getNodes("x", 1); nodes != nil {
+		t.Errorf("expected no nodes from an empty ring, got %v", nodes)
+	}
+}
+
+func TestPythonRepr(t *testing.T) {
+	for s, expected := range map[string]string{
+		"a":           `'a'`,
+		"it's":        `"it's"`,
+		`say "hi"`:    `'say "hi"'`,
+		`it's "both"`: `'it\'s "both"'`,
+		`back\slash`:  `'back\\slash'`,
+	} {
+		if repr := pythonRepr(s); repr != expected {
+			t.Errorf("pythonRepr(%q) = %s, expected %s", s, repr, expected)
+		}
+	}
+}
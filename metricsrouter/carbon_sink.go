@@ -0,0 +1,438 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package metricsrouter
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bryancallahan/metrics-runner/models"
+)
+
+// carbonTimeout limits how long connecting to carbon (and each write) can take, so a stalled
+// server can't hold up its sink's worker forever.
+const carbonTimeout = 10 * time.Second
+
+// carbonMaxDatagram keeps udp writes under a typical mtu.
+const carbonMaxDatagram = 1400
+
+// carbonSink sends metrics to carbon using its plaintext protocol over tcp (each batch in a
+// single write), its pickle protocol or plaintext over udp (packing as many lines into each
+// datagram as will fit). In the tagged format a check's fields are written as graphite 1.1
+// tagged series ("metricsrunner.elapsed;check=homepage;env=prod;type=http") rather than dotted
+// paths, everything else (e.g. relayed metrics and the canary) keeps its path.
+//
+// With several destinations each metric goes to the ones carbon-relay's consistent hashing
+// would pick (or all of them). Each destination has its own worker (queue, outbox and backoff)
+// and connection, so one that's down only holds up (and replays) its own share.
+type carbonSink struct {
+	config       *models.Config
+	sink         models.ConfigSink
+	destinations []*carbonDestination
+	ring         *carbonRing                  // Unless we're sending everything everywhere
+	tags         map[string]map[string]string // Check name to its configured tags
+}
+
+// carbonDestination is a carbon instance we write to. It's the sink its worker sends (already
+// named) samples to.
+type carbonDestination struct {
+	carbon   *carbonSink
+	address  string
+	node     carbonRingNode
+	protocol string
+	conn     net.Conn
+	backoff  outboxBackoff
+	retryAt  time.Time
+	worker   *sinkWorker
+
+	lock      sync.Mutex // Guards what's below (read when reporting stats)
+	healthy   bool
+	lastError string
+}
+
+// SinkDestination is the state of one of a sink's destinations (and its worker).
+type SinkDestination struct {
+	Address     string `json:"address"`
+	Instance    string `json:"instance,omitempty"`
+	Healthy     bool   `json:"healthy"`
+	LastError   string `json:"lastError,omitempty"`
+	Queued      int    `json:"queued"`
+	Sent        uint64 `json:"sent"`
+	Dropped     uint64 `json:"dropped"`
+	Errors      uint64 `json:"errors"`
+	OutboxDepth int64  `json:"outboxDepth"`
+	Replayed    uint64 `json:"replayed"`
+	Overflowed  uint64 `json:"overflowed"`
+}
+
+func newCarbonSink(config *models.Config, sink models.ConfigSink) (*carbonSink, error) {
+
+	s := &carbonSink{config: config, sink: sink, tags: map[string]map[string]string{}}
+	for _, metric := range config.Metrics {
+		s.tags[metric.Name] = metric.Tags
+	}
+
+	destinations := sink.Carbon.Destinations
+	if len(destinations) < 1 {
+		destinations = []string{net.JoinHostPort(sink.Carbon.Host, strconv.Itoa(sink.Carbon.Port))}
+	}
+
+	var nodes []carbonRingNode
+	seen := map[carbonRingNode]bool{}
+	for _, destination := range destinations {
+		d, err := parseCarbonDestination(destination)
+		if err != nil {
+			return nil, err
+		}
+		if seen[d.node] {
+			return nil, fmt.Errorf("destination %s is listed more than once", destination)
+		}
+		seen[d.node] = true
+		d.carbon = s
+		d.protocol = sink.Carbon.Protocol
+		d.backoff = outboxBackoff{kind: "fibonacci", max: time.Minute}
+		s.destinations = append(s.destinations, d)
+		nodes = append(nodes, d.node)
+	}
+	if sink.Carbon.Routing != "all" {
+		s.ring = newCarbonRing(nodes)
+	}
+
+	for _, d := range s.destinations {
+		err := d.connect()
+		if err != nil {
+			d.down(err)
+		} else {
+			d.healthy = true
+		}
+
+		// Each destination gets its own queue and outbox (in a directory of its own)...
+		config := sink
+		config.Name = fmt.Sprintf("%s (%s)", sink.Name, d.label())
+		config.Outbox.Directory = filepath.Join(sink.Outbox.Directory, metricSegment(d.label()))
+		d.worker = newSinkWorker(config, d)
+	}
+	return s, nil
+}
+
+// parseCarbonDestination parses "host:port" or "host:port:instance" (with ipv6 hosts in
+// brackets), as carbon-relay does.
+func parseCarbonDestination(destination string) (*carbonDestination, error) {
+
+	host, rest := destination, ""
+	if strings.HasPrefix(destination, "[") {
+		end := strings.Index(destination, "]")
+		if end < 0 {
+			return nil, fmt.Errorf("malformed destination %s", destination)
+		}
+		host, rest = destination[1:end], strings.TrimPrefix(destination[end+1:], ":")
+	} else if i := strings.Index(destination, ":"); i >= 0 {
+		host, rest = destination[:i], destination[i+1:]
+	}
+
+	parts := strings.SplitN(rest, ":", 2)
+	port, err := strconv.Atoi(parts[0])
+	if len(host) < 1 || err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("malformed destination %s (expected host:port or host:port:instance)", destination)
+	}
+
+	d := &carbonDestination{address: net.JoinHostPort(host, parts[0]), node: carbonRingNode{server: host}}
+	if len(parts) > 1 {
+		d.node.instance = parts[1]
+	}
+	return d, nil
+}
+
+// Send hands samples (named as they're written to carbon) to the workers of the destinations
+// they go to. Whatever a destination's queue hasn't room for is dropped (and counted) there.
+func (s *carbonSink) Send(samples []Sample) error {
+
+	for _, sample := range samples {
+
+		// Routed by its name, as that's what carbon hashes...
+		sample.Path = s.name(sample)
+		if s.ring == nil {
+			for _, d := range s.destinations {
+				d.worker.enqueue(sample)
+			}
+			continue
+		}
+		for _, d := range s.ring.getNodes(sample.Path, s.sink.Carbon.ReplicationFactor) {
+			s.destinations[d].worker.enqueue(sample)
+		}
+	}
+	return nil
+}
+
+// payloads encodes samples for our protocol, as a single write for tcp or one per datagram.
+func (s *carbonSink) payloads(samples []Sample) [][]byte {
+
+	if s.sink.Carbon.Protocol == "pickle" {
+		metrics := make([]carbonPickleMetric, len(samples))
+		for i, sample := range samples {
+			metrics[i] = carbonPickleMetric{name: sample.Path, value: sample.Value, timestamp: sample.Timestamp.Unix()}
+			if s.config.MetricsRouter.Verbose {
+				log.Println(fmt.Sprintf("sending to sink %s: %s %v %d", s.sink.Name, metrics[i].name, metrics[i].value, metrics[i].timestamp))
+			}
+		}
+		return [][]byte{carbonPickle(metrics)}
+	}
+
+	var payloads [][]byte
+	var payload bytes.Buffer
+	for _, sample := range samples {
+		line := fmt.Sprintf("%s %s %d\n", sample.Path, strconv.FormatFloat(sample.Value, 'f', -1, 64), sample.Timestamp.Unix())
+		if s.config.MetricsRouter.Verbose {
+			log.Println(fmt.Sprintf("sending to sink %s: %s", s.sink.Name, strings.TrimSpace(line)))
+		}
+		if s.sink.Carbon.Protocol == "udp" && payload.Len() > 0 && payload.Len()+len(line) > carbonMaxDatagram {
+			payloads = append(payloads, append([]byte(nil), payload.Bytes()...))
+			payload.Reset()
+		}
+		payload.WriteString(line)
+	}
+	return append(payloads, payload.Bytes())
+}
+
+// Close gives each destination's worker a chance to send what's still queued (all at once, so
+// one that's down doesn't use up everyone else's time).
+func (s *carbonSink) Close() error {
+
+	errs := make([]error, len(s.destinations))
+	var wg sync.WaitGroup
+	for i, d := range s.destinations {
+		wg.Add(1)
+		go func(i int, d *carbonDestination) {
+			defer wg.Done()
+			errs[i] = d.worker.close(carbonTimeout)
+		}(i, d)
+	}
+	wg.Wait()
+
+	var messages []string
+	for _, err := range errs {
+		if err != nil {
+			messages = append(messages, err.Error())
+		}
+	}
+	if len(messages) > 0 {
+		return fmt.Errorf("%s", strings.Join(messages, ", "))
+	}
+	return nil
+}
+
+func (s *carbonSink) destinationStats() []SinkDestination {
+	stats := make([]SinkDestination, len(s.destinations))
+	for i, d := range s.destinations {
+		worker := d.worker.stats()
+		stats[i] = SinkDestination{
+			Address:     d.address,
+			Instance:    d.node.instance,
+			Queued:      worker.Queued,
+			Sent:        worker.Sent,
+			Dropped:     worker.Dropped,
+			Errors:      worker.Errors,
+			OutboxDepth: worker.OutboxDepth,
+			Replayed:    worker.Replayed,
+			Overflowed:  worker.Overflowed,
+		}
+		d.lock.Lock()
+		stats[i].Healthy = d.healthy
+		stats[i].LastError = d.lastError
+		d.lock.Unlock()
+	}
+	return stats
+}
+
+// label is how we refer to the destination (its address, and instance if it has one).
+func (d *carbonDestination) label() string {
+	if len(d.node.instance) > 0 {
+		return d.address + ":" + d.node.instance
+	}
+	return d.address
+}
+
+// Send writes samples (already named) to the destination.
+func (d *carbonDestination) Send(samples []Sample) error {
+	return d.send(d.carbon.payloads(samples))
+}
+
+// Close is called by the destination's worker once it's drained.
+func (d *carbonDestination) Close() error {
+	if d.conn == nil {
+		return nil
+	}
+	return d.conn.Close()
+}
+
+func (d *carbonDestination) connect() error {
+	if d.conn != nil {
+		d.conn.Close()
+		d.conn = nil
+	}
+	network := "tcp"
+	if d.protocol == "udp" {
+		network = "udp"
+	}
+	conn, err := net.DialTimeout(network, d.address, carbonTimeout)
+	if err != nil {
+		return err
+	}
+	d.conn = conn
+	return nil
+}
+
+// send writes payloads. If there's ANY kind of error we reconnect and try again. If that doesn't
+// succeed the destination is down and we don't try it again until it's backed off (failing
+// straight away in the meantime, which its worker either drops or keeps in its outbox).
+func (d *carbonDestination) send(payloads [][]byte) error {
+
+	d.lock.Lock()
+	healthy := d.healthy
+	d.lock.Unlock()
+	if !healthy && time.Now().Before(d.retryAt) {
+		return fmt.Errorf("down (retrying in %s)", time.Until(d.retryAt).Round(time.Second))
+	}
+
+	err := fmt.Errorf("not connected")
+	if d.conn != nil {
+		err = d.write(payloads)
+	}
+	if err != nil {
+		if healthy {
+			log.Println(fmt.Sprintf("error sending metrics to %s: %s (reconnecting)", d.address, err))
+		}
+		err = d.connect()
+		if err == nil {
+			err = d.write(payloads)
+		}
+	}
+	if err != nil {
+		d.down(err)
+		return err
+	}
+
+	d.lock.Lock()
+	if !d.healthy {
+		log.Println(fmt.Sprintf("connection to %s reestablished", d.address))
+	}
+	d.healthy = true
+	d.lastError = ""
+	d.lock.Unlock()
+	d.backoff.reset()
+	return nil
+}
+
+func (d *carbonDestination) write(payloads [][]byte) error {
+	for _, payload := range payloads {
+		d.conn.SetWriteDeadline(time.Now().Add(carbonTimeout))
+		_, err := d.conn.Write(payload)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *carbonDestination) down(err error) {
+	wait := d.backoff.next()
+	d.retryAt = time.Now().Add(wait)
+
+	d.lock.Lock()
+	if d.healthy || len(d.lastError) < 1 {
+		log.Println(fmt.Sprintf("carbon destination %s is down: %s (retrying in %s)", d.address, err, wait))
+	}
+	d.healthy = false
+	d.lastError = err.Error()
+	d.lock.Unlock()
+}
+
+// name returns what a sample is written to carbon as.
+func (s *carbonSink) name(sample Sample) string {
+
+	if s.sink.Carbon.Format != "tagged" || len(sample.Check) < 1 {
+		return sample.Path
+	}
+
+	env := strings.ToLower(s.config.Env)
+	if len(env) > 4 {
+		env = env[0:4]
+	}
+	name := strings.Replace(strings.ToLower(s.config.Name), " ", "", -1)
+
+	// The built in tags win over any configured ones by the same name...
+	tags := map[string]string{}
+	for key, value := range s.tags[sample.Check] {
+		tags[carbonTagName(key)] = value
+	}
+	tags["env"] = env
+	tags["check"] = sample.Check
+	tags["type"] = sample.Type
+
+	return carbonTaggedSeries(fmt.Sprintf("%s.%s", name, sample.Field), tags)
+}
+
+// carbonTaggedSeries formats a graphite tagged series, "name;tag1=value1;tag2=value2" (sorted
+// by tag name as graphite does, and skipping tags that end up empty).
+func carbonTaggedSeries(name string, tags map[string]string) string {
+
+	var keys []string
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	series := carbonTagValue(name)
+	for _, key := range keys {
+		value := carbonTagValue(tags[key])
+		if len(key) < 1 || len(value) < 1 {
+			continue
+		}
+		series += fmt.Sprintf(";%s=%s", key, value)
+	}
+	return series
+}
+
+// carbonTagName replaces what graphite doesn't allow in tag names (";!^=") along with
+// whitespace and anything that isn't printable ascii.
+func carbonTagName(s string) string {
+	return carbonSanitize(s, ";!^=")
+}
+
+// carbonTagValue replaces what graphite doesn't allow in tag values (and series names), ";",
+// along with whitespace and anything that isn't printable ascii. Values can't start with "~"
+// either so those are trimmed.
+func carbonTagValue(s string) string {
+	return strings.TrimLeft(carbonSanitize(s, ";"), "~")
+}
+
+func carbonSanitize(s string, disallowed string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || strings.ContainsRune(disallowed, r) {
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,268 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package metricsrouter
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bryancallahan/metrics-runner/models"
+)
+
+// carbonTestServer is a stand-in carbon cache collecting the plaintext lines it's sent.
+type carbonTestServer struct {
+	sync.Mutex
+	listener net.Listener
+	lines    []string
+}
+
+func newCarbonTestServer(t *testing.T, address string) *carbonTestServer {
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &carbonTestServer{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					s.Lock()
+					s.lines = append(s.lines, scanner.Text())
+					s.Unlock()
+				}
+			}()
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+
+	return s
+}
+
+// waitFor waits for n lines, returning them.
+func (s *carbonTestServer) waitFor(t *testing.T, n int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.Lock()
+		lines := append([]string(nil), s.lines...)
+		s.Unlock()
+		if len(lines) >= n || time.Now().After(deadline) {
+			return lines
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func carbonTestSamples(start time.Time, from int, to int) []Sample {
+	var samples []Sample
+	for i := from; i < to; i++ {
+		samples = append(samples, Sample{Path: fmt.Sprintf("metricsrunner.test.%d", i), Value: float64(i), Timestamp: start.Add(time.Duration(i) * time.Second)})
+	}
+	return samples
+}
+
+func TestCarbonSinkDestinationDown(t *testing.T) {
+
+	directory, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	// One cache is up, the other (for now) isn't...
+	up := newCarbonTestServer(t, "127.0.0.1:0")
+	reserved, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downAddress := reserved.Addr().String()
+	reserved.Close()
+
+	s, err := newCarbonSink(&models.Config{}, models.ConfigSink{
+		Type:          "carbon",
+		Name:          "carbon",
+		QueueSize:     100,
+		BatchSize:     10,
+		FlushInterval: models.Duration{Duration: 10 * time.Millisecond},
+		Carbon: models.ConfigSinkCarbon{
+			Destinations:      []string{up.listener.Addr().String() + ":a", downAddress + ":b"},
+			Protocol:          "plaintext",
+			Format:            "legacy",
+			Routing:           "all",
+			ReplicationFactor: 1,
+		},
+		Outbox: models.ConfigSinkOutbox{
+			Enabled:       true,
+			Directory:     directory,
+			SegmentSizeMB: 1,
+			SegmentAge:    models.Duration{Duration: time.Hour},
+			MaxSizeMB:     8,
+			MaxAge:        models.Duration{Duration: 24 * time.Hour},
+			Backoff:       "fibonacci",
+			MaxBackoff:    models.Duration{Duration: time.Second},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The cache that's up gets everything straight away, whatever the other is doing...
+	start := time.Unix(1700000000, 0)
+	s.Send(carbonTestSamples(start, 0, 3))
+	if lines := up.waitFor(t, 3); len(lines) != 3 {
+		t.Fatalf("expected 3 lines while the other cache is down, got %v", lines)
+	}
+	s.Send(carbonTestSamples(start, 3, 5))
+	if lines := up.waitFor(t, 5); len(lines) != 5 {
+		t.Fatalf("expected 5 lines while the other cache is down, got %v", lines)
+	}
+	stats := s.destinationStats()
+	if stats[0].OutboxDepth != 0 || stats[0].Sent != 5 || stats[1].Healthy || stats[1].OutboxDepth != 5 {
+		t.Errorf("unexpected destinations %+v", stats)
+	}
+
+	// Once the other's back it gets its share, in order, and no one gets anything twice...
+	down := newCarbonTestServer(t, downAddress)
+	lines := down.waitFor(t, 5)
+	var expected []string
+	for _, sample := range carbonTestSamples(start, 0, 5) {
+		expected = append(expected, fmt.Sprintf("%s %v %d", sample.Path, sample.Value, sample.Timestamp.Unix()))
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected the outbox replayed in order, got %v", lines)
+	}
+
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := up.waitFor(t, 0); len(lines) != 5 {
+		t.Errorf("expected the cache that was up not to be sent anything again, got %v", lines)
+	}
+	stats = s.destinationStats()
+	if !stats[1].Healthy || stats[1].Sent != 5 || stats[1].Replayed != 5 || stats[1].OutboxDepth != 0 {
+		t.Errorf("unexpected destinations %+v", stats)
+	}
+}
+
+func TestCarbonSinkReplicas(t *testing.T) {
+
+	// With two replicas on different servers every metric goes to both of them...
+	servers := []*carbonTestServer{newCarbonTestServer(t, "127.0.0.1:0"), newCarbonTestServer(t, "127.0.0.2:0")}
+	s, err := newCarbonSink(&models.Config{}, models.ConfigSink{
+		Type:          "carbon",
+		Name:          "carbon",
+		QueueSize:     100,
+		BatchSize:     10,
+		FlushInterval: models.Duration{Duration: 10 * time.Millisecond},
+		Carbon: models.ConfigSinkCarbon{
+			Destinations:      []string{servers[0].listener.Addr().String(), servers[1].listener.Addr().String()},
+			Protocol:          "plaintext",
+			Format:            "legacy",
+			Routing:           "consistent-hashing",
+			ReplicationFactor: 2,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Send(carbonTestSamples(time.Unix(1700000000, 0), 0, 20))
+	for i, server := range servers {
+		if lines := server.waitFor(t, 20); len(lines) != 20 {
+			t.Errorf("expected all 20 lines on server %d, got %d", i, len(lines))
+		}
+	}
+}
+
+func TestCarbonTaggedSeries(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		tags     map[string]string
+		expected string
+	}{
+		{"app.elapsed", map[string]string{"type": "http", "check": "home", "env": "prod"}, "app.elapsed;check=home;env=prod;type=http"},
+		{"app.elapsed", nil, "app.elapsed"},
+		{"app.elapsed", map[string]string{"check": "home page;x", "team": "~web ops"}, "app.elapsed;check=home_page_x;team=web_ops"},
+		{"app.elapsed", map[string]string{"check": "héllo\tthere"}, "app.elapsed;check=h_llo_there"},
+		{"app.elapsed", map[string]string{"check": "home", "owner": "", "": "x", "region": "~"}, "app.elapsed;check=home"},
+		{"~app;x.elapsed", map[string]string{"check": "home"}, "app_x.elapsed;check=home"},
+	} {
+		if actual := carbonTaggedSeries(test.name, test.tags); actual != test.expected {
+			t.Errorf("carbonTaggedSeries(%q, %v) = %q, expected %q", test.name, test.tags, actual, test.expected)
+		}
+	}
+
+	if actual := carbonTagName("team=web;x!^y z"); actual != "team_web_x__y_z" {
+		t.Errorf("unexpected tag name %q", actual)
+	}
+}
+
+func TestCarbonSinkName(t *testing.T) {
+
+	s := &carbonSink{
+		config: &models.Config{Name: "Metrics Runner", Env: "Production"},
+		sink:   models.ConfigSink{Type: "carbon", Carbon: models.ConfigSinkCarbon{Format: "tagged"}},
+		tags: map[string]map[string]string{
+			"home": {"team": "web", "Cost Center": "42", "env": "staging", "type": "ftp"},
+		},
+	}
+	now := time.Unix(1700000000, 0)
+
+	for _, test := range []struct {
+		sample   Sample
+		expected string
+	}{
+		// Configured tags are added, but the built in ones win...
+		{
+			Sample{Path: "metricsrunner-prod.http.home.elapsed", Value: 1, Timestamp: now, Check: "home", Type: "http", Field: "elapsed"},
+			"metricsrunner.elapsed;Cost_Center=42;check=home;env=prod;team=web;type=http",
+		},
+		{
+			Sample{Path: "metricsrunner-prod.http.search.status-code", Value: 200, Timestamp: now, Check: "search", Type: "http", Field: "status-code"},
+			"metricsrunner.status-code;check=search;env=prod;type=http",
+		},
+
+		// Relayed metrics (and the canary) keep their path...
+		{Sample{Path: "relayed.cpu.load", Value: 0.5, Timestamp: now}, "relayed.cpu.load"},
+	} {
+		if actual := s.name(test.sample); actual != test.expected {
+			t.Errorf("name of %s = %q, expected %q", test.sample.Path, actual, test.expected)
+		}
+	}
+
+	// The legacy format always uses the path...
+	s.sink.Carbon.Format = "legacy"
+	sample := Sample{Path: "metricsrunner-prod.http.home.elapsed", Value: 1, Timestamp: now, Check: "home", Type: "http", Field: "elapsed"}
+	if actual := s.name(sample); actual != sample.Path {
+		t.Errorf("expected %q, got %q", sample.Path, actual)
+	}
+}
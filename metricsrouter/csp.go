@@ -0,0 +1,244 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package metricsrouter
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bryancallahan/metrics-runner/models"
+)
+
+// CSPCollector counts csp violations by page group, directive and blocked origin (writing the
+// counts through the metrics router every flush interval) and keeps a deduplicated list of
+// recent violations. Only known directives and configured origins get their own series.
+type CSPCollector struct {
+	config        *models.Config
+	metricsRouter *MetricsRouter
+	pageGroups    *models.PageGroups
+	stop          chan struct{}
+	done          chan struct{}
+
+	origins map[string]bool // Blocked origins counted by name (the rest count as "other")
+
+	lock   sync.Mutex
+	counts map[string]int                 // Keyed by metric path
+	recent map[string]*CSPRecentViolation // Keyed by page group, directive and blocked origin
+}
+
+// CSPRecentViolation is a distinct violation with the latest example of it.
+type CSPRecentViolation struct {
+	models.CSPViolation
+	PageGroup string    `json:"pageGroup"`
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// metricSegmentUnsafe matches anything that can't go in a single metric path segment.
+var metricSegmentUnsafe = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+// cspDirectives are the directives counted by name. Reports come from anyone, so anything
+// else counts as "other" (otherwise every made up directive would be a new series).
+var cspDirectives = map[string]bool{
+	"base-uri":                  true,
+	"block-all-mixed-content":   true,
+	"child-src":                 true,
+	"connect-src":               true,
+	"default-src":               true,
+	"fenced-frame-src":          true,
+	"font-src":                  true,
+	"form-action":               true,
+	"frame-ancestors":           true,
+	"frame-src":                 true,
+	"img-src":                   true,
+	"manifest-src":              true,
+	"media-src":                 true,
+	"navigate-to":               true,
+	"object-src":                true,
+	"prefetch-src":              true,
+	"require-trusted-types-for": true,
+	"sandbox":                   true,
+	"script-src":                true,
+	"script-src-attr":           true,
+	"script-src-elem":           true,
+	"style-src":                 true,
+	"style-src-attr":            true,
+	"style-src-elem":            true,
+	"trusted-types":             true,
+	"upgrade-insecure-requests": true,
+	"webrtc":                    true,
+	"worker-src":                true,
+}
+
+// cspKeywordOrigins are the blocked "origins" that aren't one (always counted by name).
+var cspKeywordOrigins = map[string]bool{
+	"about":                true,
+	"blob":                 true,
+	"data":                 true,
+	"eval":                 true,
+	"filesystem":           true,
+	"inline":               true,
+	"mediastream":          true,
+	"none":                 true,
+	"self":                 true,
+	"trusted-types-policy": true,
+	"trusted-types-sink":   true,
+	"wasm-eval":            true,
+}
+
+func NewCSPCollector(config *models.Config, metricsRouter *MetricsRouter) (*CSPCollector, error) {
+
+	pageGroups, err := models.NewPageGroups(config.PageGroups)
+	if err != nil {
+		return nil, err
+	}
+
+	origins := map[string]bool{}
+	for _, origin := range config.CSP.Origins {
+		origins[models.CSPOrigin(origin)] = true
+	}
+
+	return &CSPCollector{
+		config:        config,
+		metricsRouter: metricsRouter,
+		pageGroups:    pageGroups,
+		origins:       origins,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+		counts:        map[string]int{},
+		recent:        map[string]*CSPRecentViolation{},
+	}, nil
+}
+
+// Record counts violations and adds them to the recent list.
+func (c *CSPCollector) Record(violations []models.CSPViolation) {
+
+	now := time.Now().UTC()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, violation := range violations {
+		group := c.pageGroups.Match(violation.DocumentURL)
+		directive := violation.Directive
+		if !cspDirectives[directive] {
+			directive = "other"
+		}
+		origin := violation.BlockedOrigin
+		if !cspKeywordOrigins[origin] && !c.origins[origin] {
+			origin = "other"
+		}
+		c.counts[fmt.Sprintf("csp.%s.%s.%s", metricSegment(group), metricSegment(directive), metricSegment(origin))]++
+
+		key := strings.Join([]string{group, violation.Directive, violation.BlockedOrigin}, "\n")
+		recent, ok := c.recent[key]
+		if !ok {
+			recent = &CSPRecentViolation{PageGroup: group, FirstSeen: now}
+			c.recent[key] = recent
+		}
+		recent.CSPViolation = violation
+		recent.Count++
+		recent.LastSeen = now
+	}
+
+	// Forget the least recently seen once we're over the limit...
+	for len(c.recent) > c.config.CSP.MaxRecent {
+		var oldestKey string
+		var oldest time.Time
+		for key, recent := range c.recent {
+			if len(oldestKey) < 1 || recent.LastSeen.Before(oldest) {
+				oldestKey, oldest = key, recent.LastSeen
+			}
+		}
+		delete(c.recent, oldestKey)
+	}
+}
+
+// Recent returns copies of the recent violations (most recently seen first).
+func (c *CSPCollector) Recent() []CSPRecentViolation {
+
+	c.lock.Lock()
+	recent := make([]CSPRecentViolation, 0, len(c.recent))
+	for _, r := range c.recent {
+		recent = append(recent, *r)
+	}
+	c.lock.Unlock()
+
+	sort.Slice(recent, func(i, j int) bool {
+		return recent[i].LastSeen.After(recent[j].LastSeen)
+	})
+	return recent
+}
+
+// Start flushes every flush interval until stopped.
+func (c *CSPCollector) Start() {
+
+	defer close(c.done)
+
+	for {
+		select {
+		case <-time.After(c.config.CSP.FlushInterval.Duration):
+		case <-c.stop:
+			c.flush()
+			return
+		}
+		c.flush()
+	}
+}
+
+// Stop flushes whatever we've counted so far.
+func (c *CSPCollector) Stop() error {
+
+	const stopTimeout = 30 // Seconds
+
+	close(c.stop)
+
+	select {
+	case <-c.done:
+		return nil
+	case <-time.After(stopTimeout * time.Second):
+		return fmt.Errorf("csp: final flush did not finish within %d seconds", stopTimeout)
+	}
+}
+
+// flush writes the counts since the last flush (then starts over).
+func (c *CSPCollector) flush() {
+
+	c.lock.Lock()
+	counts := c.counts
+	c.counts = map[string]int{}
+	c.lock.Unlock()
+
+	for path, count := range counts {
+		c.metricsRouter.Write(path, float64(count))
+	}
+}
+
+// metricSegment makes a string safe to use as a single metric path segment (e.g.
+// "https://cdn.example.com" becomes "https_cdn_example_com").
+func metricSegment(s string) string {
+	s = strings.Trim(metricSegmentUnsafe.ReplaceAllString(strings.ToLower(s), "_"), "_")
+	if len(s) < 1 {
+		return "unknown"
+	}
+	return s
+}
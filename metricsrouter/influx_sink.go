@@ -0,0 +1,240 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package metricsrouter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bryancallahan/metrics-runner/models"
+)
+
+// influxMaxDatagram keeps udp writes under a typical mtu.
+const influxMaxDatagram = 1400
+
+// influxSink writes line protocol to influxdb. Fields from the same run of a check become one
+// point ("probe,check=homepage,env=production,type=http elapsed=31.2,status-code=200,valid=1"),
+// everything else is written under its path with a single value field.
+type influxSink struct {
+	config   *models.Config
+	sink     models.ConfigSink
+	client   *http.Client
+	writeURL string
+	conn     net.Conn // udp only
+}
+
+func newInfluxSink(config *models.Config, sink models.ConfigSink) (*influxSink, error) {
+
+	options := sink.Influx
+	u, err := url.Parse(options.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &influxSink{config: config, sink: sink}
+	switch u.Scheme {
+	case "udp":
+		s.conn, err = net.Dial("udp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+
+	case "http", "https":
+		s.client = &http.Client{Timeout: options.Timeout.Duration}
+		query := url.Values{}
+		query.Set("precision", "s")
+		if len(options.Token) > 0 {
+			u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+			query.Set("org", options.Org)
+			query.Set("bucket", options.Bucket)
+		} else {
+			u.Path = strings.TrimSuffix(u.Path, "/") + "/write"
+			query.Set("db", options.Database)
+			if len(options.RetentionPolicy) > 0 {
+				query.Set("rp", options.RetentionPolicy)
+			}
+		}
+		u.RawQuery = query.Encode()
+		s.writeURL = u.String()
+
+	default:
+		return nil, fmt.Errorf("cannot write to %s (only http, https and udp urls are supported)", options.URL)
+	}
+
+	return s, nil
+}
+
+func (s *influxSink) Send(samples []Sample) error {
+	lines := influxLines(samples, s.sink.Influx.Measurement, s.config.Env)
+	if len(lines) < 1 {
+		return nil
+	}
+	if s.conn != nil {
+		return s.sendUDP(lines)
+	}
+	return s.sendHTTP(lines)
+}
+
+// sendUDP packs as many lines into each datagram as will fit.
+func (s *influxSink) sendUDP(lines []string) error {
+	var datagram bytes.Buffer
+	for _, line := range lines {
+		if datagram.Len() > 0 && datagram.Len()+len(line)+1 > influxMaxDatagram {
+			_, err := s.conn.Write(datagram.Bytes())
+			if err != nil {
+				return err
+			}
+			datagram.Reset()
+		}
+		datagram.WriteString(line)
+		datagram.WriteByte('\n')
+	}
+	_, err := s.conn.Write(datagram.Bytes())
+	return err
+}
+
+// sendHTTP writes the batch gzipped, retrying (with exponential backoff) on 5xx responses and
+// connection errors.
+func (s *influxSink) sendHTTP(lines []string) error {
+
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	for _, line := range lines {
+		gz.Write([]byte(line))
+		gz.Write([]byte{'\n'})
+	}
+	err := gz.Close()
+	if err != nil {
+		return err
+	}
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		retry, err = s.post(body.Bytes())
+		if err == nil || !retry || attempt >= s.sink.Influx.Retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post makes a single write request, returning whether a failure is worth retrying.
+func (s *influxSink) post(body []byte) (bool, error) {
+
+	req, err := http.NewRequest("POST", s.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("Content-Encoding", "gzip")
+	if len(s.sink.Influx.Token) > 0 {
+		req.Header.Set("Authorization", "Token "+s.sink.Influx.Token)
+	} else if len(s.sink.Influx.Username) > 0 {
+		req.SetBasicAuth(s.sink.Influx.Username, s.sink.Influx.Password)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	response, _ := ioutil.ReadAll(res.Body)
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, nil
+	}
+	return res.StatusCode >= 500, fmt.Errorf("unexpected status code %d: %.256s", res.StatusCode, response)
+}
+
+func (s *influxSink) Close() error {
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
+
+// influxLines converts samples to line protocol (with second precision timestamps).
+func influxLines(samples []Sample, measurement string, env string) []string {
+
+	type point struct {
+		key    string
+		tags   string
+		fields []string
+		time   int64
+	}
+	var points []*point
+	checks := map[string]*point{}
+
+	for _, sample := range samples {
+		if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+			continue // Line protocol can't represent these
+		}
+		field := influxEscape(sample.Field, ",= ") + "=" + strconv.FormatFloat(sample.Value, 'g', -1, 64)
+		timestamp := sample.Timestamp.Unix()
+
+		// Group a check's fields from the same run (which all carry its start time) into one point...
+		if len(sample.Check) > 0 {
+			key := fmt.Sprintf("%s\n%s\n%d", sample.Type, sample.Check, sample.Timestamp.UnixNano())
+			if p, ok := checks[key]; ok {
+				p.fields = append(p.fields, field)
+				continue
+			}
+			p := &point{
+				key: influxEscape(measurement, ", "),
+				tags: fmt.Sprintf(",check=%s,env=%s,type=%s", influxEscape(sample.Check, ",= "),
+					influxEscape(env, ",= "), influxEscape(sample.Type, ",= ")),
+				fields: []string{field},
+				time:   timestamp,
+			}
+			checks[key] = p
+			points = append(points, p)
+			continue
+		}
+
+		points = append(points, &point{
+			key:    influxEscape(sample.Path, ", "),
+			tags:   fmt.Sprintf(",env=%s", influxEscape(env, ",= ")),
+			fields: []string{"value=" + strconv.FormatFloat(sample.Value, 'g', -1, 64)},
+			time:   timestamp,
+		})
+	}
+
+	lines := make([]string, len(points))
+	for i, p := range points {
+		lines[i] = fmt.Sprintf("%s%s %s %d", p.key, p.tags, strings.Join(p.fields, ","), p.time)
+	}
+	return lines
+}
+
+// influxEscape backslash escapes the given characters.
+func influxEscape(s string, chars string) string {
+	for _, c := range chars {
+		s = strings.Replace(s, string(c), `\`+string(c), -1)
+	}
+	return s
+}
@@ -0,0 +1,49 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package metricsrouter
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInfluxLines(t *testing.T) {
+
+	// A run's fields go together (even written either side of a second), one run per point...
+	first := time.Unix(1700000000, 999000000)
+	second := time.Unix(1700000001, 200000000)
+	samples := []Sample{
+		{Path: "a.http.home.elapsed", Value: 12.5, Timestamp: first, Check: "home", Type: "http", Field: "elapsed"},
+		{Path: "a.http.home.status-code", Value: 200, Timestamp: first, Check: "home", Type: "http", Field: "status-code"},
+		{Path: "a.http.home.elapsed", Value: 13, Timestamp: second, Check: "home", Type: "http", Field: "elapsed"},
+		{Path: "a.http.home.valid", Value: 1, Timestamp: first, Check: "home", Type: "http", Field: "valid"},
+		{Path: "a.http.home.valid", Value: math.NaN(), Timestamp: second, Check: "home", Type: "http", Field: "valid"},
+		{Path: "relayed.cpu load", Value: 0.5, Timestamp: second},
+	}
+
+	lines := influxLines(samples, "probe", "prod")
+	expected := []string{
+		"probe,check=home,env=prod,type=http elapsed=12.5,status-code=200,valid=1 1700000000",
+		"probe,check=home,env=prod,type=http elapsed=13 1700000001",
+		`relayed.cpu\ load,env=prod value=0.5 1700000001`,
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected lines\n%s", strings.Join(lines, "\n"))
+	}
+}
@@ -18,80 +18,213 @@ package metricsrouter
 
 import (
 	"fmt"
-	"log"
 	"strings"
+	"sync"
 	"time"
 
-	carbon "github.com/jforman/carbon-golang"
-
 	"github.com/bryancallahan/metrics-runner/models"
 )
 
 type MetricsRouter struct {
-	config         *models.Config
-	carbonReceiver *carbon.Carbon
-}
+	config  *models.Config
+	workers []*sinkWorker
+	stop    chan struct{}
 
-func connect(config *models.Config) (*carbon.Carbon, error) {
-	return carbon.NewCarbon(config.MetricsRouter.CarbonHost, config.MetricsRouter.CarbonPort,
-		!config.MetricsRouter.Enabled, config.MetricsRouter.Verbose)
+	closeLock sync.RWMutex
+	closed    bool // Writes after we close are ignored
 }
 
-// MetricsRouter initializes a structure and communicates for carbon stats reporting.
-func NewMetricsRouter(config *models.Config) (*MetricsRouter, error) {
+// MetricsRouter initializes a structure and fans metrics out to every enabled sink.
+func NewMetricsRouter(version *models.Version, config *models.Config) (*MetricsRouter, error) {
+
+	m := &MetricsRouter{
+		config: config,
+		stop:   make(chan struct{}),
+	}
+
+	// If we aren't enabled, don't send anything anywhere...
+	if !config.MetricsRouter.Enabled {
+		return m, nil
+	}
+
+	// The original carbonHost / carbonPort (etc.) settings become a sink of their own (unless
+	// one's already called carbon)...
+	sinks := config.MetricsRouter.Sinks
+	if len(config.MetricsRouter.CarbonHost) > 0 && !hasSink(sinks, "carbon") {
+		sinks = append([]models.ConfigSink{{
+			Enabled:       true,
+			Type:          "carbon",
+			Name:          "carbon",
+			QueueSize:     10000,
+			BatchSize:     500,
+			FlushInterval: models.Duration{Duration: time.Second},
+			Carbon: models.ConfigSinkCarbon{
+				Host:              config.MetricsRouter.CarbonHost,
+				Port:              config.MetricsRouter.CarbonPort,
+				Protocol:          config.MetricsRouter.CarbonProtocol,
+				Routing:           "consistent-hashing",
+				ReplicationFactor: 1,
+				Format:            config.MetricsRouter.CarbonFormat,
+			},
+			Outbox: config.MetricsRouter.CarbonOutbox,
+		}}, sinks...)
+	}
+
+	var errs []string
+	for _, sinkConfig := range sinks {
+		if !sinkConfig.Enabled {
+			continue
+		}
+		sink, err := newSink(version, config, sinkConfig)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("sink %s: %s", sinkConfig.Name, err))
+			continue
+		}
+		m.workers = append(m.workers, newSinkWorker(sinkConfig, sink))
+	}
+
+	if len(m.workers) > 0 {
+		go m.writeSinkStats()
+	}
 
-	carbonReceiver, err := connect(config)
-	if err != nil {
-		return &MetricsRouter{
-			config:         config,
-			carbonReceiver: nil,
-		}, err
+	if len(errs) > 0 {
+		return m, fmt.Errorf("error creating sinks (%s)", strings.Join(errs, ", "))
 	}
+	return m, nil
+}
 
-	return &MetricsRouter{
-		config:         config,
-		carbonReceiver: carbonReceiver,
-	}, nil
+func hasSink(sinks []models.ConfigSink, name string) bool {
+	for _, sink := range sinks {
+		if sink.Name == name {
+			return true
+		}
+	}
+	return false
 }
 
 func (m *MetricsRouter) Write(path string, value float64) {
+	m.WriteAt(path, value, time.Now())
+}
 
-	// Note: github.com/jforman/carbon-golang is not ideal. It doesn't handle
-	//  reconnections. So if grafana is restarted, all services that send to it
-	//  would need to be restarted too. No client-side fibb backoff or client-side
-	//  metric queuing. :'(
-	//
-	// To address this for now, we'll just try to reconnect if there's ANY kind
-	//  of error and try again. If that doesn't succeed, just drop the metric. :'(
-
-	now := time.Now().Unix()
+// Path returns the full path a metric is written to (prefixed with our name and environment).
+func (m *MetricsRouter) Path(path string) string {
 	name := strings.Replace(strings.ToLower(m.config.Name), " ", "", -1)
-	fullPath := fmt.Sprintf("%s-%s.%s", name, strings.ToLower(m.config.Env)[0:4], path)
+	return fmt.Sprintf("%s-%s.%s", name, strings.ToLower(m.config.Env)[0:4], path)
+}
+
+// WriteAt writes a metric with the given timestamp (rather than now).
+func (m *MetricsRouter) WriteAt(path string, value float64, timestamp time.Time) {
+	m.WriteFull(m.Path(path), value, timestamp)
+}
 
-	// If we don't have a receiver, don't send the metric...
-	if !m.config.MetricsRouter.Enabled || m.carbonReceiver == nil || !m.carbonReceiver.IsDefined() {
+// WriteFull writes a metric as is (without prefixing our name and environment), e.g. for
+// lines we relay on behalf of other services.
+func (m *MetricsRouter) WriteFull(fullPath string, value float64, timestamp time.Time) {
+	m.write(Sample{Path: fullPath, Value: value, Timestamp: timestamp})
+}
+
+// WriteCheck writes a field of a metrics runner's check (to "<type>.<check>.<field>"). Every
+// field from a run is timestamped with when the run started, so sinks can tell which go together.
+func (m *MetricsRouter) WriteCheck(checkType string, check string, field string, value float64, run time.Time) {
+	m.write(Sample{
+		Path:      m.Path(fmt.Sprintf("%s.%s.%s", checkType, check, field)),
+		Value:     value,
+		Timestamp: run,
+		Check:     check,
+		Type:      checkType,
+		Field:     field,
+	})
+}
+
+func (m *MetricsRouter) write(sample Sample) {
+
+	m.closeLock.RLock()
+	defer m.closeLock.RUnlock()
+	if m.closed {
 		return
 	}
 
-	err := m.carbonReceiver.SendMetric(carbon.Metric{Name: fullPath, Value: value, Timestamp: now})
-	if err != nil {
+	// Every sink gets its own copy (a full queue drops the metric for that sink only)...
+	for _, worker := range m.workers {
+		worker.enqueue(sample)
+	}
+}
 
-		// Attempt to reconnect...
-		log.Println(fmt.Sprintf("error sending metric from metrics router: %s", err))
-		log.Println(fmt.Sprintf("attempting to reconnect to %s:%d...", m.config.MetricsRouter.CarbonHost, m.config.MetricsRouter.CarbonPort))
-		carbonReceiver, connErr := connect(m.config)
-		if connErr != nil {
-			log.Println(fmt.Sprintf("reconnect to %s:%d failed: %s (dropping metric for %s)", m.config.MetricsRouter.CarbonHost, m.config.MetricsRouter.CarbonPort, connErr, path))
-			return
+// SinkStats returns the counters of every sink.
+func (m *MetricsRouter) SinkStats() []SinkStats {
+	stats := make([]SinkStats, len(m.workers))
+	for i, worker := range m.workers {
+		stats[i] = worker.stats()
+	}
+	return stats
+}
+
+// Close stops the sinks, giving each a chance to send what's still queued.
+func (m *MetricsRouter) Close() error {
+
+	const drainTimeout = 10 * time.Second
+
+	m.closeLock.Lock()
+	if m.closed {
+		m.closeLock.Unlock()
+		return nil
+	}
+	m.closed = true
+	m.closeLock.Unlock()
+
+	close(m.stop)
+
+	var errs []string
+	for _, worker := range m.workers {
+		err := worker.close(drainTimeout)
+		if err != nil {
+			errs = append(errs, err.Error())
 		}
-		m.carbonReceiver = carbonReceiver // Save reconnection handle (for later use too)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("error closing sinks (%s)", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// writeSinkStats writes how many metrics each sink sent, dropped and failed to send every
+// minute (as counts for that minute), along with how its outbox and destinations are doing.
+func (m *MetricsRouter) writeSinkStats() {
 
-		// Send metric again, if we can't then just drop it...
-		log.Println(fmt.Sprintf("connection to %s:%d reestablished, resending metric for %s", m.config.MetricsRouter.CarbonHost, m.config.MetricsRouter.CarbonPort, path))
-		errAttempt2 := m.carbonReceiver.SendMetric(carbon.Metric{Name: fullPath, Value: value, Timestamp: now})
-		if errAttempt2 != nil {
-			log.Println(fmt.Sprintf("error sending metric from metrics router: %s, dropping metric for %s", err, path))
+	last := map[string]SinkStats{}
+	for {
+		select {
+		case <-time.After(time.Minute):
+		case <-m.stop:
 			return
 		}
+
+		for _, stats := range m.SinkStats() {
+			previous := last[stats.Name]
+			m.Write(fmt.Sprintf("sinks.%s.sent", stats.Name), float64(stats.Sent-previous.Sent))
+			m.Write(fmt.Sprintf("sinks.%s.dropped", stats.Name), float64(stats.Dropped-previous.Dropped))
+			m.Write(fmt.Sprintf("sinks.%s.errors", stats.Name), float64(stats.Errors-previous.Errors))
+			m.Write(fmt.Sprintf("sinks.%s.queued", stats.Name), float64(stats.Queued))
+			if stats.Outbox {
+				m.Write(fmt.Sprintf("sinks.%s.outbox.depth", stats.Name), float64(stats.OutboxDepth))
+				m.Write(fmt.Sprintf("sinks.%s.outbox.replayed", stats.Name), float64(stats.Replayed-previous.Replayed))
+				m.Write(fmt.Sprintf("sinks.%s.outbox.overflowed", stats.Name), float64(stats.Overflowed-previous.Overflowed))
+			}
+			for _, destination := range stats.Destinations {
+				healthy := 0.0
+				if destination.Healthy {
+					healthy = 1
+				}
+				path := fmt.Sprintf("sinks.%s.destinations.%s", stats.Name, metricSegment(destination.Address))
+				if len(destination.Instance) > 0 {
+					path += "." + metricSegment(destination.Instance)
+				}
+				m.Write(path+".healthy", healthy)
+				if stats.Outbox {
+					m.Write(path+".outbox.depth", float64(destination.OutboxDepth))
+				}
+			}
+			last[stats.Name] = stats
+		}
 	}
 }
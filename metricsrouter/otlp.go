@@ -0,0 +1,311 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package metricsrouter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"strconv"
+)
+
+// The subset of opentelemetry's metrics data model we export. The json tags follow otlp/json
+// (camel case with 64 bit integers as strings) and each type can also marshal itself to
+// protobuf (see opentelemetry/proto/metrics/v1/metrics.proto for the field numbers).
+
+const (
+	otlpDelta      = 1 // AGGREGATION_TEMPORALITY_DELTA
+	otlpCumulative = 2 // AGGREGATION_TEMPORALITY_CUMULATIVE
+)
+
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope     `json:"scope"`
+	Metrics []*otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpMetric struct {
+	Name      string         `json:"name"`
+	Unit      string         `json:"unit,omitempty"`
+	Gauge     *otlpGauge     `json:"gauge,omitempty"`
+	Sum       *otlpSum       `json:"sum,omitempty"`
+	Histogram *otlpHistogram `json:"histogram,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano uint64         `json:"startTimeUnixNano,string,omitempty"`
+	TimeUnixNano      uint64         `json:"timeUnixNano,string"`
+	AsDouble          float64        `json:"asDouble"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano uint64         `json:"startTimeUnixNano,string"`
+	TimeUnixNano      uint64         `json:"timeUnixNano,string"`
+	Count             uint64         `json:"count,string"`
+	Sum               float64        `json:"sum"`
+	BucketCounts      otlpUint64s    `json:"bucketCounts"`
+	ExplicitBounds    []float64      `json:"explicitBounds"`
+	Min               float64        `json:"min"`
+	Max               float64        `json:"max"`
+}
+
+// otlpUint64s marshals to a json array of strings (as otlp/json wants 64 bit integers).
+type otlpUint64s []uint64
+
+func (u otlpUint64s) MarshalJSON() ([]byte, error) {
+	values := make([]string, len(u))
+	for i, value := range u {
+		values[i] = strconv.FormatUint(value, 10)
+	}
+	return json.Marshal(values)
+}
+
+// UnmarshalJSON accepts strings or numbers (otlp/json receivers have to take both).
+func (u *otlpUint64s) UnmarshalJSON(b []byte) error {
+	var values []json.Number
+	err := json.Unmarshal(b, &values)
+	if err != nil {
+		return err
+	}
+	*u = make(otlpUint64s, len(values))
+	for i, value := range values {
+		(*u)[i], err = strconv.ParseUint(value.String(), 10, 64)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func otlpString(key string, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: &value}}
+}
+
+func otlpBool(key string, value bool) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{BoolValue: &value}}
+}
+
+// protoWriter appends protobuf fields to a buffer.
+type protoWriter struct {
+	bytes.Buffer
+}
+
+func (w *protoWriter) key(field int, wireType int) {
+	w.varint(uint64(field<<3 | wireType))
+}
+
+func (w *protoWriter) varint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	w.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func (w *protoWriter) fixed64(field int, v uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	w.key(field, 1)
+	w.Write(buf[:])
+}
+
+func (w *protoWriter) double(field int, v float64) {
+	w.fixed64(field, math.Float64bits(v))
+}
+
+func (w *protoWriter) enum(field int, v int) {
+	w.key(field, 0)
+	w.varint(uint64(v))
+}
+
+func (w *protoWriter) bool(field int, v bool) {
+	w.key(field, 0)
+	if v {
+		w.varint(1)
+	} else {
+		w.varint(0)
+	}
+}
+
+func (w *protoWriter) bytes(field int, b []byte) {
+	w.key(field, 2)
+	w.varint(uint64(len(b)))
+	w.Write(b)
+}
+
+func (w *protoWriter) string(field int, s string) {
+	w.bytes(field, []byte(s))
+}
+
+// message writes a nested message (encoded by the given function).
+func (w *protoWriter) message(field int, encode func(*protoWriter)) {
+	var nested protoWriter
+	encode(&nested)
+	w.bytes(field, nested.Bytes())
+}
+
+func (w *protoWriter) packedFixed64s(field int, values []uint64) {
+	var packed protoWriter
+	for _, v := range values {
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], v)
+		packed.Write(buf[:])
+	}
+	w.bytes(field, packed.Bytes())
+}
+
+func (w *protoWriter) packedDoubles(field int, values []float64) {
+	bits := make([]uint64, len(values))
+	for i, v := range values {
+		bits[i] = math.Float64bits(v)
+	}
+	w.packedFixed64s(field, bits)
+}
+
+func (r *otlpRequest) marshalProto() []byte {
+	var w protoWriter
+	for i := range r.ResourceMetrics {
+		w.message(1, r.ResourceMetrics[i].encode)
+	}
+	return w.Bytes()
+}
+
+func (r *otlpResourceMetrics) encode(w *protoWriter) {
+	w.message(1, func(w *protoWriter) {
+		encodeAttributes(w, 1, r.Resource.Attributes)
+	})
+	for i := range r.ScopeMetrics {
+		w.message(2, r.ScopeMetrics[i].encode)
+	}
+}
+
+func (s *otlpScopeMetrics) encode(w *protoWriter) {
+	w.message(1, func(w *protoWriter) {
+		w.string(1, s.Scope.Name)
+	})
+	for _, metric := range s.Metrics {
+		w.message(2, metric.encode)
+	}
+}
+
+func (m *otlpMetric) encode(w *protoWriter) {
+	w.string(1, m.Name)
+	if len(m.Unit) > 0 {
+		w.string(3, m.Unit)
+	}
+	switch {
+	case m.Gauge != nil:
+		w.message(5, func(w *protoWriter) {
+			encodeNumberDataPoints(w, m.Gauge.DataPoints)
+		})
+	case m.Sum != nil:
+		w.message(7, func(w *protoWriter) {
+			encodeNumberDataPoints(w, m.Sum.DataPoints)
+			w.enum(2, m.Sum.AggregationTemporality)
+			w.bool(3, m.Sum.IsMonotonic)
+		})
+	case m.Histogram != nil:
+		w.message(9, func(w *protoWriter) {
+			for i := range m.Histogram.DataPoints {
+				w.message(1, m.Histogram.DataPoints[i].encode)
+			}
+			w.enum(2, m.Histogram.AggregationTemporality)
+		})
+	}
+}
+
+func encodeNumberDataPoints(w *protoWriter, points []otlpNumberDataPoint) {
+	for _, point := range points {
+		w.message(1, func(w *protoWriter) {
+			if point.StartTimeUnixNano > 0 {
+				w.fixed64(2, point.StartTimeUnixNano)
+			}
+			w.fixed64(3, point.TimeUnixNano)
+			w.double(4, point.AsDouble) // Part of a oneof so it's written even when zero
+			encodeAttributes(w, 7, point.Attributes)
+		})
+	}
+}
+
+func (p *otlpHistogramDataPoint) encode(w *protoWriter) {
+	w.fixed64(2, p.StartTimeUnixNano)
+	w.fixed64(3, p.TimeUnixNano)
+	w.fixed64(4, p.Count)
+	w.double(5, p.Sum)
+	w.packedFixed64s(6, p.BucketCounts)
+	w.packedDoubles(7, p.ExplicitBounds)
+	encodeAttributes(w, 9, p.Attributes)
+	w.double(11, p.Min)
+	w.double(12, p.Max)
+}
+
+func encodeAttributes(w *protoWriter, field int, attributes []otlpKeyValue) {
+	for _, attribute := range attributes {
+		w.message(field, func(w *protoWriter) {
+			w.string(1, attribute.Key)
+			w.message(2, func(w *protoWriter) {
+				switch {
+				case attribute.Value.StringValue != nil:
+					w.string(1, *attribute.Value.StringValue)
+				case attribute.Value.BoolValue != nil:
+					w.bool(2, *attribute.Value.BoolValue)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,321 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package metricsrouter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bryancallahan/metrics-runner/models"
+)
+
+// otlpElapsedBounds are the upper bounds (in milliseconds) of the elapsed histograms.
+var otlpElapsedBounds = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000}
+
+// otlpSink exports metrics to an opentelemetry collector over otlp/http. A check's elapsed
+// fields become histograms ("probe.elapsed", "probe.connect_elapsed", etc.), its runs a
+// cumulative sum ("probe.runs") and every other field a gauge ("probe.status_code"), each
+// with the check's name, type and url as attributes. Anything else is a gauge under its path.
+type otlpSink struct {
+	sink      models.ConfigSink
+	client    *http.Client
+	exportURL string
+	resource  []otlpKeyValue
+	urls      map[string]string // Check name to url
+	start     time.Time
+
+	runs        map[string]*otlpRuns
+	lastElapsed map[string]time.Time // When each elapsed histogram's last data point ended
+}
+
+// otlpRuns counts a check's runs (by whether they were valid) since we started.
+type otlpRuns struct {
+	attributes []otlpKeyValue
+	count      float64
+}
+
+func newOTLPSink(version *models.Version, config *models.Config, sink models.ConfigSink) (*otlpSink, error) {
+
+	options := sink.OTLP
+	u, err := url.Parse(options.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("cannot export to %s (only http and https urls are supported)", options.URL)
+	}
+	if options.Encoding != "protobuf" && options.Encoding != "json" {
+		return nil, fmt.Errorf("encoding %s is currently not supported", options.Encoding)
+	}
+	if len(strings.Trim(u.Path, "/")) < 1 {
+		u.Path = "/v1/metrics"
+	}
+
+	s := &otlpSink{
+		sink:        sink,
+		client:      &http.Client{Timeout: options.Timeout.Duration},
+		exportURL:   u.String(),
+		urls:        map[string]string{},
+		start:       time.Now(),
+		runs:        map[string]*otlpRuns{},
+		lastElapsed: map[string]time.Time{},
+	}
+
+	s.resource = []otlpKeyValue{
+		otlpString("service.name", config.Name),
+		otlpString("deployment.environment", config.Env),
+	}
+	if version != nil && len(version.ShortHash) > 0 {
+		s.resource = append(s.resource, otlpString("service.version", version.BuildHash()))
+	}
+
+	for _, metric := range config.Metrics {
+		s.urls[metric.Name] = metric.URL
+	}
+
+	return s, nil
+}
+
+func (s *otlpSink) Send(samples []Sample) error {
+
+	request := s.request(samples)
+	if len(request.ResourceMetrics[0].ScopeMetrics[0].Metrics) < 1 {
+		return nil
+	}
+
+	var body []byte
+	var err error
+	contentType := "application/x-protobuf"
+	if s.sink.OTLP.Encoding == "json" {
+		contentType = "application/json"
+		body, err = json.Marshal(request)
+		if err != nil {
+			return err
+		}
+	} else {
+		body = request.marshalProto()
+	}
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(body)
+	err = gz.Close()
+	if err != nil {
+		return err
+	}
+
+	// Retry with exponential backoff (unless the collector tells us how long to wait)...
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		var retryAfter time.Duration
+		retry, retryAfter, err = s.post(compressed.Bytes(), contentType)
+		if err == nil || !retry || attempt >= s.sink.OTLP.Retries {
+			return err
+		}
+		if retryAfter > 0 {
+			time.Sleep(retryAfter)
+		} else {
+			time.Sleep(backoff)
+		}
+		backoff *= 2
+	}
+}
+
+// post makes a single export request, returning whether a failure is worth retrying (and
+// after how long if the collector said).
+func (s *otlpSink) post(body []byte, contentType string) (bool, time.Duration, error) {
+
+	req, err := http.NewRequest("POST", s.exportURL, bytes.NewReader(body))
+	if err != nil {
+		return false, 0, err
+	}
+	for name, value := range s.sink.OTLP.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Content-Encoding", "gzip")
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return true, 0, err
+	}
+	defer res.Body.Close()
+	response, _ := ioutil.ReadAll(res.Body)
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, 0, nil
+	}
+
+	err = fmt.Errorf("unexpected status code %d: %.256s", res.StatusCode, response)
+	switch res.StatusCode {
+	case 429, 502, 503, 504:
+		seconds, _ := strconv.Atoi(res.Header.Get("Retry-After"))
+		return true, time.Duration(seconds) * time.Second, err
+	}
+	return false, 0, err
+}
+
+func (s *otlpSink) Close() error {
+	return nil
+}
+
+// request maps a batch of samples to otel instruments (skipping NaNs and infinities).
+func (s *otlpSink) request(samples []Sample) *otlpRequest {
+
+	var metrics []*otlpMetric
+	byName := map[string]*otlpMetric{}
+	metric := func(name string, unit string) *otlpMetric {
+		if byName[name] == nil {
+			byName[name] = &otlpMetric{Name: name, Unit: unit}
+			metrics = append(metrics, byName[name])
+		}
+		return byName[name]
+	}
+
+	histograms := map[string]*otlpHistogramDataPoint{}
+	var histogramKeys []string
+	updatedRuns := map[string]bool{}
+
+	for _, sample := range samples {
+		if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+			continue
+		}
+		timestamp := uint64(sample.Timestamp.UnixNano())
+
+		// Anything that isn't from a check is a plain gauge...
+		if len(sample.Check) < 1 {
+			m := metric(sample.Path, "")
+			if m.Gauge == nil {
+				m.Gauge = &otlpGauge{}
+			}
+			m.Gauge.DataPoints = append(m.Gauge.DataPoints, otlpNumberDataPoint{TimeUnixNano: timestamp, AsDouble: sample.Value})
+			continue
+		}
+
+		attributes := []otlpKeyValue{otlpString("check.name", sample.Check), otlpString("check.type", sample.Type)}
+		if len(s.urls[sample.Check]) > 0 {
+			attributes = append(attributes, otlpString("check.url", s.urls[sample.Check]))
+		}
+		name := "probe." + strings.Replace(sample.Field, "-", "_", -1)
+
+		// Every run writes valid once, so that's what we count runs by...
+		if sample.Field == "valid" {
+			valid := sample.Value > 0
+			key := fmt.Sprintf("%s\x00%s\x00%t", sample.Type, sample.Check, valid)
+			if s.runs[key] == nil {
+				s.runs[key] = &otlpRuns{attributes: append(attributes, otlpBool("valid", valid))}
+			}
+			s.runs[key].count++
+			updatedRuns[key] = true
+		}
+
+		// Elapsed fields are aggregated into one histogram data point per batch...
+		if sample.Field == "elapsed" || strings.HasSuffix(sample.Field, "-elapsed") {
+			key := fmt.Sprintf("%s\x00%s\x00%s", name, sample.Type, sample.Check)
+			point := histograms[key]
+			if point == nil {
+				start, ok := s.lastElapsed[key]
+				if !ok {
+					start = s.start
+				}
+				point = &otlpHistogramDataPoint{
+					Attributes:        attributes,
+					StartTimeUnixNano: uint64(start.UnixNano()),
+					BucketCounts:      make(otlpUint64s, len(otlpElapsedBounds)+1),
+					ExplicitBounds:    otlpElapsedBounds,
+					Min:               sample.Value,
+					Max:               sample.Value,
+				}
+				histograms[key] = point
+				histogramKeys = append(histogramKeys, key)
+
+				m := metric(name, "ms")
+				if m.Histogram == nil {
+					m.Histogram = &otlpHistogram{AggregationTemporality: otlpDelta}
+				}
+			}
+			point.Count++
+			point.Sum += sample.Value
+			point.BucketCounts[sort.SearchFloat64s(otlpElapsedBounds, sample.Value)]++
+			point.Min = math.Min(point.Min, sample.Value)
+			point.Max = math.Max(point.Max, sample.Value)
+			if timestamp > point.TimeUnixNano {
+				point.TimeUnixNano = timestamp
+			}
+			continue
+		}
+
+		m := metric(name, "")
+		if m.Gauge == nil {
+			m.Gauge = &otlpGauge{}
+		}
+		m.Gauge.DataPoints = append(m.Gauge.DataPoints, otlpNumberDataPoint{
+			Attributes:   attributes,
+			TimeUnixNano: timestamp,
+			AsDouble:     sample.Value,
+		})
+	}
+
+	for _, key := range histogramKeys {
+		point := histograms[key]
+		if point.TimeUnixNano <= point.StartTimeUnixNano {
+			point.TimeUnixNano = point.StartTimeUnixNano + 1 // A data point can't end before it starts
+		}
+		s.lastElapsed[key] = time.Unix(0, int64(point.TimeUnixNano))
+		m := byName[key[:strings.Index(key, "\x00")]]
+		m.Histogram.DataPoints = append(m.Histogram.DataPoints, *point)
+	}
+
+	// Runs are cumulative (we only send the counts that changed)...
+	if len(updatedRuns) > 0 {
+		m := metric("probe.runs", "{run}")
+		m.Sum = &otlpSum{AggregationTemporality: otlpCumulative, IsMonotonic: true}
+		now := uint64(time.Now().UnixNano())
+		var keys []string
+		for key := range updatedRuns {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			m.Sum.DataPoints = append(m.Sum.DataPoints, otlpNumberDataPoint{
+				Attributes:        s.runs[key].attributes,
+				StartTimeUnixNano: uint64(s.start.UnixNano()),
+				TimeUnixNano:      now,
+				AsDouble:          s.runs[key].count,
+			})
+		}
+	}
+
+	return &otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: s.resource},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope:   otlpScope{Name: "metrics-runner"},
+			Metrics: metrics,
+		}},
+	}}}
+}
@@ -0,0 +1,243 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package metricsrouter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// otlpGolden is otlpTestRequest as encoded by the official protobuf-go bindings
+// (go.opentelemetry.io/proto/otlp v1.3.1, ExportMetricsServiceRequest).
+const otlpGolden = "0ac7030a4a0a200a0c736572766963652e6e616d6512100a0e6d6574726963732d72756e6e65720a260a1664" +
+	"65706c6f796d656e742e656e7669726f6e6d656e74120c0a0a70726f64756374696f6e12f8020a100a0e6d65747269" +
+	"63732d72756e6e657212590a10687474702e7374617475732d636f64652a450a431900002a36fe9c97173a190a0a63" +
+	"6865636b2e6e616d65120b0a09686f6d6520706167653a140a0a636865636b2e7479706512060a0468747470210000" +
+	"00000000694012320a0d636f6d706172652e64656c74612a210a1f1900002a36fe9c97173a0b0a0576616c69641202" +
+	"1000210000000000000000123c0a0a70726f62652e72756e733a2e0a2811000069c60b1674171900002a36fe9c9717" +
+	"3a0b0a0576616c696412021001210000000000004540100218011296010a0c687474702e656c61707365641a026d73" +
+	"4a81010a7d1100a8e23df09c97171900002a36fe9c9717210300000000000000290000000000c04e40321801000000" +
+	"00000000020000000000000000000000000000003a10000000000000244000000000000049404a190a0a636865636b" +
+	"2e6e616d65120b0a09686f6d652070616765590000000000001240610000000000003f401001"
+
+func otlpTestRequest() *otlpRequest {
+
+	const now = 1700000000000000000
+	return &otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{
+			otlpString("service.name", "metrics-runner"),
+			otlpString("deployment.environment", "production"),
+		}},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope: otlpScope{Name: "metrics-runner"},
+			Metrics: []*otlpMetric{
+				{Name: "http.status-code", Gauge: &otlpGauge{DataPoints: []otlpNumberDataPoint{{
+					Attributes:   []otlpKeyValue{otlpString("check.name", "home page"), otlpString("check.type", "http")},
+					TimeUnixNano: now,
+					AsDouble:     200,
+				}}}},
+				{Name: "compare.delta", Gauge: &otlpGauge{DataPoints: []otlpNumberDataPoint{{
+					Attributes:   []otlpKeyValue{otlpBool("valid", false)},
+					TimeUnixNano: now,
+					AsDouble:     0,
+				}}}},
+				{Name: "probe.runs", Sum: &otlpSum{
+					DataPoints: []otlpNumberDataPoint{{
+						Attributes:        []otlpKeyValue{otlpBool("valid", true)},
+						StartTimeUnixNano: 1690000000000000000,
+						TimeUnixNano:      now,
+						AsDouble:          42,
+					}},
+					AggregationTemporality: otlpCumulative,
+					IsMonotonic:            true,
+				}},
+				{Name: "http.elapsed", Unit: "ms", Histogram: &otlpHistogram{
+					DataPoints: []otlpHistogramDataPoint{{
+						Attributes:        []otlpKeyValue{otlpString("check.name", "home page")},
+						StartTimeUnixNano: 1699999940000000000,
+						TimeUnixNano:      now,
+						Count:             3,
+						Sum:               61.5,
+						BucketCounts:      otlpUint64s{1, 2, 0},
+						ExplicitBounds:    []float64{10, 50},
+						Min:               4.5,
+						Max:               31,
+					}},
+					AggregationTemporality: otlpDelta,
+				}},
+			},
+		}},
+	}}}
+}
+
+// otlpTestSchema says which fields of each message are nested messages (by message name) or
+// packed repeated fields. Everything else is a scalar.
+var otlpTestSchema = map[string]map[int]string{
+	"ExportMetricsServiceRequest": {1: "ResourceMetrics"},
+	"ResourceMetrics":             {1: "Resource", 2: "ScopeMetrics"},
+	"Resource":                    {1: "KeyValue"},
+	"ScopeMetrics":                {1: "InstrumentationScope", 2: "Metric"},
+	"InstrumentationScope":        {},
+	"KeyValue":                    {2: "AnyValue"},
+	"AnyValue":                    {},
+	"Metric":                      {5: "Gauge", 7: "Sum", 9: "Histogram"},
+	"Gauge":                       {1: "NumberDataPoint"},
+	"Sum":                         {1: "NumberDataPoint"},
+	"Histogram":                   {1: "HistogramDataPoint"},
+	"NumberDataPoint":             {7: "KeyValue"},
+	"HistogramDataPoint":          {6: "packed", 7: "packed", 9: "KeyValue"},
+}
+
+// otlpTestDecode decodes a protobuf message into a canonical string (fields in field number
+// order, repeated fields in the order they came), so encodings that only differ in field
+// order (protobuf-go writes oneofs last, for instance) compare equal.
+func otlpTestDecode(t *testing.T, message string, b []byte) string {
+
+	schema, ok := otlpTestSchema[message]
+	if !ok {
+		t.Fatalf("unknown message %s", message)
+	}
+
+	type field struct {
+		number int
+		value  string
+	}
+	var fields []field
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("%s: malformed key", message)
+		}
+		b = b[n:]
+		number, wireType := int(key>>3), int(key&7)
+
+		var value string
+		switch wireType {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatalf("%s.%d: malformed varint", message, number)
+			}
+			b = b[n:]
+			value = fmt.Sprintf("%d", v)
+		case 1:
+			if len(b) < 8 {
+				t.Fatalf("%s.%d: truncated fixed64", message, number)
+			}
+			value = fmt.Sprintf("%016x", binary.LittleEndian.Uint64(b))
+			b = b[8:]
+		case 2:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < length {
+				t.Fatalf("%s.%d: truncated bytes", message, number)
+			}
+			content := b[n : n+int(length)]
+			b = b[n+int(length):]
+			switch nested := schema[number]; nested {
+			case "":
+				value = fmt.Sprintf("%q", content)
+			case "packed":
+				value = hex.EncodeToString(content)
+			default:
+				value = "{" + otlpTestDecode(t, nested, content) + "}"
+			}
+		default:
+			t.Fatalf("%s.%d: unexpected wire type %d", message, number, wireType)
+		}
+
+		fields = append(fields, field{number, value})
+	}
+
+	sort.SliceStable(fields, func(i, j int) bool { return fields[i].number < fields[j].number })
+	var parts []string
+	for _, f := range fields {
+		parts = append(parts, fmt.Sprintf("%d:%s", f.number, f.value))
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestOTLPMarshalProto(t *testing.T) {
+
+	golden, err := hex.DecodeString(otlpGolden)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := otlpTestDecode(t, "ExportMetricsServiceRequest", golden)
+	actual := otlpTestDecode(t, "ExportMetricsServiceRequest", otlpTestRequest().marshalProto())
+	if actual != expected {
+		t.Errorf("encoding differs from protobuf-go's\n got: %s\nwant: %s", actual, expected)
+	}
+
+	// The zero gauge value is in a oneof, so it must still be there...
+	if !strings.Contains(expected, "4:0000000000000000") {
+		t.Errorf("expected the golden encoding to carry the zero as_double")
+	}
+}
+
+func TestOTLPJSONRoundTrip(t *testing.T) {
+
+	request := otlpTestRequest()
+	body, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 64 bit integers are strings in otlp/json...
+	for _, expected := range []string{
+		`"timeUnixNano":"1700000000000000000"`,
+		`"startTimeUnixNano":"1690000000000000000"`,
+		`"count":"3"`,
+		`"bucketCounts":["1","2","0"]`,
+		`"explicitBounds":[10,50]`,
+		`"aggregationTemporality":2`,
+		`"boolValue":false`,
+	} {
+		if !bytes.Contains(body, []byte(expected)) {
+			t.Errorf("expected %s in %s", expected, body)
+		}
+	}
+	if bytes.Contains(body, []byte(`"startTimeUnixNano":"0"`)) {
+		t.Errorf("expected gauges to leave out their start time in %s", body)
+	}
+
+	var decoded otlpRequest
+	err = json.Unmarshal(body, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&decoded, request) {
+		t.Errorf("round trip differs:\n got: %+v\nwant: %+v", decoded, *request)
+	}
+
+	// Receivers have to take plain numbers too...
+	var counts otlpUint64s
+	err = json.Unmarshal([]byte(`["18446744073709551615", 7]`), &counts)
+	if err != nil || !reflect.DeepEqual(counts, otlpUint64s{18446744073709551615, 7}) {
+		t.Errorf("unexpected bucket counts %v (%v)", counts, err)
+	}
+	if json.Unmarshal([]byte(`["-1"]`), &counts) == nil {
+		t.Errorf("expected a negative bucket count to be rejected")
+	}
+}
@@ -0,0 +1,421 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package metricsrouter
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bryancallahan/metrics-runner/models"
+)
+
+// outbox keeps samples a sink couldn't send on disk until they can be replayed. Samples are
+// appended (a json line each) to the newest of a series of segment files named by when they
+// were started, and read back from the oldest. How far we've replayed is kept in a cursor file
+// so a restart picks up where we left off.
+//
+// An outbox is only ever used by its sink's worker goroutine (except for depth).
+type outbox struct {
+	config   models.ConfigSinkOutbox
+	segments []*outboxSegment // Oldest first, the last one is being appended to
+	file     *os.File         // The newest segment (nil until we next append)
+	depth    int64            // Samples waiting to be replayed
+
+	// Where the last peek got to in the oldest segment (committed once they're sent)...
+	peekOffset int64
+	peekCount  int
+}
+
+type outboxSegment struct {
+	path      string
+	started   time.Time
+	lastWrite time.Time
+	size      int64
+	samples   int
+	offset    int64 // How far we've replayed (oldest segment only)
+	replayed  int
+}
+
+type outboxRecord struct {
+	Path  string `json:"path"`
+	Value string `json:"value"` // As a string so NaNs and infinities survive
+	Time  int64  `json:"time"`  // Unix nanoseconds
+	Check string `json:"check,omitempty"`
+	Type  string `json:"type,omitempty"`
+	Field string `json:"field,omitempty"`
+}
+
+const outboxCursorFile = "cursor"
+
+// newOutbox opens an outbox, picking up any segments left from before we restarted.
+func newOutbox(config models.ConfigSinkOutbox) (*outbox, error) {
+
+	err := os.MkdirAll(config.Directory, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &outbox{config: config}
+
+	paths, err := filepath.Glob(filepath.Join(config.Directory, "*.segment"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths) // Zero padded start times so these sort oldest first
+	for _, path := range paths {
+		segment, err := loadOutboxSegment(path)
+		if err != nil {
+			return nil, err
+		}
+		o.segments = append(o.segments, segment)
+		o.depth += int64(segment.samples)
+	}
+
+	// Skip what was already replayed from the oldest segment...
+	cursor, err := ioutil.ReadFile(filepath.Join(config.Directory, outboxCursorFile))
+	if err == nil && len(o.segments) > 0 {
+		fields := strings.Fields(string(cursor))
+		if len(fields) == 2 && fields[0] == filepath.Base(o.segments[0].path) {
+			offset, _ := strconv.ParseInt(fields[1], 10, 64)
+			o.skip(offset)
+		}
+	}
+
+	return o, nil
+}
+
+func loadOutboxSegment(path string) (*outboxSegment, error) {
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	started, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(path), ".segment"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected segment name %s", path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	segment := &outboxSegment{path: path, started: time.Unix(0, started), lastWrite: info.ModTime()}
+	r := bufio.NewReader(file)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			segment.samples++
+			segment.size += int64(len(line))
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	// A crash part way through an append leaves half a line at the end, which goes so our size
+	// (and what we replay) only covers whole samples...
+	if segment.size < info.Size() {
+		err = os.Truncate(path, segment.size)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return segment, nil
+}
+
+// skip moves past samples in the oldest segment that were replayed before a restart.
+func (o *outbox) skip(offset int64) {
+
+	segment := o.segments[0]
+	file, err := os.Open(segment.path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	for segment.offset < offset {
+		line, err := r.ReadBytes('\n')
+		if err != nil || line[len(line)-1] != '\n' {
+			return
+		}
+		segment.offset += int64(len(line))
+		segment.replayed++
+		o.depth--
+	}
+}
+
+// Depth is how many samples are waiting to be replayed (safe to call from any goroutine).
+func (o *outbox) Depth() int64 {
+	return atomic.LoadInt64(&o.depth)
+}
+
+// append adds samples to the newest segment (starting a new one if it's too big or old),
+// returning how many older samples were dropped to stay under our maximum size.
+func (o *outbox) append(samples []Sample) (int, error) {
+
+	var lines []byte
+	for _, sample := range samples {
+		line, err := json.Marshal(outboxRecord{
+			Path:  sample.Path,
+			Value: strconv.FormatFloat(sample.Value, 'g', -1, 64),
+			Time:  sample.Timestamp.UnixNano(),
+			Check: sample.Check,
+			Type:  sample.Type,
+			Field: sample.Field,
+		})
+		if err != nil {
+			return 0, err
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+
+	now := time.Now()
+	if o.file != nil {
+		current := o.segments[len(o.segments)-1]
+		if current.size >= int64(o.config.SegmentSizeMB)<<20 || now.Sub(current.started) >= o.config.SegmentAge.Duration {
+			o.file.Close()
+			o.file = nil
+		}
+	}
+
+	// Make room by dropping the oldest segments (the newest ones are more use to us)...
+	dropped := 0
+	maxSize := int64(o.config.MaxSizeMB) << 20
+	for len(o.segments) > 0 && o.size()+int64(len(lines)) > maxSize {
+		dropped += o.dropOldest()
+	}
+	if o.size()+int64(len(lines)) > maxSize {
+		return dropped, fmt.Errorf("%d samples would take the outbox over %dMB", len(samples), o.config.MaxSizeMB)
+	}
+
+	if o.file == nil {
+		path := filepath.Join(o.config.Directory, fmt.Sprintf("%020d.segment", now.UnixNano()))
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return dropped, err
+		}
+		o.file = file
+		o.segments = append(o.segments, &outboxSegment{path: path, started: now})
+	}
+
+	current := o.segments[len(o.segments)-1]
+	n, err := o.file.Write(lines)
+	current.size += int64(n)
+	current.lastWrite = now
+	if err != nil {
+		return dropped, err
+	}
+	current.samples += len(samples)
+	atomic.AddInt64(&o.depth, int64(len(samples)))
+
+	return dropped, nil
+}
+
+func (o *outbox) size() int64 {
+	var size int64
+	for _, segment := range o.segments {
+		size += segment.size
+	}
+	return size
+}
+
+// expire drops segments that haven't been written to in longer than our maximum age,
+// returning how many samples went with them.
+func (o *outbox) expire() int {
+	dropped := 0
+	for len(o.segments) > 0 && time.Since(o.segments[0].lastWrite) > o.config.MaxAge.Duration {
+		dropped += o.dropOldest()
+	}
+	return dropped
+}
+
+// dropOldest removes the oldest segment, returning how many samples hadn't been replayed.
+func (o *outbox) dropOldest() int {
+
+	segment := o.segments[0]
+	if len(o.segments) == 1 && o.file != nil {
+		o.file.Close()
+		o.file = nil
+	}
+	os.Remove(segment.path)
+	o.segments = o.segments[1:]
+	o.peekOffset, o.peekCount = 0, 0
+
+	remaining := segment.samples - segment.replayed
+	atomic.AddInt64(&o.depth, -int64(remaining))
+	o.saveCursor()
+	return remaining
+}
+
+// peek reads up to max of the oldest samples (sorted by time), which stay in the outbox until
+// they're committed.
+func (o *outbox) peek(max int) ([]Sample, error) {
+
+	o.peekOffset, o.peekCount = 0, 0
+
+	// Finished segments we've read everything from are done with...
+	for len(o.segments) > 0 && o.segments[0].replayed >= o.segments[0].samples {
+		if len(o.segments) == 1 && o.file != nil {
+			return nil, nil
+		}
+		o.dropOldest()
+	}
+	if len(o.segments) < 1 {
+		return nil, nil
+	}
+
+	segment := o.segments[0]
+	file, err := os.Open(segment.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	_, err = file.Seek(segment.offset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []Sample
+	offset := segment.offset
+	r := bufio.NewReader(file)
+	for o.peekCount < max && segment.replayed+o.peekCount < segment.samples {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		offset += int64(len(line))
+		o.peekCount++
+
+		// Lines we can't make sense of (e.g. corrupted on disk) are skipped...
+		var record outboxRecord
+		if json.Unmarshal(line, &record) != nil {
+			continue
+		}
+		value, err := strconv.ParseFloat(record.Value, 64)
+		if err != nil {
+			continue
+		}
+		samples = append(samples, Sample{
+			Path:      record.Path,
+			Value:     value,
+			Timestamp: time.Unix(0, record.Time),
+			Check:     record.Check,
+			Type:      record.Type,
+			Field:     record.Field,
+		})
+	}
+	o.peekOffset = offset
+
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Timestamp.Before(samples[j].Timestamp)
+	})
+	return samples, nil
+}
+
+// commit removes what we last peeked at (once it's been sent).
+func (o *outbox) commit() {
+
+	if len(o.segments) < 1 || o.peekCount < 1 {
+		return
+	}
+
+	segment := o.segments[0]
+	segment.offset = o.peekOffset
+	segment.replayed += o.peekCount
+	atomic.AddInt64(&o.depth, -int64(o.peekCount))
+	o.peekOffset, o.peekCount = 0, 0
+
+	// Once everything's been replayed there's no reason to keep appending to the same file...
+	if segment.replayed >= segment.samples {
+		if len(o.segments) == 1 && o.file != nil {
+			o.file.Close()
+			o.file = nil
+		}
+		os.Remove(segment.path)
+		o.segments = o.segments[1:]
+	}
+	o.saveCursor()
+}
+
+func (o *outbox) saveCursor() {
+	path := filepath.Join(o.config.Directory, outboxCursorFile)
+	if len(o.segments) < 1 || o.segments[0].offset == 0 {
+		os.Remove(path)
+		return
+	}
+	cursor := fmt.Sprintf("%s %d\n", filepath.Base(o.segments[0].path), o.segments[0].offset)
+
+	// Written alongside and renamed over so a crash can't leave us with half a cursor...
+	err := ioutil.WriteFile(path+".tmp", []byte(cursor), 0644)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		log.Println(fmt.Sprintf("error saving outbox cursor in %s: %s", o.config.Directory, err))
+	}
+}
+
+func (o *outbox) close() error {
+	if o.file == nil {
+		return nil
+	}
+	err := o.file.Close()
+	o.file = nil
+	return err
+}
+
+// outboxBackoff is how long to wait between replay attempts, growing with each failure (as
+// fibonacci numbers or powers of two of a second) up to a maximum.
+type outboxBackoff struct {
+	kind     string
+	max      time.Duration
+	previous time.Duration
+	current  time.Duration
+}
+
+func (b *outboxBackoff) next() time.Duration {
+	switch {
+	case b.current == 0:
+		b.previous, b.current = 0, time.Second
+	case b.kind == "exponential":
+		b.previous, b.current = b.current, b.current*2
+	default:
+		b.previous, b.current = b.current, b.previous+b.current
+	}
+	if b.current > b.max {
+		b.current = b.max
+	}
+	return b.current
+}
+
+func (b *outboxBackoff) reset() {
+	b.previous, b.current = 0, 0
+}
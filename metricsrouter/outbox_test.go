@@ -0,0 +1,325 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package metricsrouter
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bryancallahan/metrics-runner/models"
+)
+
+func outboxTestConfig(t *testing.T) models.ConfigSinkOutbox {
+
+	directory, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(directory) })
+
+	return models.ConfigSinkOutbox{
+		Directory:     directory,
+		SegmentSizeMB: 1,
+		SegmentAge:    models.Duration{Duration: time.Hour},
+		MaxSizeMB:     8,
+		MaxAge:        models.Duration{Duration: 24 * time.Hour},
+	}
+}
+
+// outboxTestSamples makes n samples a second apart, padded out to about size bytes each.
+func outboxTestSamples(start time.Time, n int, size int) []Sample {
+	var samples []Sample
+	for i := 0; i < n; i++ {
+		samples = append(samples, Sample{
+			Path:      "metricsrunner.test." + strings.Repeat("x", size),
+			Value:     float64(i),
+			Timestamp: start.Add(time.Duration(i) * time.Second),
+			Check:     "test",
+			Type:      "http",
+			Field:     "elapsed",
+		})
+	}
+	return samples
+}
+
+func outboxTestSegments(t *testing.T, config models.ConfigSinkOutbox) []string {
+	paths, err := filepath.Glob(filepath.Join(config.Directory, "*.segment"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func TestOutboxReplay(t *testing.T) {
+
+	config := outboxTestConfig(t)
+	o, err := newOutbox(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Appended out of order, replayed by time (with odd values intact)...
+	start := time.Unix(1700000000, 0)
+	samples := outboxTestSamples(start, 4, 0)
+	samples[0].Value = math.NaN()
+	samples[1].Value = math.Inf(-1)
+	_, err = o.append([]Sample{samples[1], samples[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = o.append(samples[2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Depth() != 4 {
+		t.Fatalf("expected 4 samples waiting, got %d", o.Depth())
+	}
+
+	peeked, err := o.peek(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peeked) != 2 || !math.IsNaN(peeked[0].Value) || !math.IsInf(peeked[1].Value, -1) ||
+		!peeked[0].Timestamp.Equal(start) || peeked[0].Check != "test" || peeked[0].Field != "elapsed" {
+		t.Fatalf("unexpected samples %+v", peeked)
+	}
+
+	// Nothing's gone until it's committed...
+	peeked, _ = o.peek(2)
+	if len(peeked) != 2 || o.Depth() != 4 {
+		t.Fatalf("expected the same samples again, got %+v (depth %d)", peeked, o.Depth())
+	}
+	o.commit()
+	if o.Depth() != 2 {
+		t.Errorf("expected 2 samples waiting, got %d", o.Depth())
+	}
+	if _, err := os.Stat(filepath.Join(config.Directory, outboxCursorFile+".tmp")); !os.IsNotExist(err) {
+		t.Errorf("expected the cursor to be renamed into place, got %v", err)
+	}
+	o.close()
+
+	// A restart skips what was already replayed...
+	o, err = newOutbox(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Depth() != 2 {
+		t.Fatalf("expected 2 samples waiting after restarting, got %d", o.Depth())
+	}
+	peeked, err = o.peek(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peeked) != 2 || peeked[0].Value != 2 || peeked[1].Value != 3 {
+		t.Fatalf("unexpected samples after restarting %+v", peeked)
+	}
+	o.commit()
+
+	// Once everything's replayed the segment and cursor go...
+	if o.Depth() != 0 || len(outboxTestSegments(t, config)) != 0 {
+		t.Errorf("expected an empty outbox, got %d samples in %v", o.Depth(), outboxTestSegments(t, config))
+	}
+	if _, err := os.Stat(filepath.Join(config.Directory, outboxCursorFile)); !os.IsNotExist(err) {
+		t.Errorf("expected the cursor to be removed, got %v", err)
+	}
+}
+
+func TestOutboxPartialLine(t *testing.T) {
+
+	config := outboxTestConfig(t)
+	o, err := newOutbox(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1700000000, 0)
+	_, err = o.append(outboxTestSamples(start, 2, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.close()
+
+	// As if we crashed part way through the next append...
+	segments := outboxTestSegments(t, config)
+	if len(segments) != 1 {
+		t.Fatalf("expected 1 segment, got %v", segments)
+	}
+	file, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"path":"metricsrunner.test.","val`)
+	file.Close()
+
+	// The partial line is cut off, leaving only whole samples to replay...
+	o, err = newOutbox(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.close()
+	if o.Depth() != 2 {
+		t.Fatalf("expected 2 samples waiting after restarting, got %d", o.Depth())
+	}
+	info, err := os.Stat(segments[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != o.size() {
+		t.Errorf("expected the segment to be cut back to %d bytes, got %d", o.size(), info.Size())
+	}
+
+	samples := outboxTestSamples(start.Add(time.Minute), 1, 0)
+	samples[0].Value = 7
+	_, err = o.append(samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replayed []float64
+	for o.Depth() > 0 && len(replayed) < 10 {
+		peeked, err := o.peek(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, sample := range peeked {
+			replayed = append(replayed, sample.Value)
+		}
+		o.commit()
+	}
+	if len(replayed) != 3 || replayed[0] != 0 || replayed[1] != 1 || replayed[2] != 7 {
+		t.Errorf("unexpected samples replayed %v", replayed)
+	}
+}
+
+func TestOutboxSegments(t *testing.T) {
+
+	config := outboxTestConfig(t)
+	o, err := newOutbox(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.close()
+
+	// A segment is rolled once it's reached its size...
+	start := time.Unix(1700000000, 0)
+	for i := 0; i < 3; i++ {
+		_, err = o.append(outboxTestSamples(start, 1, 600<<10))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if segments := outboxTestSegments(t, config); len(segments) != 2 {
+		t.Errorf("expected 2 segments, got %v", segments)
+	}
+
+	// Or its age...
+	o.segments[len(o.segments)-1].started = time.Now().Add(-2 * time.Hour)
+	_, err = o.append(outboxTestSamples(start, 1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if segments := outboxTestSegments(t, config); len(segments) != 3 || o.Depth() != 4 {
+		t.Errorf("expected 4 samples in 3 segments, got %d in %v", o.Depth(), segments)
+	}
+
+	// Replay carries on from one segment to the next...
+	var replayed []Sample
+	for o.Depth() > 0 && len(replayed) < 10 {
+		samples, err := o.peek(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		replayed = append(replayed, samples...)
+		o.commit()
+	}
+	if len(replayed) != 4 || len(outboxTestSegments(t, config)) != 0 {
+		t.Errorf("expected 4 samples replayed, got %d (%v left)", len(replayed), outboxTestSegments(t, config))
+	}
+}
+
+func TestOutboxLimits(t *testing.T) {
+
+	config := outboxTestConfig(t)
+	config.MaxSizeMB = 2
+	o, err := newOutbox(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.close()
+
+	// Going over the maximum size drops the oldest segments...
+	start := time.Unix(1700000000, 0)
+	dropped := 0
+	for i := 0; i < 5; i++ {
+		n, err := o.append(outboxTestSamples(start.Add(time.Duration(i)*time.Minute), 1, 600<<10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dropped += n
+	}
+	if dropped != 2 || o.Depth() != 3 || o.size() > 2<<20 {
+		t.Errorf("expected 2 dropped leaving 3 under 2MB, got %d dropped leaving %d in %d bytes", dropped, o.Depth(), o.size())
+	}
+	samples, err := o.peek(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) < 1 || !samples[0].Timestamp.Equal(start.Add(2*time.Minute)) {
+		t.Errorf("expected the oldest samples to be dropped, got %+v", samples)
+	}
+
+	// A batch that won't fit at all is refused...
+	_, err = o.append(outboxTestSamples(start, 4, 600<<10))
+	if err == nil {
+		t.Errorf("expected a batch over the maximum size to be refused")
+	}
+
+	// Segments not written to for longer than the maximum age are dropped...
+	o, err = newOutbox(outboxTestConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.close()
+	o.append(outboxTestSamples(start, 3, 0))
+	if dropped := o.expire(); dropped != 0 {
+		t.Errorf("expected nothing to expire yet, got %d", dropped)
+	}
+	o.segments[0].lastWrite = time.Now().Add(-25 * time.Hour)
+	if dropped := o.expire(); dropped != 3 || o.Depth() != 0 || len(outboxTestSegments(t, o.config)) != 0 {
+		t.Errorf("expected 3 samples to expire, got %d (depth %d)", dropped, o.Depth())
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+
+	fibonacci := &outboxBackoff{kind: "fibonacci", max: 10 * time.Second}
+	exponential := &outboxBackoff{kind: "exponential", max: 10 * time.Second}
+	var waits []string
+	for i := 0; i < 6; i++ {
+		waits = append(waits, fibonacci.next().String()+"/"+exponential.next().String())
+	}
+	if strings.Join(waits, " ") != "1s/1s 1s/2s 2s/4s 3s/8s 5s/10s 8s/10s" {
+		t.Errorf("unexpected waits %v", waits)
+	}
+	fibonacci.reset()
+	if wait := fibonacci.next(); wait != time.Second {
+		t.Errorf("expected to start again from a second, got %s", wait)
+	}
+}
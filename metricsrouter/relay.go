@@ -0,0 +1,355 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package metricsrouter
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bryancallahan/metrics-runner/models"
+)
+
+// Relay listens for graphite's plaintext protocol ("<path> <value> <timestamp>\n") and relays
+// each line through the metrics router (so legacy services get our reconnection behavior).
+// Readers hand lines to a single writer through a bounded buffer, dropping them (rather than
+// blocking senders) when it's full.
+type Relay struct {
+	wg            sync.WaitGroup // Listeners and connections
+	config        *models.Config
+	metricsRouter *MetricsRouter
+	allow         []*regexp.Regexp
+	deny          []*regexp.Regexp
+	stop          chan struct{}
+	samples       chan Sample
+	written       chan struct{} // Closed once the writer has written everything buffered
+
+	listener net.Listener
+	packets  net.PacketConn
+	connLock sync.Mutex
+	conns    map[net.Conn]bool // Open tcp connections (closed when we stop)
+
+	relayed   uint64
+	malformed uint64
+	filtered  uint64
+	dropped   uint64
+}
+
+func NewRelay(config *models.Config, metricsRouter *MetricsRouter) (*Relay, error) {
+
+	r := &Relay{
+		config:        config,
+		metricsRouter: metricsRouter,
+		stop:          make(chan struct{}),
+		samples:       make(chan Sample, config.MetricsRouter.Relay.BufferSize),
+		written:       make(chan struct{}),
+		conns:         map[net.Conn]bool{},
+	}
+
+	for _, pattern := range config.MetricsRouter.Relay.Allow {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling relay allow pattern %s: %s", pattern, err)
+		}
+		r.allow = append(r.allow, re)
+	}
+	for _, pattern := range config.MetricsRouter.Relay.Deny {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling relay deny pattern %s: %s", pattern, err)
+		}
+		r.deny = append(r.deny, re)
+	}
+
+	return r, nil
+}
+
+// Start listens on the configured protocols (returning once we're listening).
+func (r *Relay) Start() error {
+
+	relay := r.config.MetricsRouter.Relay
+	for _, protocol := range relay.Protocols {
+		switch protocol {
+		case "tcp":
+			listener, err := net.Listen("tcp", relay.Listen)
+			if err != nil {
+				r.close()
+				return fmt.Errorf("error listening on tcp %s: %s", relay.Listen, err)
+			}
+			r.listener = listener
+			r.wg.Add(1)
+			go r.acceptTCP()
+
+		case "udp":
+			packets, err := net.ListenPacket("udp", relay.Listen)
+			if err != nil {
+				r.close()
+				return fmt.Errorf("error listening on udp %s: %s", relay.Listen, err)
+			}
+			r.packets = packets
+			r.wg.Add(1)
+			go r.readUDP()
+
+		default:
+			r.close()
+			return fmt.Errorf("relay protocol %s is currently not supported", protocol)
+		}
+	}
+
+	log.Println(fmt.Sprintf("carbon relay started (listening on %s %s)", strings.Join(relay.Protocols, "/"), relay.Listen))
+	go r.writeSamples()
+	go r.flushCounters()
+	return nil
+}
+
+func (r *Relay) Stop() error {
+
+	const stopTimeout = 30 // Seconds
+
+	close(r.stop)
+	r.close()
+
+	// Once nothing's reading, the writer can finish off what's buffered...
+	c := make(chan struct{}, 1)
+	go func() {
+		r.wg.Wait()
+		close(r.samples)
+		<-r.written
+		c <- struct{}{}
+	}()
+
+	select {
+	case <-c:
+		return nil
+	case <-time.After(stopTimeout * time.Second):
+		return fmt.Errorf("relay: wait group did not finish within %d seconds", stopTimeout)
+	}
+}
+
+func (r *Relay) close() {
+	if r.listener != nil {
+		r.listener.Close()
+	}
+	if r.packets != nil {
+		r.packets.Close()
+	}
+
+	r.connLock.Lock()
+	for conn := range r.conns {
+		conn.Close()
+	}
+	r.connLock.Unlock()
+}
+
+func (r *Relay) acceptTCP() {
+
+	defer r.wg.Done()
+
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			select {
+			case <-r.stop:
+				return
+			default:
+			}
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			log.Println(fmt.Sprintf("error accepting relay connection: %s", err))
+			return
+		}
+
+		// A connection accepted as we're stopping would be missed by close, so it goes now...
+		r.connLock.Lock()
+		select {
+		case <-r.stop:
+			r.connLock.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		r.conns[conn] = true
+		r.wg.Add(1)
+		r.connLock.Unlock()
+
+		go r.readTCP(conn)
+	}
+}
+
+func (r *Relay) readTCP(conn net.Conn) {
+
+	defer r.wg.Done()
+	defer func() {
+		conn.Close()
+		r.connLock.Lock()
+		delete(r.conns, conn)
+		r.connLock.Unlock()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		r.relay(scanner.Text())
+	}
+}
+
+func (r *Relay) readUDP() {
+
+	defer r.wg.Done()
+
+	buffer := make([]byte, 65536)
+	for {
+		n, _, err := r.packets.ReadFrom(buffer)
+		if err != nil {
+			select {
+			case <-r.stop:
+				return
+			default:
+			}
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			log.Println(fmt.Sprintf("error reading relay packet: %s", err))
+			return
+		}
+
+		// A datagram can hold several lines...
+		for _, line := range strings.Split(string(buffer[:n]), "\n") {
+			if len(strings.TrimSpace(line)) > 0 {
+				r.relay(line)
+			}
+		}
+	}
+}
+
+// relay parses, filters, rewrites and writes a single line.
+func (r *Relay) relay(line string) {
+
+	path, value, timestamp, err := parsePlaintextLine(line)
+	if err != nil {
+		atomic.AddUint64(&r.malformed, 1)
+		if r.config.MetricsRouter.Verbose {
+			log.Println(fmt.Sprintf("relay dropping malformed line %.256q: %s", line, err))
+		}
+		return
+	}
+
+	if !r.allowed(path) {
+		atomic.AddUint64(&r.filtered, 1)
+		return
+	}
+
+	for _, rewrite := range r.config.MetricsRouter.Relay.Rewrites {
+		if strings.HasPrefix(path, rewrite.Prefix) {
+			path = rewrite.Replacement + strings.TrimPrefix(path, rewrite.Prefix)
+			break
+		}
+	}
+
+	select {
+	case r.samples <- Sample{Path: path, Value: value, Timestamp: timestamp}:
+	default:
+		atomic.AddUint64(&r.dropped, 1)
+	}
+}
+
+// writeSamples writes buffered samples through the metrics router until the buffer is closed.
+func (r *Relay) writeSamples() {
+
+	defer close(r.written)
+
+	for sample := range r.samples {
+		r.metricsRouter.WriteFull(sample.Path, sample.Value, sample.Timestamp)
+		atomic.AddUint64(&r.relayed, 1)
+	}
+}
+
+// allowed checks a path against the allow (any must match, if there are any) and deny
+// (none may match) patterns.
+func (r *Relay) allowed(path string) bool {
+
+	if len(r.allow) > 0 {
+		matched := false
+		for _, re := range r.allow {
+			if re.MatchString(path) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	for _, re := range r.deny {
+		if re.MatchString(path) {
+			return false
+		}
+	}
+	return true
+}
+
+// flushCounters writes (and resets) our counters every flush interval.
+func (r *Relay) flushCounters() {
+	for {
+		select {
+		case <-time.After(r.config.MetricsRouter.Relay.FlushInterval.Duration):
+		case <-r.stop:
+			return
+		}
+		r.metricsRouter.Write("relay.relayed", float64(atomic.SwapUint64(&r.relayed, 0)))
+		r.metricsRouter.Write("relay.malformed", float64(atomic.SwapUint64(&r.malformed, 0)))
+		r.metricsRouter.Write("relay.filtered", float64(atomic.SwapUint64(&r.filtered, 0)))
+		r.metricsRouter.Write("relay.dropped", float64(atomic.SwapUint64(&r.dropped, 0)))
+	}
+}
+
+// parsePlaintextLine parses "<path> <value> <timestamp>" (carbon also accepts fractional
+// timestamps and -1 for now).
+func parsePlaintextLine(line string) (string, float64, time.Time, error) {
+
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return "", 0, time.Time{}, fmt.Errorf("expected 3 fields, got %d", len(fields))
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return "", 0, time.Time{}, fmt.Errorf("invalid value %s", fields[1])
+	}
+
+	seconds, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return "", 0, time.Time{}, fmt.Errorf("invalid timestamp %s", fields[2])
+	}
+	timestamp := time.Unix(int64(seconds), 0)
+	if seconds == -1 {
+		timestamp = time.Now()
+	}
+
+	return fields[0], value, timestamp, nil
+}
@@ -0,0 +1,233 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package metricsrouter
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bryancallahan/metrics-runner/models"
+)
+
+// recordingSink keeps whatever it's sent.
+type recordingSink struct {
+	sync.Mutex
+	samples []Sample
+}
+
+func (s *recordingSink) Send(samples []Sample) error {
+	s.Lock()
+	defer s.Unlock()
+	s.samples = append(s.samples, samples...)
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	return nil
+}
+
+// waitFor waits (a while) for n samples, returning what it has.
+func (s *recordingSink) waitFor(n int) []Sample {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.Lock()
+		samples := append([]Sample(nil), s.samples...)
+		s.Unlock()
+		if len(samples) >= n || time.Now().After(deadline) {
+			return samples
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// newRecordingRouter is a metrics router with a single sink recording what's written.
+func newRecordingRouter(t *testing.T, config *models.Config) (*MetricsRouter, *recordingSink) {
+
+	sink := &recordingSink{}
+	m := &MetricsRouter{config: config, stop: make(chan struct{})}
+	m.workers = []*sinkWorker{newSinkWorker(models.ConfigSink{
+		Type:          "test",
+		Name:          "test",
+		QueueSize:     1000,
+		BatchSize:     1,
+		FlushInterval: models.Duration{Duration: 10 * time.Millisecond},
+	}, sink)}
+	t.Cleanup(func() { m.Close() })
+
+	return m, sink
+}
+
+func relayTestConfig(protocol string) *models.Config {
+	return &models.Config{Name: "metrics-runner", Env: "test", MetricsRouter: models.ConfigMetricsRouter{
+		Relay: models.ConfigRelay{
+			Listen:        "127.0.0.1:0",
+			Protocols:     []string{protocol},
+			Rewrites:      []models.ConfigRelayRewrite{{Prefix: "legacy.", Replacement: "app.legacy."}},
+			Allow:         []string{`^(app|legacy)\.`},
+			Deny:          []string{`\.secret$`},
+			FlushInterval: models.Duration{Duration: time.Hour},
+			BufferSize:    100,
+		},
+	}}
+}
+
+func TestRelayStopWithOpenConnection(t *testing.T) {
+
+	config := relayTestConfig("tcp")
+	router, sink := newRecordingRouter(t, config)
+	r, err := NewRelay(config, router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", r.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "app.requests 5 1700000000\n")
+	if samples := sink.waitFor(1); len(samples) != 1 {
+		t.Fatalf("expected the line to be relayed, got %v", samples)
+	}
+
+	// Stopping doesn't wait for the client to hang up...
+	started := time.Now()
+	err = r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(started) > 5*time.Second {
+		t.Errorf("expected the relay to stop promptly, took %s", time.Since(started))
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("expected our connection to be closed")
+	}
+}
+
+func TestRelayStopWhileConnecting(t *testing.T) {
+
+	// Connections arriving as we stop are closed too (rather than holding up the stop)...
+	for i := 0; i < 20; i++ {
+		config := relayTestConfig("tcp")
+		router, _ := newRecordingRouter(t, config)
+		r, err := NewRelay(config, router)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = r.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		address := r.listener.Addr().String()
+		var conns []net.Conn
+		var lock sync.Mutex
+		var wg sync.WaitGroup
+		for j := 0; j < 10; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn, err := net.Dial("tcp", address)
+				if err == nil {
+					lock.Lock()
+					conns = append(conns, conn)
+					lock.Unlock()
+				}
+			}()
+		}
+
+		stopped := make(chan error, 1)
+		go func() { stopped <- r.Stop() }()
+		select {
+		case err := <-stopped:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("relay didn't stop with connections arriving")
+		}
+
+		wg.Wait()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+}
+
+func TestRelayRewritesAndFilters(t *testing.T) {
+
+	config := relayTestConfig("udp")
+	router, sink := newRecordingRouter(t, config)
+	r, err := NewRelay(config, router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	conn, err := net.Dial("udp", r.packets.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "app.requests 5 1700000000\n"+
+		"legacy.cpu.load 0.5 1700000000.7\n"+
+		"other.requests 1 1700000000\n"+
+		"app.password.secret 1 1700000000\n"+
+		"app.broken 1\n"+
+		"app.broken NaN 1700000000\n"+
+		"\n"+
+		"app.now 2 -1\n")
+
+	samples := sink.waitFor(3)
+	expected := []struct {
+		path  string
+		value float64
+		time  int64
+	}{
+		{"app.requests", 5, 1700000000},
+		{"app.legacy.cpu.load", 0.5, 1700000000},
+		{"app.now", 2, 0},
+	}
+	if len(samples) != len(expected) {
+		t.Fatalf("expected %d samples, got %+v", len(expected), samples)
+	}
+	for i, sample := range samples {
+		if sample.Path != expected[i].path || sample.Value != expected[i].value ||
+			(expected[i].time > 0 && sample.Timestamp.Unix() != expected[i].time) {
+			t.Errorf("unexpected sample %+v (expected %+v)", sample, expected[i])
+		}
+	}
+	if time.Since(samples[2].Timestamp) > time.Minute {
+		t.Errorf("expected a timestamp of -1 to be now, got %s", samples[2].Timestamp)
+	}
+	if filtered, malformed := atomic.LoadUint64(&r.filtered), atomic.LoadUint64(&r.malformed); filtered != 2 || malformed != 2 {
+		t.Errorf("expected 2 filtered and 2 malformed, got %d and %d", filtered, malformed)
+	}
+}
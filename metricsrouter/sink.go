@@ -0,0 +1,309 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package metricsrouter
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bryancallahan/metrics-runner/models"
+)
+
+// Sample is a single metric on its way to the sinks.
+type Sample struct {
+	Path      string // Full path (e.g. "metricsrunner-prod.http.homepage.elapsed")
+	Value     float64
+	Timestamp time.Time
+
+	// Metrics from runners also say where they came from (for sinks with tags / labels)...
+	Check string // e.g. "homepage"
+	Type  string // e.g. "http"
+	Field string // e.g. "elapsed"
+}
+
+// Sink is somewhere we send metrics. Each sink gets its own queue and goroutine, so Send only
+// ever gets called by one goroutine at a time (and can take its time without holding anyone
+// else up).
+type Sink interface {
+	Send(samples []Sample) error
+	Close() error
+}
+
+// SinkStats are a sink's counters since we started.
+type SinkStats struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Queued  int    `json:"queued"`
+	Sent    uint64 `json:"sent"`    // To each destination (for sinks with several)
+	Dropped uint64 `json:"dropped"` // Because the queue was full or sending failed (without an outbox)
+	Errors  uint64 `json:"errors"`  // Failed sends (each dropping a batch or sending it to the outbox)
+
+	// With an outbox...
+	Outbox      bool   `json:"outbox"`
+	OutboxDepth int64  `json:"outboxDepth"` // Samples waiting to be replayed
+	Replayed    uint64 `json:"replayed"`
+	Overflowed  uint64 `json:"overflowed"` // Dropped from the outbox for its size and age limits
+
+	Destinations []SinkDestination `json:"destinations,omitempty"` // For sinks with several
+}
+
+// destinationSink is a sink that hands what it's sent on to a worker per destination (each with
+// its own queue, outbox and backoff), so a destination that's down only holds up itself.
+type destinationSink interface {
+	Sink
+	destinationStats() []SinkDestination
+}
+
+// newSink creates a sink of the configured type.
+func newSink(version *models.Version, config *models.Config, sink models.ConfigSink) (Sink, error) {
+	switch sink.Type {
+	case "carbon":
+		return newCarbonSink(config, sink)
+	case "influx":
+		return newInfluxSink(config, sink)
+	case "statsd":
+		return newStatsDSink(config, sink)
+	case "otlp":
+		return newOTLPSink(version, config, sink)
+	default:
+		return nil, fmt.Errorf("sink type %s is currently not supported", sink.Type)
+	}
+}
+
+// sinkWorker feeds a sink from its queue. With an outbox, whatever fails to send is kept on
+// disk and everything after it goes there too (so it's sent in order) until it's replayed.
+type sinkWorker struct {
+	config  models.ConfigSink
+	sink    Sink
+	queue   chan Sample
+	wg      sync.WaitGroup
+	outbox  *outbox
+	backoff outboxBackoff
+
+	sent       uint64
+	dropped    uint64
+	errors     uint64
+	replayed   uint64
+	overflowed uint64
+}
+
+func newSinkWorker(config models.ConfigSink, sink Sink) *sinkWorker {
+	w := &sinkWorker{
+		config:  config,
+		sink:    sink,
+		queue:   make(chan Sample, config.QueueSize),
+		backoff: outboxBackoff{kind: config.Outbox.Backoff, max: config.Outbox.MaxBackoff.Duration},
+	}
+	if _, ok := sink.(destinationSink); !ok && config.Outbox.Enabled {
+		o, err := newOutbox(config.Outbox)
+		if err != nil {
+			log.Println(fmt.Sprintf("error opening outbox for sink %s: %s (failed sends will be dropped)", config.Name, err))
+		} else {
+			w.outbox = o
+		}
+	}
+	w.wg.Add(1)
+	go w.run()
+	return w
+}
+
+// enqueue adds a sample to the queue (dropping it if the queue is full rather than waiting).
+func (w *sinkWorker) enqueue(sample Sample) {
+	select {
+	case w.queue <- sample:
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+	}
+}
+
+// run sends whatever's queued (in batches of up to the batch size, or whatever's arrived within
+// the flush interval) until the queue is closed, replaying the outbox (if there's anything in
+// it) in between.
+func (w *sinkWorker) run() {
+
+	defer w.wg.Done()
+
+	var tick <-chan time.Time
+	if w.outbox != nil {
+		defer w.outbox.close()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var replayAt time.Time
+
+	batch := make([]Sample, 0, w.config.BatchSize)
+	for {
+		select {
+		case sample, ok := <-w.queue:
+			if !ok {
+				return
+			}
+
+			// Wait for the batch to fill up (or the flush interval to pass)...
+			batch = append(batch[:0], sample)
+			flush := time.NewTimer(w.config.FlushInterval.Duration)
+			closed := false
+		collect:
+			for len(batch) < w.config.BatchSize {
+				select {
+				case sample, ok := <-w.queue:
+					if !ok {
+						closed = true
+						break collect
+					}
+					batch = append(batch, sample)
+				case <-flush.C:
+					break collect
+				}
+			}
+			flush.Stop()
+			w.send(batch)
+			if closed {
+				return
+			}
+
+		case now := <-tick:
+			w.addOverflowed(w.outbox.expire())
+			if w.outbox.Depth() > 0 && !now.Before(replayAt) {
+				replayAt = now.Add(w.replay())
+			}
+		}
+	}
+}
+
+func (w *sinkWorker) send(batch []Sample) {
+
+	// Anything newer than what's in the outbox waits its turn...
+	if w.outbox != nil && w.outbox.Depth() > 0 {
+		w.store(batch)
+		return
+	}
+
+	err := w.sink.Send(batch)
+	if err != nil {
+		atomic.AddUint64(&w.errors, 1)
+		if w.outbox != nil {
+			log.Println(fmt.Sprintf("error sending %d metrics to sink %s: %s (keeping them in the outbox)", len(batch), w.config.Name, err))
+			w.store(batch)
+			return
+		}
+		log.Println(fmt.Sprintf("error sending %d metrics to sink %s: %s (dropping them)", len(batch), w.config.Name, err))
+		atomic.AddUint64(&w.dropped, uint64(len(batch)))
+		return
+	}
+	atomic.AddUint64(&w.sent, uint64(len(batch)))
+}
+
+func (w *sinkWorker) store(batch []Sample) {
+	overflowed, err := w.outbox.append(batch)
+	w.addOverflowed(overflowed)
+	if err != nil {
+		log.Println(fmt.Sprintf("error adding %d metrics to the outbox of sink %s: %s (dropping them)", len(batch), w.config.Name, err))
+		w.addOverflowed(len(batch))
+	}
+}
+
+func (w *sinkWorker) addOverflowed(n int) {
+	if n > 0 {
+		atomic.AddUint64(&w.overflowed, uint64(n))
+	}
+}
+
+// replay sends the oldest batches from the outbox (up to ten at a time so the queue isn't
+// kept waiting), returning how long to wait before trying again.
+func (w *sinkWorker) replay() time.Duration {
+
+	for i := 0; i < 10 && w.outbox.Depth() > 0; i++ {
+		samples, err := w.outbox.peek(w.config.BatchSize)
+		if err != nil {
+			log.Println(fmt.Sprintf("error reading the outbox of sink %s: %s", w.config.Name, err))
+			return w.backoff.next()
+		}
+		if len(samples) > 0 {
+			err = w.sink.Send(samples)
+			if err != nil {
+				atomic.AddUint64(&w.errors, 1)
+				wait := w.backoff.next()
+				log.Println(fmt.Sprintf("error replaying %d metrics to sink %s: %s (%d waiting, retrying in %s)", len(samples),
+					w.config.Name, err, w.outbox.Depth(), wait))
+				return wait
+			}
+		}
+		w.outbox.commit()
+		atomic.AddUint64(&w.sent, uint64(len(samples)))
+		atomic.AddUint64(&w.replayed, uint64(len(samples)))
+	}
+
+	w.backoff.reset()
+	return 0
+}
+
+// close stops accepting samples and waits (up to the timeout) for the queue to drain.
+func (w *sinkWorker) close(timeout time.Duration) error {
+
+	close(w.queue)
+
+	c := make(chan struct{}, 1)
+	go func() {
+		w.wg.Wait()
+		c <- struct{}{}
+	}()
+
+	select {
+	case <-c:
+		return w.sink.Close()
+	case <-time.After(timeout):
+		return fmt.Errorf("sink %s did not drain within %s", w.config.Name, timeout)
+	}
+}
+
+func (w *sinkWorker) stats() SinkStats {
+	stats := SinkStats{
+		Name:    w.config.Name,
+		Type:    w.config.Type,
+		Queued:  len(w.queue),
+		Sent:    atomic.LoadUint64(&w.sent),
+		Dropped: atomic.LoadUint64(&w.dropped),
+		Errors:  atomic.LoadUint64(&w.errors),
+	}
+	if sink, ok := w.sink.(destinationSink); ok {
+
+		// What's sent, failed and kept in outboxes is down to each destination...
+		stats.Destinations = sink.destinationStats()
+		stats.Sent = 0
+		stats.Outbox = w.config.Outbox.Enabled
+		for _, destination := range stats.Destinations {
+			stats.Sent += destination.Sent
+			stats.Dropped += destination.Dropped
+			stats.Errors += destination.Errors
+			stats.OutboxDepth += destination.OutboxDepth
+			stats.Replayed += destination.Replayed
+			stats.Overflowed += destination.Overflowed
+		}
+	}
+	if w.outbox != nil {
+		stats.Outbox = true
+		stats.OutboxDepth = w.outbox.Depth()
+		stats.Replayed = atomic.LoadUint64(&w.replayed)
+		stats.Overflowed = atomic.LoadUint64(&w.overflowed)
+	}
+	return stats
+}
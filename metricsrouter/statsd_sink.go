@@ -0,0 +1,181 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package metricsrouter
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/bryancallahan/metrics-runner/models"
+)
+
+// statsdSink sends samples to a statsd agent over udp (or a unix datagram socket). Elapsed
+// fields become timers and everything else becomes a gauge. With tags enabled the check's
+// name, type and env go in dogstatsd tags ("http.elapsed:31|ms|#check:homepage,type:http,env:production")
+// rather than in the metric name.
+type statsdSink struct {
+	config  *models.Config
+	sink    models.ConfigSink
+	network string
+	address string
+	conn    net.Conn // Nil until we've managed to connect
+}
+
+func newStatsDSink(config *models.Config, sink models.ConfigSink) (*statsdSink, error) {
+
+	u, err := url.Parse(sink.StatsD.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &statsdSink{config: config, sink: sink, network: u.Scheme}
+	switch u.Scheme {
+	case "udp":
+		s.address = u.Host
+	case "unixgram":
+		s.address = u.Path
+	default:
+		return nil, fmt.Errorf("cannot send to %s (only udp and unixgram addresses are supported)", sink.StatsD.Address)
+	}
+
+	// The agent may not be up yet (its socket may not even exist), so we try again on send...
+	err = s.connect()
+	if err != nil {
+		log.Println(fmt.Sprintf("error connecting to statsd at %s: %s (retrying on send)", sink.StatsD.Address, err))
+	}
+
+	return s, nil
+}
+
+func (s *statsdSink) connect() error {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	conn, err := net.Dial(s.network, s.address)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+// write sends a datagram. If there's ANY kind of error we reconnect and try again (a restarted
+// agent leaves a unix socket connected to the old one, and udp refusals show up on later writes).
+func (s *statsdSink) write(datagram []byte) error {
+	err := fmt.Errorf("not connected")
+	if s.conn != nil {
+		_, err = s.conn.Write(datagram)
+	}
+	if err != nil {
+		err = s.connect()
+		if err == nil {
+			_, err = s.conn.Write(datagram)
+		}
+	}
+	return err
+}
+
+func (s *statsdSink) Send(samples []Sample) error {
+
+	// Pack as many lines into each datagram as will fit...
+	var datagram bytes.Buffer
+	for _, line := range statsdLines(samples, s.sink.StatsD.Prefix, s.sink.StatsD.Tags, s.config.Env) {
+		if datagram.Len() > 0 && datagram.Len()+len(line)+1 > s.sink.StatsD.MTU {
+			err := s.write(datagram.Bytes())
+			if err != nil {
+				return err
+			}
+			datagram.Reset()
+		}
+		if datagram.Len() > 0 {
+			datagram.WriteByte('\n')
+		}
+		datagram.WriteString(line)
+	}
+	if datagram.Len() < 1 {
+		return nil
+	}
+	return s.write(datagram.Bytes())
+}
+
+func (s *statsdSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// statsdLines formats samples as statsd lines (skipping NaNs and infinities, which statsd
+// can't represent).
+func statsdLines(samples []Sample, prefix string, tags bool, env string) []string {
+
+	var lines []string
+	for _, sample := range samples {
+		if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+			continue
+		}
+
+		name := sample.Path
+		var tagList []string
+		if tags {
+			tagList = append(tagList, "env:"+statsdTagEscape(env))
+		}
+		if len(sample.Check) > 0 && tags {
+			name = fmt.Sprintf("%s.%s", sample.Type, sample.Field)
+			tagList = append([]string{
+				"check:" + statsdTagEscape(sample.Check),
+				"type:" + statsdTagEscape(sample.Type),
+			}, tagList...)
+		}
+		name = statsdEscape(prefix + name)
+
+		suffix := ""
+		if len(tagList) > 0 {
+			suffix = "|#" + strings.Join(tagList, ",")
+		}
+
+		value := strconv.FormatFloat(sample.Value, 'f', -1, 64)
+		if sample.Field == "elapsed" || strings.HasSuffix(sample.Field, "-elapsed") {
+			lines = append(lines, fmt.Sprintf("%s:%s|ms%s", name, value, suffix))
+			continue
+		}
+
+		// A signed gauge is a relative change to statsd, so negative values are set from zero...
+		if sample.Value < 0 {
+			lines = append(lines, fmt.Sprintf("%s:0|g%s", name, suffix))
+		}
+		lines = append(lines, fmt.Sprintf("%s:%s|g%s", name, value, suffix))
+	}
+	return lines
+}
+
+// statsdEscape replaces the characters statsd uses to separate a line's parts.
+func statsdEscape(s string) string {
+	return strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", "\n", "_", " ", "_").Replace(s)
+}
+
+// statsdTagEscape replaces the characters dogstatsd uses to separate tags.
+func statsdTagEscape(s string) string {
+	return strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_", " ", "_").Replace(s)
+}
@@ -0,0 +1,132 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package metricsrouter
+
+import (
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bryancallahan/metrics-runner/models"
+)
+
+func TestStatsDLines(t *testing.T) {
+
+	now := time.Unix(1700000000, 0)
+	samples := []Sample{
+		{Path: "a.http.home.elapsed", Value: 12.5, Timestamp: now, Check: "home", Type: "http", Field: "elapsed"},
+		{Path: "a.http.home.dns-elapsed", Value: 2, Timestamp: now, Check: "home", Type: "http", Field: "dns-elapsed"},
+		{Path: "a.http.home.valid", Value: 1, Timestamp: now, Check: "home", Type: "http", Field: "valid"},
+		{Path: "a.http.home.delta", Value: -3, Timestamp: now, Check: "home", Type: "http", Field: "delta"},
+		{Path: "a.http.home.status-code", Value: math.NaN(), Timestamp: now, Check: "home", Type: "http", Field: "status-code"},
+		{Path: "a.http.home.size", Value: math.Inf(1), Timestamp: now, Check: "home", Type: "http", Field: "size"},
+		{Path: "a.http.home page|x.valid", Value: 0, Timestamp: now, Check: "home page,#1", Type: "http", Field: "valid"},
+		{Path: "relayed.cpu:load", Value: 0.25, Timestamp: now},
+	}
+
+	for _, test := range []struct {
+		name     string
+		tags     bool
+		expected []string
+	}{
+		{
+			name: "names",
+			expected: []string{
+				"mr.a.http.home.elapsed:12.5|ms",
+				"mr.a.http.home.dns-elapsed:2|ms",
+				"mr.a.http.home.valid:1|g",
+				"mr.a.http.home.delta:0|g", // Negative gauges are set from zero
+				"mr.a.http.home.delta:-3|g",
+				"mr.a.http.home_page_x.valid:0|g",
+				"mr.relayed.cpu_load:0.25|g",
+			},
+		},
+		{
+			name: "tags",
+			tags: true,
+			expected: []string{
+				"mr.http.elapsed:12.5|ms|#check:home,type:http,env:prod_1",
+				"mr.http.dns-elapsed:2|ms|#check:home,type:http,env:prod_1",
+				"mr.http.valid:1|g|#check:home,type:http,env:prod_1",
+				"mr.http.delta:0|g|#check:home,type:http,env:prod_1",
+				"mr.http.delta:-3|g|#check:home,type:http,env:prod_1",
+				"mr.http.valid:0|g|#check:home_page__1,type:http,env:prod_1",
+				"mr.relayed.cpu_load:0.25|g|#env:prod_1", // Relayed samples keep their path
+			},
+		},
+	} {
+		lines := statsdLines(samples, "mr.", test.tags, "prod 1")
+		if strings.Join(lines, "\n") != strings.Join(test.expected, "\n") {
+			t.Errorf("%s: unexpected lines\n%s", test.name, strings.Join(lines, "\n"))
+		}
+	}
+}
+
+func TestStatsDSinkSend(t *testing.T) {
+
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	const mtu = 64
+	s, err := newStatsDSink(&models.Config{Env: "prod"}, models.ConfigSink{
+		Type:   "statsd",
+		StatsD: models.ConfigSinkStatsD{Address: "udp://" + listener.LocalAddr().String(), MTU: mtu},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	now := time.Unix(1700000000, 0)
+	var samples []Sample
+	for _, path := range []string{"a.one", "a.two", "a.three", "a.four", "a.five", "a." + strings.Repeat("x", mtu)} {
+		samples = append(samples, Sample{Path: path, Value: 1, Timestamp: now})
+	}
+	err = s.Send(samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Lines are packed up to the mtu (a line too long for it goes by itself, rather than not at all)...
+	var datagrams []string
+	buffer := make([]byte, 2048)
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for received := 0; received < len(samples); {
+		n, _, err := listener.ReadFrom(buffer)
+		if err != nil {
+			t.Fatalf("expected %d lines, got %q (%s)", len(samples), datagrams, err)
+		}
+		datagrams = append(datagrams, string(buffer[:n]))
+		received += strings.Count(string(buffer[:n]), "\n") + 1
+	}
+
+	expected := []string{
+		"a.one:1|g\na.two:1|g\na.three:1|g\na.four:1|g\na.five:1|g",
+		"a." + strings.Repeat("x", mtu) + ":1|g",
+	}
+	if strings.Join(datagrams, "|") != strings.Join(expected, "|") {
+		t.Errorf("expected datagrams %q, got %q", expected, datagrams)
+	}
+	if len(datagrams[0]) > mtu {
+		t.Errorf("datagram of %d bytes is over the %d byte mtu", len(datagrams[0]), mtu)
+	}
+}
@@ -36,6 +36,17 @@ type MetricsRunner struct {
 	version       *models.Version
 	metricsRouter *metricsrouter.MetricsRouter
 	metric        *models.ConfigMetric
+
+	resultLock sync.RWMutex
+	result     *models.RunResult
+	mismatch   *models.HTTPCompareMismatch // Last differing pair of responses (http-compare only)
+	stats      *ProbeStats
+
+	schemaFingerprint string                   // First schema fingerprint we saw (graphql only)
+	snmpCounters      models.SNMPCounters      // Last counter samples, for rates (snmp only)
+	domainExpiry      models.DomainExpiryCache // Last whois lookup (domain-expiry only)
+
+	runStarted time.Time // When the current run started (all its fields are written as of then)
 }
 
 func NewMetricsRunner(version *models.Version, config *models.Config,
@@ -45,6 +56,8 @@ func NewMetricsRunner(version *models.Version, config *models.Config,
 		version:       version,
 		metricsRouter: metricsRouter,
 		metric:        &metric,
+		snmpCounters:  models.SNMPCounters{},
+		stats:         newProbeStats(),
 	}
 }
 
@@ -56,6 +69,10 @@ func (m *MetricsRunner) run() error {
 	m.Lock()
 	defer m.Unlock()
 
+	result := models.NewRunResult(m.metric)
+	defer m.setResult(result)
+	m.runStarted = result.Started
+
 	switch m.metric.Type {
 	case "build-number":
 		// Send the build number (note: if short hash ends with "-dev", we're running uncommitted
@@ -65,6 +82,8 @@ func (m *MetricsRunner) run() error {
 			buildNumber += 0.5
 		}
 		m.metricsRouter.Write(fmt.Sprintf("%s.%s", m.metric.Type, m.metric.Name), buildNumber)
+		result.Details["buildNumber"] = buildNumber
+		result.Finish(true, nil)
 		return nil
 
 	case "http":
@@ -76,18 +95,339 @@ func (m *MetricsRunner) run() error {
 			log.Println(fmt.Sprintf("%s %s - Elapsed: %s, Status Code: %d, Valid: %t, Error: %s", m.metric.Method, m.metric.URL, elapsed, statusCode, valid, err))
 		}
 
-		validMetric := 0
-		if valid {
-			validMetric = 1
+		m.write("elapsed", milliseconds(elapsed))
+		m.write("status-code", float64(statusCode))
+		m.write("valid", boolMetric(valid))
+		result.Details["statusCode"] = statusCode
+		result.Finish(valid, err)
+		return nil
+
+	case "http-compare":
+
+		compare, err := models.QueryHTTPCompareMetric(m.metric)
+		if err != nil {
+			log.Println(fmt.Sprintf("%s %s <> %s - Error: %s", m.metric.Method, m.metric.URL, m.metric.Compare.URL, err))
+			m.write("valid", 0)
+			result.Finish(false, err)
+			m.addMismatchDetails(result)
+			return nil
+		}
+
+		log.Println(fmt.Sprintf("%s %s <> %s - Elapsed: %s / %s, Status Code: %d / %d, Mismatch: %t", m.metric.Method,
+			m.metric.URL, m.metric.Compare.URL, compare.Elapsed, compare.CompareElapsed, compare.StatusCode,
+			compare.CompareStatusCode, compare.Mismatch()))
+
+		if compare.Mismatch() {
+			m.resultLock.Lock()
+			m.mismatch = models.NewHTTPCompareMismatch(m.metric, compare)
+			m.resultLock.Unlock()
+		}
+
+		m.write("elapsed", milliseconds(compare.Elapsed))
+		m.write("compare-elapsed", milliseconds(compare.CompareElapsed))
+		m.write("elapsed-delta", milliseconds(compare.CompareElapsed-compare.Elapsed))
+		m.write("status-code", float64(compare.StatusCode))
+		m.write("compare-status-code", float64(compare.CompareStatusCode))
+		m.write("mismatch", boolMetric(compare.Mismatch()))
+		m.write("valid", 1)
+		result.Details["statusCode"] = compare.StatusCode
+		result.Details["compareStatusCode"] = compare.CompareStatusCode
+		result.Details["reasons"] = compare.Reasons
+		if m.metric.Compare.BodyMode == "similarity" {
+			result.Details["similarity"] = compare.Similarity
+		}
+		result.Finish(true, nil)
+		m.addMismatchDetails(result)
+		return nil
+
+	case "crawl":
+
+		crawl, err := models.QueryCrawlMetric(m.metric)
+		if err != nil {
+			log.Println(fmt.Sprintf("crawl %s - Error: %s", m.metric.URL, err))
+			m.write("valid", 0)
+			result.Finish(false, err)
+			return nil
+		}
+
+		log.Println(fmt.Sprintf("crawl %s - Elapsed: %s, Pages: %d, Assets: %d, Bytes: %d, Broken Links: %d, Slowest Page: %s (%s)",
+			m.metric.URL, crawl.Elapsed, crawl.Pages, crawl.Assets, crawl.TotalBytes, len(crawl.BrokenLinks),
+			crawl.SlowestPage, crawl.SlowestTime))
+
+		valid := len(crawl.BrokenLinks) == 0
+		m.write("elapsed", milliseconds(crawl.Elapsed))
+		m.write("pages", float64(crawl.Pages))
+		m.write("broken-links", float64(len(crawl.BrokenLinks)))
+		m.write("page-weight", float64(crawl.TotalBytes))
+		m.write("slowest-page", milliseconds(crawl.SlowestTime))
+		m.write("valid", boolMetric(valid))
+		result.Details["pages"] = crawl.Pages
+		result.Details["assets"] = crawl.Assets
+		result.Details["totalBytes"] = crawl.TotalBytes
+		result.Details["slowestPage"] = crawl.SlowestPage
+		result.Details["slowestPageElapsed"] = models.Duration{Duration: crawl.SlowestTime}
+		result.Details["robotsDenied"] = crawl.RobotsDenied
+		result.Details["brokenLinks"] = crawl.BrokenLinks
+		result.Finish(valid, nil)
+		return nil
+
+	case "graphql":
+
+		graphQL, err := models.QueryGraphQLMetric(m.metric)
+		if err != nil {
+			log.Println(fmt.Sprintf("graphql %s - Error: %s", m.metric.URL, err))
+			m.write("valid", 0)
+			result.Finish(false, err)
+			return nil
+		}
+
+		log.Println(fmt.Sprintf("graphql %s - Elapsed: %s, Status Code: %d, Valid: %t, Errors: %d", m.metric.URL,
+			graphQL.Elapsed, graphQL.StatusCode, graphQL.Valid, len(graphQL.Errors)))
+
+		m.write("elapsed", milliseconds(graphQL.Elapsed))
+		m.write("status-code", float64(graphQL.StatusCode))
+		m.write("errors", float64(len(graphQL.Errors)))
+		m.write("valid", boolMetric(graphQL.Valid))
+		for name, value := range graphQL.Values {
+			m.write(fmt.Sprintf("data.%s", name), value)
+		}
+		result.Details["statusCode"] = graphQL.StatusCode
+		result.Details["errors"] = graphQL.Errors
+		result.Details["values"] = graphQL.Values
+
+		// Flag schema changes (against the expected fingerprint if we have one, otherwise
+		//  against the first one we saw, so a change stays flagged until it's acknowledged by
+		//  configuring the new fingerprint or restarting)...
+		if m.metric.GraphQL.CheckSchema && len(graphQL.SchemaError) > 0 {
+			log.Println(fmt.Sprintf("graphql %s - Error: %s", m.metric.URL, graphQL.SchemaError))
+			m.write("schema-error", 1)
+			result.Details["schemaError"] = graphQL.SchemaError
+		} else if m.metric.GraphQL.CheckSchema {
+			if len(m.schemaFingerprint) < 1 {
+				m.schemaFingerprint = graphQL.SchemaFingerprint
+			}
+			expected := m.metric.GraphQL.SchemaFingerprint
+			if len(expected) < 1 {
+				expected = m.schemaFingerprint
+			}
+			changed := expected != graphQL.SchemaFingerprint
+			if changed {
+				log.Println(fmt.Sprintf("graphql %s - Schema fingerprint changed from %s to %s", m.metric.URL,
+					expected, graphQL.SchemaFingerprint))
+			}
+			m.write("schema-error", 0)
+			m.write("schema-changed", boolMetric(changed))
+			result.Details["schemaFingerprint"] = graphQL.SchemaFingerprint
+			result.Details["schemaChanged"] = changed
+		}
+
+		result.Finish(graphQL.Valid, nil)
+		return nil
+
+	case "snmp":
+
+		snmp, err := models.QuerySNMPMetric(m.metric, m.snmpCounters)
+		if err != nil {
+			log.Println(fmt.Sprintf("snmp %s:%d - Error: %s", m.metric.SNMP.Host, m.metric.SNMP.Port, err))
+			m.write("valid", 0)
+			result.Finish(false, err)
+			return nil
+		}
+
+		log.Println(fmt.Sprintf("snmp %s:%d - Elapsed: %s, Values: %d, Valid: %t", m.metric.SNMP.Host, m.metric.SNMP.Port,
+			snmp.Elapsed, len(snmp.Values), snmp.Valid))
+
+		m.write("elapsed", milliseconds(snmp.Elapsed))
+		m.write("valid", boolMetric(snmp.Valid))
+		for name, value := range snmp.Values {
+			m.write(name, value)
+		}
+		result.Details["values"] = snmp.Values
+		result.Details["errors"] = snmp.Errors
+		result.Finish(snmp.Valid, nil)
+		return nil
+
+	case "ldap":
+
+		ldap, err := models.QueryLDAPMetric(m.metric)
+		if err != nil {
+			log.Println(fmt.Sprintf("ldap %s - Error: %s", m.metric.URL, err))
+			m.write("valid", 0)
+			result.Finish(false, err)
+			return nil
+		}
+
+		log.Println(fmt.Sprintf("ldap %s - Connect: %s, Bind: %s, Search: %s, Results: %d, Valid: %t", m.metric.URL,
+			ldap.ConnectElapsed, ldap.BindElapsed, ldap.SearchElapsed, ldap.Results, ldap.Valid))
+
+		m.write("connect-elapsed", milliseconds(ldap.ConnectElapsed))
+		m.write("bind-elapsed", milliseconds(ldap.BindElapsed))
+		m.write("search-elapsed", milliseconds(ldap.SearchElapsed))
+		m.write("results", float64(ldap.Results))
+		m.write("valid", boolMetric(ldap.Valid))
+		result.Details["results"] = ldap.Results
+		result.Finish(ldap.Valid, nil)
+		return nil
+
+	case "sftp":
+
+		transfer, err := models.QuerySFTPMetric(m.metric)
+		if err != nil {
+			log.Println(fmt.Sprintf("sftp %s - Error: %s", m.metric.URL, err))
+			m.write("valid", 0)
+			result.Finish(false, err)
+			return nil
+		}
+
+		var phases []string
+		for _, phase := range transfer.Phases {
+			phases = append(phases, fmt.Sprintf("%s: %s", phase.Name, phase.Elapsed))
+			m.write(phase.Name+"-elapsed", milliseconds(phase.Elapsed))
+		}
+		log.Println(fmt.Sprintf("sftp %s - %s, Valid: %t", m.metric.URL, strings.Join(phases, ", "), transfer.Valid))
+		if transfer.Err != nil {
+			log.Println(fmt.Sprintf("sftp %s - Error: %s", m.metric.URL, transfer.Err))
+		}
+
+		m.write("failed-phase", float64(transfer.FailedPhaseIndex()))
+		m.write("valid", boolMetric(transfer.Valid))
+		result.Details["failedPhase"] = transfer.FailedPhase
+		result.Finish(transfer.Valid, transfer.Err)
+		return nil
+
+	case "mail-roundtrip":
+
+		mail, err := models.QueryMailRoundtripMetric(m.metric)
+		if err != nil {
+			log.Println(fmt.Sprintf("mail-roundtrip %s - Error: %s", m.metric.Name, err))
+			m.write("valid", 0)
+			result.Finish(false, err)
+			return nil
+		}
+
+		log.Println(fmt.Sprintf("mail-roundtrip %s - Submission: %s, Delivery: %s, Delivered: %t, Cleaned: %t", m.metric.Name,
+			mail.SubmissionElapsed, mail.DeliveryElapsed, mail.Delivered, mail.Cleaned))
+		if mail.CleanupErr != nil {
+			log.Println(fmt.Sprintf("mail-roundtrip %s - Error: %s", m.metric.Name, mail.CleanupErr))
+		}
+
+		m.write("submission-elapsed", milliseconds(mail.SubmissionElapsed))
+		if mail.Delivered {
+			m.write("delivery-elapsed", milliseconds(mail.DeliveryElapsed))
+		}
+		m.write("cleaned", boolMetric(mail.Cleaned))
+		m.write("valid", boolMetric(mail.Valid))
+		result.Details["delivered"] = mail.Delivered
+		result.Details["cleaned"] = mail.Cleaned
+		result.Finish(mail.Valid, nil)
+		return nil
+
+	case "broker":
+
+		broker, err := models.QueryBrokerMetric(m.metric)
+		if err != nil {
+			log.Println(fmt.Sprintf("broker %s - Error: %s", m.metric.Name, err))
+			m.write("valid", 0)
+			result.Finish(false, err)
+			return nil
+		}
+
+		log.Println(fmt.Sprintf("broker %s - Connect: %s, Round Trip: %s, Received: %t, Valid: %t", m.metric.Name,
+			broker.ConnectElapsed, broker.Elapsed, broker.Received, broker.Valid))
+
+		m.write("connect-elapsed", milliseconds(broker.ConnectElapsed))
+		if broker.Received {
+			m.write("elapsed", milliseconds(broker.Elapsed))
+		}
+		for name, depth := range broker.Depths {
+			m.write("depth."+name, depth)
+		}
+		m.write("valid", boolMetric(broker.Valid))
+		result.Details["depths"] = broker.Depths
+		result.Details["errors"] = broker.Errors
+		result.Finish(broker.Valid, nil)
+		return nil
+
+	case "tsdb-query":
+
+		tsdb, err := models.QueryTSDBMetric(m.metric)
+		if err != nil {
+			log.Println(fmt.Sprintf("tsdb-query %s - Error: %s", m.metric.TSDB.Query, err))
+			m.write("valid", 0)
+			result.Finish(false, err)
+			return nil
+		}
+
+		log.Println(fmt.Sprintf("tsdb-query %s - Elapsed: %s, Series: %d, Value: %f, No Data: %t, Valid: %t",
+			m.metric.TSDB.Query, tsdb.Elapsed, tsdb.Series, tsdb.Value, tsdb.NoData, tsdb.Valid))
+
+		m.write("elapsed", milliseconds(tsdb.Elapsed))
+		if !tsdb.NoData {
+			m.write("value", tsdb.Value)
+		}
+		m.write("no-data", boolMetric(tsdb.NoData))
+		m.write("valid", boolMetric(tsdb.Valid))
+		result.Details["noData"] = tsdb.NoData
+		if !tsdb.NoData {
+			result.Details["value"] = tsdb.Value
+		}
+		result.Finish(tsdb.Valid, nil)
+		return nil
+
+	case "domain-expiry":
+
+		expiry, err := models.QueryDomainExpiryMetric(m.metric, &m.domainExpiry)
+		if err != nil {
+			log.Println(fmt.Sprintf("domain-expiry %s - Error: %s", m.metric.DomainExpiry.Domain, err))
+			m.write("valid", 0)
+			result.Finish(false, err)
+			return nil
 		}
 
-		m.metricsRouter.Write(fmt.Sprintf("%s.%s.elapsed", m.metric.Type, m.metric.Name), float64(elapsed/time.Microsecond)/1000.0)
-		m.metricsRouter.Write(fmt.Sprintf("%s.%s.status-code", m.metric.Type, m.metric.Name), float64(statusCode))
-		m.metricsRouter.Write(fmt.Sprintf("%s.%s.valid", m.metric.Type, m.metric.Name), float64(validMetric))
+		log.Println(fmt.Sprintf("domain-expiry %s - Server: %s, Expires: %s, Days: %.1f, Cached: %t, Valid: %t",
+			m.metric.DomainExpiry.Domain, expiry.Server, expiry.Expires.Format(time.RFC3339), expiry.Days,
+			expiry.Cached, expiry.Valid))
+
+		if !expiry.Cached {
+			m.write("elapsed", milliseconds(expiry.Elapsed))
+		}
+		m.write("days", expiry.Days)
+		m.write("valid", boolMetric(expiry.Valid))
+		result.Details["server"] = expiry.Server
+		result.Details["expires"] = expiry.Expires
+		result.Details["days"] = expiry.Days
+		result.Details["cached"] = expiry.Cached
+		result.Finish(expiry.Valid, nil)
 		return nil
 
 	default:
-		return fmt.Errorf("could not run metrics runner for type %s as it is an unsupported type", m.metric.Type)
+		err := fmt.Errorf("could not run metrics runner for type %s as it is an unsupported type", m.metric.Type)
+		result.Finish(false, err)
+		return err
+	}
+}
+
+// write sends value for one of this runner's fields (e.g. "elapsed") to the metrics router.
+func (m *MetricsRunner) write(field string, value float64) {
+	m.metricsRouter.WriteCheck(m.metric.Type, m.metric.Name, field, value, m.runStarted)
+
+	m.resultLock.Lock()
+	m.stats.Values[field] = value
+	m.resultLock.Unlock()
+}
+
+func (m *MetricsRunner) setResult(result *models.RunResult) {
+	m.resultLock.Lock()
+	defer m.resultLock.Unlock()
+	m.result = result
+	m.stats.observe(result.Valid, result.Elapsed.Duration, result.Started.Add(result.Elapsed.Duration))
+}
+
+func (m *MetricsRunner) addMismatchDetails(result *models.RunResult) {
+	m.resultLock.RLock()
+	defer m.resultLock.RUnlock()
+	if m.mismatch != nil {
+		result.Details["lastMismatch"] = m.mismatch
 	}
 }
 
@@ -138,3 +478,32 @@ func (m *MetricsRunner) Metric() *models.ConfigMetric {
 		Periodicity: m.metric.Periodicity,
 	}
 }
+
+// Result returns a copy of the result of the last run (nil if we haven't run yet).
+func (m *MetricsRunner) Result() *models.RunResult {
+	m.resultLock.RLock()
+	defer m.resultLock.RUnlock()
+	if m.result == nil {
+		return nil
+	}
+	return m.result.Copy()
+}
+
+// Stats returns a copy of the stats accumulated over every run so far.
+func (m *MetricsRunner) Stats() *ProbeStats {
+	m.resultLock.RLock()
+	defer m.resultLock.RUnlock()
+	return m.stats.copy()
+}
+
+// milliseconds converts a duration into fractional milliseconds (how we report all timings).
+func milliseconds(d time.Duration) float64 {
+	return float64(d/time.Microsecond) / 1000.0
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,72 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package metricsrunner
+
+import (
+	"time"
+)
+
+// ProbeDurationBuckets are the upper bounds (in seconds) of the run duration histogram.
+var ProbeDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// ProbeStats accumulate over every run of a metrics runner (for exposition to prometheus).
+type ProbeStats struct {
+	Successes       uint64
+	Failures        uint64
+	DurationBuckets []uint64 // Cumulative counts per ProbeDurationBuckets bound
+	DurationSum     float64  // Seconds
+	DurationCount   uint64
+	LastRun         time.Time
+	Values          map[string]float64 // The last value written for each field
+}
+
+func newProbeStats() *ProbeStats {
+	return &ProbeStats{
+		DurationBuckets: make([]uint64, len(ProbeDurationBuckets)),
+		Values:          map[string]float64{},
+	}
+}
+
+// observe records a finished run.
+func (s *ProbeStats) observe(valid bool, elapsed time.Duration, finished time.Time) {
+
+	if valid {
+		s.Successes++
+	} else {
+		s.Failures++
+	}
+
+	seconds := elapsed.Seconds()
+	for i, bound := range ProbeDurationBuckets {
+		if seconds <= bound {
+			s.DurationBuckets[i]++
+		}
+	}
+	s.DurationSum += seconds
+	s.DurationCount++
+	s.LastRun = finished
+}
+
+func (s *ProbeStats) copy() *ProbeStats {
+	c := *s
+	c.DurationBuckets = append([]uint64{}, s.DurationBuckets...)
+	c.Values = map[string]float64{}
+	for field, value := range s.Values {
+		c.Values[field] = value
+	}
+	return &c
+}
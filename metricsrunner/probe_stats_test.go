@@ -0,0 +1,49 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package metricsrunner
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProbeStatsObserve(t *testing.T) {
+
+	s := newProbeStats()
+	finished := time.Unix(1554000000, 0)
+	s.observe(true, 5*time.Millisecond, finished) // Right on a bound counts in it
+	s.observe(false, 80*time.Millisecond, finished.Add(time.Minute))
+	s.observe(true, 90*time.Second, finished.Add(2*time.Minute)) // Past every bound (only in +Inf)
+
+	expected := []uint64{1, 1, 1, 1, 2, 2, 2, 2, 2, 2, 2, 2, 2}
+	if !reflect.DeepEqual(s.DurationBuckets, expected) {
+		t.Errorf("expected buckets %v, got %v", expected, s.DurationBuckets)
+	}
+	if s.Successes != 2 || s.Failures != 1 || s.DurationCount != 3 || s.DurationSum != 90.085 ||
+		!s.LastRun.Equal(finished.Add(2*time.Minute)) {
+		t.Errorf("unexpected stats %+v", s)
+	}
+
+	// Copies don't share buckets or values...
+	c := s.copy()
+	c.DurationBuckets[0]++
+	c.Values["elapsed"] = 1
+	if s.DurationBuckets[0] != 1 || len(s.Values) != 0 {
+		t.Errorf("copy shares state with %+v", s)
+	}
+}
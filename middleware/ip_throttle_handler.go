@@ -0,0 +1,89 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package middleware
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	throttled "gopkg.in/throttled/throttled.v2"
+	"gopkg.in/throttled/throttled.v2/store/memstore"
+
+	"github.com/bryancallahan/metrics-runner/models"
+)
+
+// NewIPThrottleHandler limits requests per client ip to the given rate (for routes browsers
+// post to on every page view, which the api's throttle would cut off). Requests from a trusted
+// proxy are throttled by the client it says it forwarded them for.
+func NewIPThrottleHandler(config *models.Config, requestsPerMinute int) func(h http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+
+		throttleStore, err := memstore.New(65536)
+		if err != nil {
+			log.Fatal(err)
+		}
+		trustedProxies, err := config.TrustedProxyNetworks()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		return throttled.RateLimit(throttled.PerMin(requestsPerMinute),
+			&throttled.VaryBy{Custom: func(r *http.Request) string { return clientIP(r, trustedProxies) }},
+			throttleStore).Throttle(h)
+	}
+}
+
+// clientIP is the request's remote address without the port (so every connection from a
+// client shares a limit). If that's a trusted proxy we go back through X-Forwarded-For (which
+// each proxy appends to) to the last address a trusted proxy didn't add.
+func clientIP(r *http.Request, trustedProxies []*net.IPNet) string {
+
+	ip := r.RemoteAddr
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err == nil {
+		ip = host
+	}
+
+	var forwarded []string
+	for _, header := range r.Header["X-Forwarded-For"] {
+		for _, address := range strings.Split(header, ",") {
+			forwarded = append(forwarded, strings.TrimSpace(address))
+		}
+	}
+	for i := len(forwarded) - 1; i >= 0 && isTrustedProxy(ip, trustedProxies); i-- {
+		if net.ParseIP(forwarded[i]) == nil {
+			break
+		}
+		ip = forwarded[i]
+	}
+	return ip
+}
+
+func isTrustedProxy(ip string, trustedProxies []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package middleware
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/bryancallahan/metrics-runner/models"
+)
+
+func TestClientIP(t *testing.T) {
+
+	config := &models.Config{TrustedProxies: []string{"10.0.0.0/8", "192.168.1.1"}}
+	trustedProxies, err := config.TrustedProxyNetworks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := []struct {
+		remoteAddr string
+		forwarded  []string
+		expected   string
+	}{
+		{"203.0.113.9:5000", nil, "203.0.113.9"},
+
+		// Only a trusted proxy gets to say who it's forwarding for...
+		{"203.0.113.9:5000", []string{"198.51.100.1"}, "203.0.113.9"},
+		{"10.1.2.3:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+
+		// Going back through as many trusted proxies as there are (but no further)...
+		{"10.1.2.3:5000", []string{"6.6.6.6, 198.51.100.1, 192.168.1.1"}, "198.51.100.1"},
+		{"10.1.2.3:5000", []string{"6.6.6.6", "198.51.100.1, 10.9.9.9"}, "198.51.100.1"},
+		{"10.1.2.3:5000", []string{"198.51.100.1, 10.9.9.9"}, "198.51.100.1"},
+		{"10.1.2.3:5000", []string{"10.9.9.9"}, "10.9.9.9"},
+		{"10.1.2.3:5000", []string{"garbage, 10.9.9.9"}, "10.9.9.9"},
+	}
+	for _, request := range requests {
+		r := &http.Request{RemoteAddr: request.remoteAddr, Header: http.Header{}}
+		for _, forwarded := range request.forwarded {
+			r.Header.Add("X-Forwarded-For", forwarded)
+		}
+		if ip := clientIP(r, trustedProxies); ip != request.expected {
+			t.Errorf("clientIP(%s, %v) = %s, expected %s", request.remoteAddr, request.forwarded, ip, request.expected)
+		}
+	}
+
+	config.TrustedProxies = []string{"10.0.0.0/33"}
+	if _, err := config.TrustedProxyNetworks(); err == nil {
+		t.Errorf("expected a malformed cidr to be rejected")
+	}
+}
@@ -0,0 +1,122 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Beacon is what browsers send to /api/beacon. It can carry a navigation timing entry, a
+// map of web vitals or a single web vital (as the web-vitals library reports them).
+type Beacon struct {
+	URL        string                 `json:"url"`
+	Navigation map[string]interface{} `json:"navigation"` // PerformanceNavigationTiming (or legacy performance.timing) as json
+	Vitals     map[string]float64     `json:"vitals"`     // e.g. {"LCP": 2100, "CLS": 0.02}
+	Name       string                 `json:"name"`       // A single web vital...
+	Value      *float64               `json:"value"`      // ...and its value
+}
+
+// beaconVitals are the web vitals we keep (anything else is ignored so browsers can't
+// create arbitrary metrics).
+var beaconVitals = map[string]bool{
+	"cls":  true,
+	"fcp":  true,
+	"fid":  true,
+	"inp":  true,
+	"lcp":  true,
+	"ttfb": true,
+}
+
+// beaconNavigationSpans are the timings we derive from a navigation entry (name, start, end
+// where an empty start means since the navigation started).
+var beaconNavigationSpans = [][3]string{
+	{"dns", "domainLookupStart", "domainLookupEnd"},
+	{"connect", "connectStart", "connectEnd"},
+	{"tls", "secureConnectionStart", "connectEnd"},
+	{"request", "requestStart", "responseStart"},
+	{"response", "responseStart", "responseEnd"},
+	{"first-byte", "", "responseStart"},
+	{"dom-interactive", "", "domInteractive"},
+	{"dom-content-loaded", "", "domContentLoadedEventEnd"},
+	{"load", "", "loadEventEnd"},
+}
+
+// ParseBeacon parses a beacon (sendBeacon posts strings as text/plain, so we don't look at
+// the content type).
+func ParseBeacon(body []byte) (*Beacon, error) {
+	beacon := &Beacon{}
+	err := json.Unmarshal(body, beacon)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing beacon: %s", err)
+	}
+	if len(beacon.URL) < 1 {
+		return nil, fmt.Errorf("beacon has no url")
+	}
+	return beacon, nil
+}
+
+// Timings returns the beacon's timings (in milliseconds, apart from cls) by metric name.
+func (b *Beacon) Timings() map[string]float64 {
+
+	timings := map[string]float64{}
+
+	// Navigation timing entries are relative to startTime (0) but the legacy performance.timing
+	// object has epoch timestamps relative to navigationStart...
+	if len(b.Navigation) > 0 {
+		base := b.navigation("startTime")
+		if navigationStart := b.navigation("navigationStart"); navigationStart > 0 {
+			base = navigationStart
+		}
+		for _, span := range beaconNavigationSpans {
+			start, end := base, b.navigation(span[2])
+			if len(span[1]) > 0 {
+				start = b.navigation(span[1])
+			}
+			if end <= 0 || (span[1] == "secureConnectionStart" && start <= 0) {
+				continue // Never reached (or not a secure connection)
+			}
+			if value := end - start; value >= 0 {
+				timings[span[0]] = value
+			}
+		}
+	}
+
+	for name, value := range b.Vitals {
+		b.addVital(timings, name, value)
+	}
+	if len(b.Name) > 0 && b.Value != nil {
+		b.addVital(timings, b.Name, *b.Value)
+	}
+
+	return timings
+}
+
+// navigation returns a numeric navigation timing field (0 if it's missing).
+func (b *Beacon) navigation(name string) float64 {
+	value, _ := b.Navigation[name].(float64)
+	return value
+}
+
+func (b *Beacon) addVital(timings map[string]float64, name string, value float64) {
+	name = strings.ToLower(name)
+	if beaconVitals[name] && value >= 0 && !math.IsInf(value, 0) && !math.IsNaN(value) {
+		timings[name] = value
+	}
+}
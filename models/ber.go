@@ -0,0 +1,233 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A minimal BER (basic encoding rules) encoder / decoder, just enough to speak
+// SNMP and LDAP. Only single byte tags are supported (which is all either needs).
+
+const (
+	berTagBoolean     = 0x01
+	berTagInteger     = 0x02
+	berTagOctetString = 0x04
+	berTagNull        = 0x05
+	berTagOID         = 0x06
+	berTagEnumerated  = 0x0a
+	berTagSequence    = 0x30
+)
+
+// berElement is a decoded tag-length-value. Content slices into the decoded buffer.
+type berElement struct {
+	Tag     byte
+	Content []byte
+}
+
+func berEncode(tag byte, content []byte) []byte {
+	return append(append([]byte{tag}, berLength(len(content))...), content...)
+}
+
+func berLength(length int) []byte {
+	if length < 0x80 {
+		return []byte{byte(length)}
+	}
+	var b []byte
+	for ; length > 0; length >>= 8 {
+		b = append([]byte{byte(length)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+func berConstruct(tag byte, children ...[]byte) []byte {
+	var content []byte
+	for _, child := range children {
+		content = append(content, child...)
+	}
+	return berEncode(tag, content)
+}
+
+func berSequence(children ...[]byte) []byte {
+	return berConstruct(berTagSequence, children...)
+}
+
+func berInteger(tag byte, value int64) []byte {
+	// Two's complement, big endian, as few bytes as possible...
+	b := []byte{byte(value)}
+	for value >= 0x80 || value < -0x80 {
+		value >>= 8
+		b = append([]byte{byte(value)}, b...)
+	}
+	return berEncode(tag, b)
+}
+
+func berUnsigned(tag byte, value uint64) []byte {
+	b := []byte{byte(value)}
+	for value >= 0x100 {
+		value >>= 8
+		b = append([]byte{byte(value)}, b...)
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...) // Keep it positive
+	}
+	return berEncode(tag, b)
+}
+
+func berBoolean(value bool) []byte {
+	if value {
+		return berEncode(berTagBoolean, []byte{0xff})
+	}
+	return berEncode(berTagBoolean, []byte{0})
+}
+
+func berOctetString(tag byte, value []byte) []byte {
+	return berEncode(tag, value)
+}
+
+func berNull() []byte {
+	return []byte{berTagNull, 0}
+}
+
+// berOID encodes a dotted object identifier (e.g. "1.3.6.1.2.1.1.3.0").
+func berOID(oid string) ([]byte, error) {
+
+	parts := strings.Split(strings.TrimPrefix(oid, "."), ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid oid %s", oid)
+	}
+
+	arcs := make([]uint64, len(parts))
+	for i, part := range parts {
+		arc, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid oid %s", oid)
+		}
+		arcs[i] = arc
+	}
+
+	content := berBase128(arcs[0]*40 + arcs[1])
+	for _, arc := range arcs[2:] {
+		content = append(content, berBase128(arc)...)
+	}
+
+	return berEncode(berTagOID, content), nil
+}
+
+func berBase128(value uint64) []byte {
+	b := []byte{byte(value & 0x7f)}
+	for value >>= 7; value > 0; value >>= 7 {
+		b = append([]byte{byte(value&0x7f) | 0x80}, b...)
+	}
+	return b
+}
+
+// berDecode reads one element off the front of data and returns it with whatever follows.
+func berDecode(data []byte) (berElement, []byte, error) {
+
+	if len(data) < 2 {
+		return berElement{}, nil, fmt.Errorf("ber: truncated element")
+	}
+
+	tag := data[0]
+	if tag&0x1f == 0x1f {
+		return berElement{}, nil, fmt.Errorf("ber: multi-byte tags are not supported")
+	}
+
+	length := int(data[1])
+	offset := 2
+	if length&0x80 != 0 {
+		count := length & 0x7f
+		if count < 1 || count > 4 || len(data) < offset+count {
+			return berElement{}, nil, fmt.Errorf("ber: unsupported length")
+		}
+		length = 0
+		for _, b := range data[offset : offset+count] {
+			length = length<<8 | int(b)
+		}
+		offset += count
+	}
+
+	if length < 0 || len(data) < offset+length {
+		return berElement{}, nil, fmt.Errorf("ber: truncated element")
+	}
+
+	return berElement{Tag: tag, Content: data[offset : offset+length]}, data[offset+length:], nil
+}
+
+// berChildren decodes all of the elements inside a constructed element.
+func berChildren(data []byte) ([]berElement, error) {
+	var children []berElement
+	for len(data) > 0 {
+		child, rest, err := berDecode(data)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+		data = rest
+	}
+	return children, nil
+}
+
+func (e berElement) Int() int64 {
+	if len(e.Content) < 1 {
+		return 0
+	}
+	value := int64(int8(e.Content[0])) // Sign extend the first byte
+	for _, b := range e.Content[1:] {
+		value = value<<8 | int64(b)
+	}
+	return value
+}
+
+func (e berElement) Uint() uint64 {
+	var value uint64
+	for _, b := range e.Content {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+func (e berElement) OID() string {
+
+	if len(e.Content) < 1 {
+		return ""
+	}
+
+	var arcs []string
+	var value uint64
+	for _, b := range e.Content {
+		value = value<<7 | uint64(b&0x7f)
+		if b&0x80 != 0 {
+			continue
+		}
+		if len(arcs) == 0 {
+			first := value / 40
+			if first > 2 {
+				first = 2
+			}
+			arcs = append(arcs, strconv.FormatUint(first, 10), strconv.FormatUint(value-first*40, 10))
+		} else {
+			arcs = append(arcs, strconv.FormatUint(value, 10))
+		}
+		value = 0
+	}
+
+	return strings.Join(arcs, ".")
+}
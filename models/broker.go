@@ -0,0 +1,174 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type BrokerResult struct {
+	ConnectElapsed time.Duration
+	Elapsed        time.Duration // Publishing until the message came back to us
+	Received       bool
+	Depths         map[string]float64 // Messages waiting in each configured queue (or stream)
+	Errors         []string
+	Valid          bool
+}
+
+// QueryBrokerMetric publishes a uniquely tagged message via the metric's broker (amqp://,
+// amqps://, nats:// or tls:// url) and times how long it takes to come back through a
+// temporary queue (or subscription). It also reports the depth of any configured queues.
+func QueryBrokerMetric(metric *ConfigMetric) (*BrokerResult, error) {
+
+	// We can only query metrics of broker type...
+	if metric.Type != "broker" {
+		return nil, fmt.Errorf("cannot query metric type %s via broker", metric.Type)
+	}
+
+	u, err := url.Parse(metric.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	tag := make([]byte, 8)
+	_, err = rand.Read(tag)
+	if err != nil {
+		return nil, err
+	}
+	id := fmt.Sprintf("metrics-runner-%s-%s", metric.Name, hex.EncodeToString(tag))
+
+	result := &BrokerResult{Depths: map[string]float64{}}
+
+	switch u.Scheme {
+	case "amqp", "amqps":
+		err = queryAMQP(metric, id, result)
+	case "nats", "tls":
+		err = queryNATS(metric, u, id, result)
+	default:
+		return nil, fmt.Errorf("cannot query %s (only amqp, amqps, nats and tls urls are supported)", metric.URL)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result.Valid = result.Received && len(result.Errors) == 0
+	return result, nil
+}
+
+// brokerRoutingKey returns the configured routing key (or subject), defaulting to one
+// specific to the metric.
+func brokerRoutingKey(metric *ConfigMetric) string {
+	if len(metric.Broker.RoutingKey) > 0 {
+		return metric.Broker.RoutingKey
+	}
+	return fmt.Sprintf("metrics-runner.%s", metric.Name)
+}
+
+func queryAMQP(metric *ConfigMetric, id string, result *BrokerResult) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), metric.Timeout.Duration)
+	defer cancel()
+
+	// Connect...
+	start := time.Now()
+	conn, err := amqp.DialConfig(metric.URL, amqp.Config{Dial: amqp.DefaultDial(metric.Timeout.Duration)})
+	if err != nil {
+		return fmt.Errorf("error connecting: %s", err)
+	}
+	defer conn.Close()
+	result.ConnectElapsed = time.Since(start)
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	// Declare a temporary queue (the server names it and deletes it when we disconnect)...
+	queue, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		return fmt.Errorf("error declaring queue: %s", err)
+	}
+
+	// Everything goes to the default exchange by queue name, otherwise bind to the exchange...
+	exchange := metric.Broker.Exchange
+	routingKey := queue.Name
+	if len(exchange) > 0 {
+		routingKey = brokerRoutingKey(metric)
+		err = ch.QueueBind(queue.Name, routingKey, exchange, false, nil)
+		if err != nil {
+			return fmt.Errorf("error binding to exchange %s: %s", exchange, err)
+		}
+	}
+
+	deliveries, err := ch.Consume(queue.Name, "", true, true, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("error consuming: %s", err)
+	}
+
+	// Round trip...
+	start = time.Now()
+	err = ch.PublishWithContext(ctx, exchange, routingKey, false, false, amqp.Publishing{
+		ContentType: "text/plain",
+		MessageId:   id,
+		Expiration:  fmt.Sprintf("%d", metric.Timeout.Duration/time.Millisecond), // Don't linger if we never see it
+		Body:        []byte(id),
+	})
+	if err != nil {
+		return fmt.Errorf("error publishing: %s", err)
+	}
+	timedOut := false
+	for !result.Received && !timedOut {
+		select {
+		case delivery, ok := <-deliveries:
+			if !ok {
+				return fmt.Errorf("channel closed while waiting for our message")
+			}
+			if delivery.MessageId == id {
+				result.Elapsed = time.Since(start)
+				result.Received = true
+			}
+		case <-ctx.Done():
+			result.Errors = append(result.Errors, "timed out waiting for our message")
+			timedOut = true // Queue depths are most interesting when messages aren't getting through
+		}
+	}
+
+	// Check named queues (on their own channel each as a missing queue closes the channel)...
+	for _, name := range metric.Broker.Queues {
+		depthChannel, err := conn.Channel()
+		if err != nil {
+			return err
+		}
+		queue, err := depthChannel.QueueDeclarePassive(name, false, false, false, false, nil)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("error checking queue %s: %s", name, err))
+		} else {
+			result.Depths[name] = float64(queue.Messages)
+		}
+		depthChannel.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,86 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func configTestDecode(t *testing.T, config string) (*Config, error) {
+
+	directory, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	filename := filepath.Join(directory, "config.json")
+	err = ioutil.WriteFile(filename, []byte(config), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{}
+	return c, decodeJson(filename, c)
+}
+
+func TestDecodeJsonSinkSizes(t *testing.T) {
+
+	// Left out they're defaulted...
+	c, err := configTestDecode(t, `{"metricsRouter": {"sinks": [{"type": "influx"}]}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sink := c.MetricsRouter.Sinks[0]; sink.QueueSize != 10000 || sink.BatchSize != 500 {
+		t.Errorf("unexpected sink sizes %d and %d", sink.QueueSize, sink.BatchSize)
+	}
+
+	// Anything below 1 is an error (rather than a panic making the queue)...
+	for _, sizes := range []string{`"queueSize": -1`, `"batchSize": -5`} {
+		_, err := configTestDecode(t, `{"metricsRouter": {"sinks": [{"type": "influx", `+sizes+`}]}}`)
+		if err == nil || !strings.Contains(err.Error(), "at least 1") {
+			t.Errorf("expected %s to be rejected, got %v", sizes, err)
+		}
+	}
+}
+
+func TestDecodeJsonCanaryRenderURL(t *testing.T) {
+
+	for _, test := range []struct {
+		canary string
+		ok     bool
+	}{
+		{`"enabled": true, "renderURL": "http://graphite.example.com"`, true},
+		{`"enabled": true, "renderURL": "https://graphite.example.com/graphite/"`, true},
+		{`"enabled": false`, true},
+		{`"enabled": true`, false},
+		{`"enabled": true, "renderURL": "graphite.example.com"`, false},
+		{`"enabled": true, "renderURL": "tcp://graphite.example.com:2003"`, false},
+		{`"enabled": true, "renderURL": "http://"`, false},
+	} {
+		_, err := configTestDecode(t, `{"metricsRouter": {"canary": {`+test.canary+`}}}`)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: expected ok %v, got %v", test.canary, test.ok, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "canary render url") {
+			t.Errorf("%s: unexpected error %s", test.canary, err)
+		}
+	}
+}
@@ -0,0 +1,555 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	crawlUserAgent     = "metrics-runner"
+	maxCrawlPageLength = 10 * 1024 * 1024 // We don't parse more than this much of a page
+)
+
+var (
+	crawlTagRegexp       = regexp.MustCompile(`(?is)<(a|img|script|link)\b([^>]*)>`)
+	crawlAttributeRegexp = regexp.MustCompile(`(?is)\b(href|src|rel)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+)
+
+type CrawlBrokenLink struct {
+	URL        string `json:"url"`
+	FoundOn    string `json:"foundOn,omitempty"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type CrawlResult struct {
+	Elapsed      time.Duration
+	Pages        int
+	Assets       int
+	TotalBytes   int64
+	SlowestPage  string
+	SlowestTime  time.Duration
+	BrokenLinks  []CrawlBrokenLink
+	RobotsDenied int // Links we skipped because robots.txt asked us to
+}
+
+// crawler holds the state of a single crawl (everything is guarded by the mutex
+// except for the client and the per-host semaphores, which are safe on their own).
+type crawler struct {
+	sync.Mutex
+
+	metric     *ConfigMetric
+	origin     *url.URL
+	client     *http.Client
+	seen       map[string]bool
+	robots     robotsEntry // The origin's (other hosts only serve us assets)
+	semaphores map[string]chan struct{}
+	result     *CrawlResult
+}
+
+// QueryCrawlMetric crawls the site starting at the metric's url (a page or a sitemap.xml),
+// checking every same-origin page and referenced asset it finds along the way.
+func QueryCrawlMetric(metric *ConfigMetric) (*CrawlResult, error) {
+
+	// We can only query metrics of crawl type...
+	if metric.Type != "crawl" {
+		return nil, fmt.Errorf("cannot query metric type %s via crawl", metric.Type)
+	}
+
+	origin, err := url.Parse(metric.URL)
+	if err != nil {
+		return nil, err
+	}
+	if origin.Scheme != "http" && origin.Scheme != "https" {
+		return nil, fmt.Errorf("cannot crawl %s (only http and https urls are supported)", metric.URL)
+	}
+
+	c := &crawler{
+		metric:     metric,
+		origin:     origin,
+		client:     &http.Client{Timeout: metric.Timeout.Duration},
+		seen:       map[string]bool{},
+		semaphores: map[string]chan struct{}{},
+		result:     &CrawlResult{},
+	}
+
+	start := time.Now()
+
+	// Figure out where we're starting from...
+	frontier := []crawlLink{{url: origin.String()}}
+	if metric.Crawl.Sitemap || strings.HasSuffix(strings.ToLower(origin.Path), ".xml") {
+		frontier, err = c.readSitemap(origin.String(), true)
+		if err != nil {
+			return nil, fmt.Errorf("error reading sitemap %s: %s", metric.URL, err)
+		}
+	}
+
+	// Crawl breadth first, one depth at a time...
+	for depth := 0; depth <= metric.Crawl.MaxDepth && len(frontier) > 0; depth++ {
+
+		var wg sync.WaitGroup
+		var nextLock sync.Mutex
+		var next []crawlLink
+
+		for _, link := range frontier {
+
+			if !c.claim(link, true) {
+				continue
+			}
+
+			wg.Add(1)
+			go func(link crawlLink, followLinks bool) {
+				defer wg.Done()
+				found := c.crawlPage(link, followLinks)
+				nextLock.Lock()
+				next = append(next, found...)
+				nextLock.Unlock()
+			}(link, depth < metric.Crawl.MaxDepth)
+		}
+
+		wg.Wait()
+		frontier = next
+	}
+
+	c.result.Elapsed = time.Since(start)
+	sort.Slice(c.result.BrokenLinks, func(i, j int) bool {
+		return c.result.BrokenLinks[i].URL < c.result.BrokenLinks[j].URL
+	})
+
+	return c.result, nil
+}
+
+type crawlLink struct {
+	url     string
+	foundOn string
+}
+
+// claim marks link as seen and returns true if we should fetch it (it's new, we're
+// still under the page limit and robots.txt lets us).
+func (c *crawler) claim(link crawlLink, isPage bool) bool {
+
+	c.Lock()
+	if c.seen[link.url] {
+		c.Unlock()
+		return false
+	}
+	c.seen[link.url] = true
+	c.Unlock()
+
+	if !c.allowedByRobots(link.url) {
+		c.Lock()
+		c.result.RobotsDenied++
+		c.Unlock()
+		return false
+	}
+
+	if isPage {
+		c.Lock()
+		defer c.Unlock()
+		if c.result.Pages >= c.metric.Crawl.MaxPages {
+			return false
+		}
+		c.result.Pages++
+	}
+
+	return true
+}
+
+// crawlPage fetches a page along with its assets and returns the same-origin
+// links found on it (when followLinks is set).
+func (c *crawler) crawlPage(link crawlLink, followLinks bool) []crawlLink {
+
+	elapsed, res, body, size, err := c.fetch(link.url, maxCrawlPageLength)
+	if err != nil || res.StatusCode >= 400 {
+		c.broken(link, res, err)
+		return nil
+	}
+
+	c.Lock()
+	c.result.TotalBytes += size
+	if elapsed > c.result.SlowestTime {
+		c.result.SlowestTime = elapsed
+		c.result.SlowestPage = link.url
+	}
+	c.Unlock()
+
+	// Only html can link to anything...
+	if !strings.Contains(res.Header.Get("Content-Type"), "html") {
+		return nil
+	}
+
+	pages, assets := c.extractLinks(res.Request.URL, body)
+
+	// Fetch assets (once per crawl, no matter how many pages use them)...
+	var wg sync.WaitGroup
+	for _, asset := range assets {
+		asset := crawlLink{url: asset, foundOn: link.url}
+		if !c.claim(asset, false) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.crawlAsset(asset)
+		}()
+	}
+	wg.Wait()
+
+	if !followLinks {
+		return nil
+	}
+
+	var found []crawlLink
+	for _, page := range pages {
+		found = append(found, crawlLink{url: page, foundOn: link.url})
+	}
+	return found
+}
+
+func (c *crawler) crawlAsset(link crawlLink) {
+
+	_, res, _, size, err := c.fetch(link.url, 0)
+	if err != nil || res.StatusCode >= 400 {
+		c.broken(link, res, err)
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.result.Assets++
+	c.result.TotalBytes += size
+}
+
+func (c *crawler) broken(link crawlLink, res *http.Response, err error) {
+
+	brokenLink := CrawlBrokenLink{URL: link.url, FoundOn: link.foundOn}
+	if err != nil {
+		brokenLink.Error = err.Error()
+	} else {
+		brokenLink.StatusCode = res.StatusCode
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.result.BrokenLinks = append(c.result.BrokenLinks, brokenLink)
+}
+
+// fetch GETs rawURL while holding one of its host's concurrency slots. Bodies are
+// read in full (to weigh them) but only up to limit bytes are kept.
+func (c *crawler) fetch(rawURL string, limit int64) (time.Duration, *http.Response, []byte, int64, error) {
+
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return 0, nil, nil, 0, err
+	}
+	req.Header.Set("User-Agent", crawlUserAgent)
+	for key, value := range c.metric.Headers {
+		req.Header.Add(key, value)
+	}
+
+	semaphore := c.semaphore(req.URL.Host)
+	semaphore <- struct{}{}
+	defer func() { <-semaphore }()
+
+	start := time.Now()
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return 0, nil, nil, 0, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, limit))
+	if err != nil {
+		return 0, nil, nil, 0, err
+	}
+
+	// Read (and count) whatever's left...
+	rest, err := io.Copy(ioutil.Discard, res.Body)
+	if err != nil {
+		return 0, nil, nil, 0, err
+	}
+
+	return time.Since(start), res, body, int64(len(body)) + rest, nil
+}
+
+func (c *crawler) semaphore(host string) chan struct{} {
+	c.Lock()
+	defer c.Unlock()
+	semaphore, ok := c.semaphores[host]
+	if !ok {
+		semaphore = make(chan struct{}, c.metric.Crawl.HostConcurrency)
+		c.semaphores[host] = semaphore
+	}
+	return semaphore
+}
+
+// extractLinks pulls the links (anchors) and assets (images, scripts and stylesheets)
+// out of a page. Only same-origin links are returned, assets may live anywhere.
+func (c *crawler) extractLinks(base *url.URL, body []byte) ([]string, []string) {
+
+	var pages, assets []string
+	for _, tag := range crawlTagRegexp.FindAllStringSubmatch(string(body), -1) {
+
+		name := strings.ToLower(tag[1])
+		attributes := map[string]string{}
+		for _, attribute := range crawlAttributeRegexp.FindAllStringSubmatch(tag[2], -1) {
+			attributes[strings.ToLower(attribute[1])] = html.UnescapeString(attribute[2] + attribute[3] + attribute[4])
+		}
+
+		switch name {
+		case "a":
+			link, ok := resolveCrawlLink(base, attributes["href"])
+			if ok && c.sameOrigin(link) {
+				pages = append(pages, link.String())
+			}
+
+		case "img", "script":
+			if link, ok := resolveCrawlLink(base, attributes["src"]); ok {
+				assets = append(assets, link.String())
+			}
+
+		case "link":
+			if !strings.Contains(strings.ToLower(attributes["rel"]), "stylesheet") {
+				continue
+			}
+			if link, ok := resolveCrawlLink(base, attributes["href"]); ok {
+				assets = append(assets, link.String())
+			}
+		}
+	}
+
+	return pages, assets
+}
+
+func (c *crawler) sameOrigin(link *url.URL) bool {
+	return link.Scheme == c.origin.Scheme && link.Host == c.origin.Host
+}
+
+func resolveCrawlLink(base *url.URL, reference string) (*url.URL, bool) {
+
+	reference = strings.TrimSpace(reference)
+	if len(reference) < 1 || strings.HasPrefix(reference, "#") {
+		return nil, false
+	}
+
+	link, err := base.Parse(reference)
+	if err != nil || (link.Scheme != "http" && link.Scheme != "https") {
+		return nil, false // e.g. mailto:, tel:, javascript: or data:
+	}
+	link.Fragment = ""
+
+	return link, true
+}
+
+// readSitemap returns the pages listed in a sitemap (following one level of sitemap index when
+// followIndex is set, which is all the protocol allows, so indexes can't send us round in circles).
+func (c *crawler) readSitemap(rawURL string, followIndex bool) ([]crawlLink, error) {
+
+	_, res, body, _, err := c.fetch(rawURL, maxCrawlPageLength)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+
+	var sitemap struct {
+		XMLName  xml.Name
+		URLs     []string `xml:"url>loc"`
+		Sitemaps []string `xml:"sitemap>loc"`
+	}
+	err = xml.Unmarshal(body, &sitemap)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sitemaps may only list their own site's pages, anything else isn't ours to crawl...
+	var links []crawlLink
+	for _, loc := range sitemap.URLs {
+		link, err := url.Parse(strings.TrimSpace(loc))
+		if err != nil || !c.sameOrigin(link) {
+			continue
+		}
+		links = append(links, crawlLink{url: link.String(), foundOn: rawURL})
+	}
+	for _, loc := range sitemap.Sitemaps {
+		if sitemap.XMLName.Local != "sitemapindex" || !followIndex {
+			continue
+		}
+		nested, err := c.readSitemap(strings.TrimSpace(loc), false)
+		if err != nil {
+			return nil, fmt.Errorf("error reading sitemap %s: %s", loc, err)
+		}
+		links = append(links, nested...)
+	}
+
+	return links, nil
+}
+
+// robotsEntry lets the first link load the origin's robots.txt while the others wait.
+type robotsEntry struct {
+	once  sync.Once
+	rules *robotsRules
+}
+
+// robotsRules are the allow / disallow rules from a robots.txt that apply to us.
+type robotsRules struct {
+	allow    []robotsRule
+	disallow []robotsRule
+}
+
+type robotsRule struct {
+	pattern *regexp.Regexp
+	length  int // Of the path as written (which decides the most specific match)
+}
+
+func (c *crawler) allowedByRobots(rawURL string) bool {
+
+	link, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+
+	// Only the origin's robots.txt is ours to follow (other hosts just serve its assets)...
+	if !c.sameOrigin(link) {
+		return true
+	}
+	c.robots.once.Do(func() {
+		c.robots.rules = c.readRobots()
+	})
+
+	return c.robots.rules.allowed(link.RequestURI())
+}
+
+func (c *crawler) readRobots() *robotsRules {
+
+	robotsURL := &url.URL{Scheme: c.origin.Scheme, Host: c.origin.Host, Path: "/robots.txt"}
+	_, res, body, _, err := c.fetch(robotsURL.String(), maxCrawlPageLength)
+	if err != nil || res.StatusCode != 200 {
+		return &robotsRules{} // No (readable) robots.txt means everything is allowed
+	}
+
+	return parseRobots(string(body), crawlUserAgent)
+}
+
+// parseRobots reads the rules for userAgent out of a robots.txt (falling back on the
+// rules for "*" when nothing names us specifically).
+func parseRobots(robots string, userAgent string) *robotsRules {
+
+	groups := map[string]*robotsRules{}
+	var current []string
+	inAgents := false
+
+	scanner := bufio.NewScanner(strings.NewReader(robots))
+	for scanner.Scan() {
+
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(parts[0]))
+		value := strings.TrimSpace(parts[1])
+
+		switch key {
+		case "user-agent":
+			if !inAgents {
+				current = nil
+			}
+			inAgents = true
+			agent := strings.ToLower(value)
+			current = append(current, agent)
+			if _, ok := groups[agent]; !ok {
+				groups[agent] = &robotsRules{}
+			}
+
+		case "allow", "disallow":
+			inAgents = false
+			if len(value) < 1 {
+				continue // An empty disallow allows everything
+			}
+			rule := robotsRule{pattern: robotsPattern(value), length: len(value)}
+			for _, agent := range current {
+				if key == "allow" {
+					groups[agent].allow = append(groups[agent].allow, rule)
+				} else {
+					groups[agent].disallow = append(groups[agent].disallow, rule)
+				}
+			}
+
+		default:
+			inAgents = false
+		}
+	}
+
+	userAgent = strings.ToLower(userAgent)
+	for agent, rules := range groups {
+		if agent != "*" && strings.Contains(userAgent, agent) {
+			return rules
+		}
+	}
+	if rules, ok := groups["*"]; ok {
+		return rules
+	}
+	return &robotsRules{}
+}
+
+// robotsPattern converts a robots.txt path (which may use "*" and "$") into a regexp.
+func robotsPattern(path string) *regexp.Regexp {
+	anchored := strings.HasSuffix(path, "$")
+	path = strings.TrimSuffix(path, "$")
+	pattern := "^" + strings.Replace(regexp.QuoteMeta(path), `\*`, ".*", -1)
+	if anchored {
+		pattern += "$"
+	}
+	return regexp.MustCompile(pattern)
+}
+
+// allowed applies the most specific (longest) matching rule, preferring allow on a tie.
+func (r *robotsRules) allowed(path string) bool {
+
+	longestAllow, longestDisallow := -1, -1
+	for _, rule := range r.allow {
+		if rule.pattern.MatchString(path) && rule.length > longestAllow {
+			longestAllow = rule.length
+		}
+	}
+	for _, rule := range r.disallow {
+		if rule.pattern.MatchString(path) && rule.length > longestDisallow {
+			longestDisallow = rule.length
+		}
+	}
+
+	return longestDisallow < 0 || longestAllow >= longestDisallow
+}
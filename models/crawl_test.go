@@ -0,0 +1,179 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueryCrawlMetricSitemapIndexCycle(t *testing.T) {
+
+	var server *httptest.Server
+	index := func(locs ...string) string {
+		body := `<?xml version="1.0" encoding="UTF-8"?><sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">`
+		for _, loc := range locs {
+			body += fmt.Sprintf("<sitemap><loc>%s%s</loc></sitemap>", server.URL, loc)
+		}
+		return body + "</sitemapindex>"
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/a.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, index("/b.xml", "/pages.xml"))
+	})
+	mux.HandleFunc("/b.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, index("/a.xml")) // Back where we started
+	})
+	mux.HandleFunc("/pages.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9"><url><loc>%s/page</loc></url></urlset>`, server.URL)
+	})
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<html><body>Hello</body></html>")
+	})
+	server = httptest.NewServer(mux)
+	defer server.Close()
+
+	metric := &ConfigMetric{
+		Type:    "crawl",
+		URL:     server.URL + "/a.xml",
+		Timeout: Duration{5 * time.Second},
+		Crawl:   ConfigMetricCrawl{MaxDepth: 1, MaxPages: 10, HostConcurrency: 2},
+	}
+	result, err := QueryCrawlMetric(metric)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Pages != 1 || len(result.BrokenLinks) != 0 {
+		t.Errorf("expected just the one page, got %+v", result)
+	}
+}
+
+func TestQueryCrawlMetricOrigin(t *testing.T) {
+
+	// Another site (whose robots.txt we've no business reading) serving an image...
+	var elsewhereRobots, elsewherePages int32
+	elsewhere := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/robots.txt":
+			atomic.AddInt32(&elsewhereRobots, 1)
+			fmt.Fprint(w, "User-agent: *\nDisallow: /\n")
+		case "/logo.png":
+			w.Header().Set("Content-Type", "image/png")
+		default:
+			atomic.AddInt32(&elsewherePages, 1)
+			w.Header().Set("Content-Type", "text/html")
+		}
+	}))
+	defer elsewhere.Close()
+
+	var server *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sitemap.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">`+
+			`<url><loc>%s/</loc></url><url><loc>%s/private/page</loc></url><url><loc>%s/other</loc></url></urlset>`,
+			server.URL, server.URL, elsewhere.URL)
+	})
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "User-agent: *\nDisallow: /private/\n")
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<html><body><img src="%s/logo.png"><a href="%s/linked">x</a></body></html>`, elsewhere.URL, elsewhere.URL)
+	})
+	server = httptest.NewServer(mux)
+	defer server.Close()
+
+	result, err := QueryCrawlMetric(&ConfigMetric{
+		Type:    "crawl",
+		URL:     server.URL + "/sitemap.xml",
+		Timeout: Duration{5 * time.Second},
+		Crawl:   ConfigMetricCrawl{MaxDepth: 1, MaxPages: 10, HostConcurrency: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Pages != 1 || result.Assets != 1 || result.RobotsDenied != 1 || len(result.BrokenLinks) != 0 {
+		t.Errorf("expected 1 page, 1 asset and 1 page denied, got %+v", result)
+	}
+	if n := atomic.LoadInt32(&elsewherePages); n != 0 {
+		t.Errorf("expected no pages fetched from another site, got %d", n)
+	}
+	if n := atomic.LoadInt32(&elsewhereRobots); n != 0 {
+		t.Errorf("expected no robots.txt fetched from another site, got %d", n)
+	}
+}
+
+func TestRobotsRules(t *testing.T) {
+
+	robots := `# Comments and unknown lines are ignored
+User-agent: *
+Disallow: /private/
+Allow: /private/public$
+Disallow: /a.b.c
+Allow: /*/deep
+Disallow: /*.pdf$
+Allow: /tie
+Disallow: /tie
+
+User-agent: OtherBot
+User-agent: metrics-runner
+Disallow: /not-for-us
+Disallow:
+`
+
+	rules := parseRobots(robots, "Mozilla/5.0 (compatible; SomeBot)")
+	for _, test := range []struct {
+		path    string
+		allowed bool
+	}{
+		{"/", true},
+		{"/private/", false},
+		{"/private/x", false},
+		{"/private/public", true},
+		{"/private/public/x", false}, // $ anchors the allow
+		{"/a.b.c", false},
+		{"/a.b.c/deep", true}, // The allow is longer as written, however long its regexp
+		{"/axb.c", true},      // A "." is just a dot
+		{"/docs/report.pdf", false},
+		{"/docs/report.pdf?download=1", true},
+		{"/tie", true}, // Allow wins a tie
+	} {
+		if actual := rules.allowed(test.path); actual != test.allowed {
+			t.Errorf("expected %s allowed %v, got %v", test.path, test.allowed, actual)
+		}
+	}
+
+	// A group naming us applies instead of "*" (and can share its rules with other agents)...
+	rules = parseRobots(robots, "metrics-runner")
+	if rules.allowed("/not-for-us") || !rules.allowed("/private/x") {
+		t.Errorf("expected our own group's rules, got %+v", rules)
+	}
+	rules = parseRobots(robots, "otherbot/2.1")
+	if rules.allowed("/not-for-us") {
+		t.Errorf("expected OtherBot's rules, got %+v", rules)
+	}
+	if !parseRobots("", "metrics-runner").allowed("/anything") {
+		t.Errorf("expected an empty robots.txt to allow everything")
+	}
+}
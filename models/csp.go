@@ -0,0 +1,149 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/url"
+	"strings"
+)
+
+// CSPViolation is a content security policy violation (normalized from either report format).
+type CSPViolation struct {
+	DocumentURL   string `json:"documentURL"`
+	Directive     string `json:"directive"`     // The effective directive (e.g. "script-src-elem")
+	BlockedURL    string `json:"blockedURL"`    // As reported (e.g. "https://cdn.example.com/x.js" or "inline")
+	BlockedOrigin string `json:"blockedOrigin"` // e.g. "https://cdn.example.com" or "inline"
+	SourceFile    string `json:"sourceFile,omitempty"`
+	LineNumber    int    `json:"lineNumber,omitempty"`
+	Disposition   string `json:"disposition,omitempty"` // "enforce" or "report"
+	Sample        string `json:"sample,omitempty"`
+}
+
+// ParseCSPReports parses a report-uri style body (application/csp-report, a single report) or
+// a reporting api body (application/reports+json, a list of reports of which we only keep
+// csp violations).
+func ParseCSPReports(contentType string, body []byte) ([]CSPViolation, error) {
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/csp-report", "application/json":
+		report := struct {
+			Report *struct {
+				DocumentURI        string `json:"document-uri"`
+				ViolatedDirective  string `json:"violated-directive"`
+				EffectiveDirective string `json:"effective-directive"`
+				BlockedURI         string `json:"blocked-uri"`
+				SourceFile         string `json:"source-file"`
+				LineNumber         int    `json:"line-number"`
+				Disposition        string `json:"disposition"`
+				ScriptSample       string `json:"script-sample"`
+			} `json:"csp-report"`
+		}{}
+		err := json.Unmarshal(body, &report)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing csp report: %s", err)
+		}
+		if report.Report == nil {
+			return nil, fmt.Errorf("body has no csp-report")
+		}
+		r := report.Report
+		directive := r.EffectiveDirective
+		if len(directive) < 1 {
+			directive = r.ViolatedDirective // Older browsers, e.g. "script-src 'self'"
+		}
+		return []CSPViolation{newCSPViolation(r.DocumentURI, directive, r.BlockedURI, r.SourceFile,
+			r.LineNumber, r.Disposition, r.ScriptSample)}, nil
+
+	case "application/reports+json":
+		var reports []struct {
+			Type string `json:"type"`
+			URL  string `json:"url"`
+			Body struct {
+				DocumentURL        string `json:"documentURL"`
+				EffectiveDirective string `json:"effectiveDirective"`
+				BlockedURL         string `json:"blockedURL"`
+				SourceFile         string `json:"sourceFile"`
+				LineNumber         int    `json:"lineNumber"`
+				Disposition        string `json:"disposition"`
+				Sample             string `json:"sample"`
+			} `json:"body"`
+		}
+		err := json.Unmarshal(body, &reports)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing reports: %s", err)
+		}
+		var violations []CSPViolation
+		for _, r := range reports {
+			if r.Type != "csp-violation" {
+				continue
+			}
+			documentURL := r.Body.DocumentURL
+			if len(documentURL) < 1 {
+				documentURL = r.URL
+			}
+			violations = append(violations, newCSPViolation(documentURL, r.Body.EffectiveDirective, r.Body.BlockedURL,
+				r.Body.SourceFile, r.Body.LineNumber, r.Body.Disposition, r.Body.Sample))
+		}
+		return violations, nil
+
+	default:
+		return nil, fmt.Errorf("content type %s is currently not supported", mediaType)
+	}
+}
+
+func newCSPViolation(documentURL string, directive string, blockedURL string, sourceFile string,
+	lineNumber int, disposition string, sample string) CSPViolation {
+
+	fields := strings.Fields(directive)
+	if len(fields) > 0 {
+		directive = strings.ToLower(fields[0])
+	}
+	if len(directive) < 1 {
+		directive = "unknown"
+	}
+
+	return CSPViolation{
+		DocumentURL:   documentURL,
+		Directive:     directive,
+		BlockedURL:    blockedURL,
+		BlockedOrigin: CSPOrigin(blockedURL),
+		SourceFile:    sourceFile,
+		LineNumber:    lineNumber,
+		Disposition:   disposition,
+		Sample:        sample,
+	}
+}
+
+// CSPOrigin reduces a blocked url to its origin (keywords like "inline" and "eval" and bare
+// schemes like "data" stay as they are).
+func CSPOrigin(blockedURL string) string {
+	blockedURL = strings.TrimSpace(blockedURL)
+	if len(blockedURL) < 1 {
+		return "none"
+	}
+	u, err := url.Parse(blockedURL)
+	if err != nil || len(u.Scheme) < 1 {
+		return strings.ToLower(strings.TrimSuffix(blockedURL, ":"))
+	}
+	if len(u.Host) < 1 {
+		return strings.ToLower(u.Scheme) // e.g. data:, blob:
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
@@ -0,0 +1,136 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCSPReports(t *testing.T) {
+
+	for _, test := range []struct {
+		name        string
+		contentType string
+		body        string
+		violations  []CSPViolation
+		err         string
+	}{
+		{
+			name:        "report-uri",
+			contentType: "application/csp-report",
+			body: `{"csp-report": {"document-uri": "https://www.example.com/page", "referrer": "",
+				"violated-directive": "script-src-elem", "effective-directive": "script-src-elem",
+				"original-policy": "script-src 'self'; report-uri /api/csp", "disposition": "enforce",
+				"blocked-uri": "https://cdn.example.net/lib.js?v=2", "line-number": 12, "source-file": "https://www.example.com/page",
+				"status-code": 200, "script-sample": ""}}`,
+			violations: []CSPViolation{{
+				DocumentURL:   "https://www.example.com/page",
+				Directive:     "script-src-elem",
+				BlockedURL:    "https://cdn.example.net/lib.js?v=2",
+				BlockedOrigin: "https://cdn.example.net",
+				SourceFile:    "https://www.example.com/page",
+				LineNumber:    12,
+				Disposition:   "enforce",
+			}},
+		},
+		{
+			name:        "report-uri from an older browser",
+			contentType: "application/json; charset=utf-8",
+			body: `{"csp-report": {"document-uri": "https://www.example.com/", "violated-directive": "Style-Src 'self' https://fonts.example.net",
+				"blocked-uri": "inline", "script-sample": "body { color: red }"}}`,
+			violations: []CSPViolation{{
+				DocumentURL:   "https://www.example.com/",
+				Directive:     "style-src",
+				BlockedURL:    "inline",
+				BlockedOrigin: "inline",
+				Sample:        "body { color: red }",
+			}},
+		},
+		{
+			name:        "reporting api",
+			contentType: "application/reports+json",
+			body: `[
+				{"type": "csp-violation", "age": 10, "url": "https://www.example.com/a", "user_agent": "x",
+					"body": {"documentURL": "https://www.example.com/a", "effectiveDirective": "img-src",
+						"blockedURL": "data", "disposition": "report", "lineNumber": 0}},
+				{"type": "deprecation", "url": "https://www.example.com/a", "body": {"id": "x"}},
+				{"type": "csp-violation", "url": "https://www.example.com/b",
+					"body": {"effectiveDirective": "", "blockedURL": "eval", "sourceFile": "https://www.example.com/app.js", "lineNumber": 3}}
+			]`,
+			violations: []CSPViolation{
+				{DocumentURL: "https://www.example.com/a", Directive: "img-src", BlockedURL: "data", BlockedOrigin: "data", Disposition: "report"},
+				{DocumentURL: "https://www.example.com/b", Directive: "unknown", BlockedURL: "eval", BlockedOrigin: "eval",
+					SourceFile: "https://www.example.com/app.js", LineNumber: 3},
+			},
+		},
+		{
+			name:        "reporting api without violations",
+			contentType: "application/reports+json",
+			body:        `[{"type": "intervention", "body": {}}]`,
+		},
+		{
+			name:        "no report",
+			contentType: "application/csp-report",
+			body:        `{"document-uri": "https://www.example.com/"}`,
+			err:         "body has no csp-report",
+		},
+		{
+			name:        "not json",
+			contentType: "application/reports+json",
+			body:        `csp-report`,
+			err:         "error parsing reports: invalid character 'c' looking for beginning of value",
+		},
+		{
+			name:        "form",
+			contentType: "application/x-www-form-urlencoded",
+			body:        `a=b`,
+			err:         "content type application/x-www-form-urlencoded is currently not supported",
+		},
+	} {
+		violations, err := ParseCSPReports(test.contentType, []byte(test.body))
+		if len(test.err) > 0 {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(violations, test.violations) {
+			t.Errorf("%s: expected %+v, got %+v (%v)", test.name, test.violations, violations, err)
+		}
+	}
+}
+
+func TestCSPOrigin(t *testing.T) {
+	for blockedURL, expected := range map[string]string{
+		"https://CDN.example.net:8443/lib.js?v=2": "https://cdn.example.net:8443",
+		"wss://socket.example.net/live":           "wss://socket.example.net",
+		"inline":                                  "inline",
+		"eval":                                    "eval",
+		"data":                                    "data",
+		"data:":                                   "data",
+		"data:image/png;base64,iVBORw0KGgo=":      "data",
+		"blob:https://www.example.com/1f9e-44":    "blob",
+		"Trusted-Types-Sink":                      "trusted-types-sink",
+		"":                                        "none",
+		"  ":                                      "none",
+	} {
+		if actual := CSPOrigin(blockedURL); actual != expected {
+			t.Errorf("CSPOrigin(%q) = %q, expected %q", blockedURL, actual, expected)
+		}
+	}
+}
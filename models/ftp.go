@@ -0,0 +1,274 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ftpSession is a minimal ftp client (passive mode only). ftps:// urls upgrade the control
+// and data connections with AUTH TLS (or connect with tls outright when ImplicitTLS is set).
+type ftpSession struct {
+	conn      net.Conn
+	text      *textproto.Conn
+	tlsConfig *tls.Config // Nil for plain ftp
+	deadline  time.Time
+}
+
+func newFTPSession(conn net.Conn, u *url.URL, metric *ConfigMetric) (*ftpSession, error) {
+
+	s := &ftpSession{conn: conn, deadline: time.Now().Add(metric.Timeout.Duration)}
+
+	if u.Scheme == "ftps" {
+		s.tlsConfig = &tls.Config{
+			ServerName:         u.Hostname(),
+			ClientSessionCache: tls.NewLRUClientSessionCache(4), // Servers often insist data connections resume the control session
+		}
+	}
+
+	if s.tlsConfig != nil && metric.SFTP.ImplicitTLS {
+		s.conn = tls.Client(conn, s.tlsConfig)
+	}
+	s.text = textproto.NewConn(s.conn)
+
+	_, _, err := s.text.ReadResponse(220)
+	if err != nil {
+		return nil, err
+	}
+
+	// Upgrade the control connection...
+	if s.tlsConfig != nil && !metric.SFTP.ImplicitTLS {
+		_, err = s.command(234, "AUTH TLS")
+		if err != nil {
+			return nil, err
+		}
+		s.conn = tls.Client(conn, s.tlsConfig)
+		s.text = textproto.NewConn(s.conn)
+	}
+
+	// Log in (anonymously if no user is given)...
+	username := u.User.Username()
+	if len(username) < 1 {
+		username = "anonymous"
+	}
+	code, err := s.command(0, "USER %s", username)
+	if err != nil {
+		return nil, err
+	}
+	if code == 331 {
+		_, err = s.command(230, "PASS %s", transferPassword(u, metric))
+		if err != nil {
+			return nil, err
+		}
+	} else if code != 230 {
+		return nil, fmt.Errorf("unexpected response to USER (code %d)", code)
+	}
+
+	// Protect the data connections too...
+	if s.tlsConfig != nil {
+		_, err = s.command(200, "PBSZ 0")
+		if err == nil {
+			_, err = s.command(200, "PROT P")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = s.command(200, "TYPE I")
+	if err != nil {
+		return nil, err
+	}
+	if len(u.Path) > 0 && u.Path != "/" {
+		_, err = s.command(250, "CWD %s", u.Path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// command sends a command and reads its response (expecting expectCode unless it's zero).
+func (s *ftpSession) command(expectCode int, format string, args ...interface{}) (int, error) {
+	_, err := s.text.Cmd(format, args...)
+	if err != nil {
+		return 0, err
+	}
+	code, message, err := s.text.ReadResponse(expectCode)
+	if _, ok := err.(*textproto.Error); ok && expectCode == 0 {
+		return code, nil
+	}
+	if err != nil {
+		return code, fmt.Errorf("%s: %d %s", strings.Fields(format)[0], code, message)
+	}
+	return code, nil
+}
+
+// data opens a passive data connection and sends the command that will use it.
+func (s *ftpSession) data(format string, args ...interface{}) (net.Conn, error) {
+
+	address, err := s.passive()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("tcp", address, time.Until(s.deadline))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(s.deadline)
+
+	code, err := s.command(0, format, args...)
+	if err != nil || (code != 125 && code != 150) {
+		conn.Close()
+		if err == nil {
+			err = fmt.Errorf("%s: unexpected response (code %d)", strings.Fields(format)[0], code)
+		}
+		return nil, err
+	}
+
+	if s.tlsConfig != nil {
+		return tls.Client(conn, s.tlsConfig), nil
+	}
+	return conn, nil
+}
+
+// passive returns the address to open a data connection to. The host from a PASV response
+// is ignored (servers behind nat often get it wrong) in favour of the control connection's.
+func (s *ftpSession) passive() (string, error) {
+
+	host, _, _ := net.SplitHostPort(s.conn.RemoteAddr().String())
+
+	_, err := s.text.Cmd("EPSV")
+	if err != nil {
+		return "", err
+	}
+	_, message, err := s.text.ReadResponse(229)
+	if err == nil {
+		// e.g. "Entering Extended Passive Mode (|||6446|)"...
+		start, end := strings.Index(message, "(|||"), strings.LastIndex(message, "|)")
+		if start < 0 || end < start+4 {
+			return "", fmt.Errorf("malformed EPSV response: %s", message)
+		}
+		return net.JoinHostPort(host, message[start+4:end]), nil
+	}
+
+	_, err = s.text.Cmd("PASV")
+	if err != nil {
+		return "", err
+	}
+	code, message, err := s.text.ReadResponse(227)
+	if err != nil {
+		return "", fmt.Errorf("PASV: %d %s", code, message)
+	}
+
+	// e.g. "Entering Passive Mode (192,168,1,2,25,46)"...
+	start, end := strings.Index(message, "("), strings.LastIndex(message, ")")
+	if start < 0 || end < start {
+		return "", fmt.Errorf("malformed PASV response: %s", message)
+	}
+	parts := strings.Split(message[start+1:end], ",")
+	if len(parts) != 6 {
+		return "", fmt.Errorf("malformed PASV response: %s", message)
+	}
+	high, err := strconv.Atoi(strings.TrimSpace(parts[4]))
+	if err != nil {
+		return "", fmt.Errorf("malformed PASV response: %s", message)
+	}
+	low, err := strconv.Atoi(strings.TrimSpace(parts[5]))
+	if err != nil {
+		return "", fmt.Errorf("malformed PASV response: %s", message)
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(high<<8|low)), nil
+}
+
+// finish closes a data connection and waits for the server to confirm the transfer.
+func (s *ftpSession) finish(conn net.Conn, err error) error {
+	closeErr := conn.Close()
+	code, message, readErr := s.text.ReadResponse(226)
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	if readErr != nil {
+		return fmt.Errorf("transfer failed: %d %s", code, message)
+	}
+	return nil
+}
+
+func (s *ftpSession) Upload(name string, data []byte) error {
+	conn, err := s.data("STOR %s", name)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(data)
+	return s.finish(conn, err)
+}
+
+func (s *ftpSession) List() ([]string, error) {
+	conn, err := s.data("NLST")
+	if err != nil {
+		return nil, err
+	}
+	listing, err := ioutil.ReadAll(conn)
+	err = s.finish(conn, err)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, line := range strings.Split(string(listing), "\n") {
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			names = append(names, line)
+		}
+	}
+	return names, nil
+}
+
+func (s *ftpSession) Download(name string) ([]byte, error) {
+	conn, err := s.data("RETR %s", name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(conn)
+	err = s.finish(conn, err)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *ftpSession) Delete(name string) error {
+	_, err := s.command(250, "DELE %s", name)
+	return err
+}
+
+func (s *ftpSession) Close() error {
+	s.command(221, "QUIT")
+	return s.conn.Close()
+}
@@ -0,0 +1,214 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/jsonq"
+)
+
+// introspectionQuery asks for the whole schema (the same query graphiql sends).
+const introspectionQuery = `query IntrospectionQuery {
+  __schema {
+    queryType { name }
+    mutationType { name }
+    subscriptionType { name }
+    types { ...FullType }
+    directives { name description locations args { ...InputValue } }
+  }
+}
+fragment FullType on __Type {
+  kind name description
+  fields(includeDeprecated: true) {
+    name description args { ...InputValue } type { ...TypeRef } isDeprecated deprecationReason
+  }
+  inputFields { ...InputValue }
+  interfaces { ...TypeRef }
+  enumValues(includeDeprecated: true) { name description isDeprecated deprecationReason }
+  possibleTypes { ...TypeRef }
+}
+fragment InputValue on __InputValue {
+  name description type { ...TypeRef } defaultValue
+}
+fragment TypeRef on __Type {
+  kind name
+  ofType { kind name ofType { kind name ofType { kind name ofType { kind name ofType { kind name ofType { kind name ofType { kind name } } } } } } }
+}`
+
+type GraphQLResult struct {
+	Elapsed           time.Duration
+	StatusCode        int
+	Valid             bool
+	Errors            []string           // Messages from the response's errors array
+	Values            map[string]float64 // Fields extracted from data (by configured name)
+	SchemaFingerprint string             // Only set when schema checking is enabled
+	SchemaError       string             // Why the schema couldn't be fingerprinted (the query's result still stands)
+}
+
+// QueryGraphQLMetric posts the metric's query (and variables) and checks the response
+// for errors, pulling any configured numeric fields out of its data.
+func QueryGraphQLMetric(metric *ConfigMetric) (*GraphQLResult, error) {
+
+	// We can only query metrics of graphql type...
+	if metric.Type != "graphql" {
+		return nil, fmt.Errorf("cannot query metric type %s via graphql", metric.Type)
+	}
+
+	elapsed, statusCode, response, err := doGraphQLRequest(metric, metric.GraphQL.Query, metric.GraphQL.Variables,
+		metric.GraphQL.OperationName)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &GraphQLResult{
+		Elapsed:    elapsed,
+		StatusCode: statusCode,
+		Values:     map[string]float64{},
+	}
+
+	// GraphQL servers answer 200 even when the query failed, so we have to look inside...
+	for _, e := range response.Errors {
+		result.Errors = append(result.Errors, e.Message)
+	}
+	result.Valid = statusCode == 200 && len(result.Errors) == 0 && response.Data != nil
+
+	// Extract numeric fields (anything missing or non-numeric invalidates the run)...
+	if data, ok := response.Data.(map[string]interface{}); ok {
+		jq := jsonq.NewQuery(data)
+		for name, path := range metric.GraphQL.Extract {
+			value, err := jq.Float(strings.Split(path, ".")...)
+			if err != nil {
+				result.Valid = false
+				result.Errors = append(result.Errors, fmt.Sprintf("could not extract %s from data.%s", name, path))
+				continue
+			}
+			result.Values[name] = value
+		}
+	}
+
+	// Fingerprint the schema (if asked to)...
+	if metric.GraphQL.CheckSchema {
+		fingerprint, err := graphQLSchemaFingerprint(metric)
+		if err != nil {
+			result.SchemaError = fmt.Sprintf("error fingerprinting schema: %s", err)
+		}
+		result.SchemaFingerprint = fingerprint
+	}
+
+	return result, nil
+}
+
+type graphQLResponse struct {
+	Data   interface{} `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+func doGraphQLRequest(metric *ConfigMetric, query string, variables map[string]interface{},
+	operationName string) (time.Duration, int, *graphQLResponse, error) {
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"query":         query,
+		"variables":     variables,
+		"operationName": operationName,
+	})
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	req, err := http.NewRequest("POST", metric.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	elapsed, res, body, err := sendHTTPRequest(metric, req)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	response := &graphQLResponse{}
+	err = json.Unmarshal(body, response)
+	if err != nil {
+		return elapsed, res.StatusCode, nil, fmt.Errorf("error parsing response (status code %d): %s", res.StatusCode, err)
+	}
+
+	return elapsed, res.StatusCode, response, nil
+}
+
+// graphQLSchemaFingerprint introspects the schema and hashes a canonical form of it
+// (servers don't promise any particular ordering of types, fields and so on).
+func graphQLSchemaFingerprint(metric *ConfigMetric) (string, error) {
+
+	_, statusCode, response, err := doGraphQLRequest(metric, introspectionQuery, nil, "IntrospectionQuery")
+	if err != nil {
+		return "", err
+	}
+	if statusCode != 200 || len(response.Errors) > 0 || response.Data == nil {
+		return "", fmt.Errorf("introspection failed (status code %d, %d errors)", statusCode, len(response.Errors))
+	}
+
+	canonical, err := json.Marshal(sortByName(response.Data))
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// sortByName sorts every array of named objects by name (json.Marshal takes care of
+// sorting object keys).
+func sortByName(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			v[key] = sortByName(child)
+		}
+		return v
+
+	case []interface{}:
+		for i, child := range v {
+			v[i] = sortByName(child)
+		}
+		sort.SliceStable(v, func(i, j int) bool {
+			return fmt.Sprint(nameOf(v[i])) < fmt.Sprint(nameOf(v[j]))
+		})
+		return v
+
+	default:
+		return v
+	}
+}
+
+func nameOf(value interface{}) interface{} {
+	if object, ok := value.(map[string]interface{}); ok {
+		return object["name"]
+	}
+	return nil
+}
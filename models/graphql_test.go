@@ -0,0 +1,176 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// graphQLTestServer answers introspection with schema (or fails it with a 500 if schema is
+// empty) and every other query with response.
+func graphQLTestServer(t *testing.T, response string, schema string) *ConfigMetric {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			OperationName string `json:"operationName"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		if request.OperationName != "IntrospectionQuery" {
+			fmt.Fprint(w, response)
+			return
+		}
+		if len(schema) < 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"errors":[{"message":"introspection is disabled"}]}`)
+			return
+		}
+		fmt.Fprintf(w, `{"data":%s}`, schema)
+	}))
+	t.Cleanup(server.Close)
+
+	return &ConfigMetric{
+		Type:    "graphql",
+		Name:    "graphql",
+		URL:     server.URL,
+		Timeout: Duration{5 * time.Second},
+		GraphQL: ConfigMetricGraphQL{
+			Query:   "{ stats { users orders } }",
+			Extract: map[string]string{"users": "stats.users"},
+		},
+	}
+}
+
+const graphQLTestSchema = `{"__schema":{"queryType":{"name":"Query"},"types":[
+	{"kind":"OBJECT","name":"Query","fields":[{"name":"stats","args":[]},{"name":"me","args":[]}]},
+	{"kind":"SCALAR","name":"Int","fields":null}
+]}}`
+
+func TestQueryGraphQLMetric(t *testing.T) {
+
+	for _, test := range []struct {
+		name     string
+		response string
+		valid    bool
+		errors   []string
+		values   map[string]float64
+	}{
+		{
+			name:     "ok",
+			response: `{"data":{"stats":{"users":42,"orders":7}}}`,
+			valid:    true,
+			values:   map[string]float64{"users": 42},
+		},
+		{
+			name:     "errors with data",
+			response: `{"data":{"stats":{"users":42,"orders":null}},"errors":[{"message":"orders resolver timed out"}]}`,
+			errors:   []string{"orders resolver timed out"},
+			values:   map[string]float64{"users": 42},
+		},
+		{
+			name:     "no data",
+			response: `{"data":null,"errors":[{"message":"not authorized"}]}`,
+			errors:   []string{"not authorized"},
+			values:   map[string]float64{},
+		},
+		{
+			name:     "missing field",
+			response: `{"data":{"stats":{"orders":7}}}`,
+			errors:   []string{"could not extract users from data.stats.users"},
+			values:   map[string]float64{},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+
+			result, err := QueryGraphQLMetric(graphQLTestServer(t, test.response, ""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Valid != test.valid || !reflect.DeepEqual(result.Errors, test.errors) ||
+				!reflect.DeepEqual(result.Values, test.values) {
+				t.Errorf("unexpected valid %v, errors %q and values %v", result.Valid, result.Errors, result.Values)
+			}
+		})
+	}
+}
+
+func TestQueryGraphQLMetricSchema(t *testing.T) {
+
+	// A failed introspection is noted without losing the query's result...
+	metric := graphQLTestServer(t, `{"data":{"stats":{"users":42}}}`, "")
+	metric.GraphQL.CheckSchema = true
+	result, err := QueryGraphQLMetric(metric)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Valid || result.Values["users"] != 42 || len(result.SchemaFingerprint) > 0 {
+		t.Errorf("expected a valid result without a fingerprint, got %+v", result)
+	}
+	if !strings.HasPrefix(result.SchemaError, "error fingerprinting schema: introspection failed (status code 500") {
+		t.Errorf("unexpected schema error %q", result.SchemaError)
+	}
+
+	metric = graphQLTestServer(t, `{"data":{"stats":{"users":42}}}`, graphQLTestSchema)
+	metric.GraphQL.CheckSchema = true
+	result, err = QueryGraphQLMetric(metric)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Valid || len(result.SchemaFingerprint) != 64 || len(result.SchemaError) > 0 {
+		t.Errorf("expected a valid result with a fingerprint, got %+v", result)
+	}
+}
+
+func TestGraphQLSchemaFingerprint(t *testing.T) {
+
+	fingerprint := func(schema string) string {
+		metric := graphQLTestServer(t, "", schema)
+		fingerprint, err := graphQLSchemaFingerprint(metric)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fingerprint
+	}
+	expected := fingerprint(graphQLTestSchema)
+
+	// Types, fields and keys in another order are the same schema...
+	reordered := `{"__schema":{"types":[
+		{"name":"Int","kind":"SCALAR","fields":null},
+		{"fields":[{"args":[],"name":"me"},{"name":"stats","args":[]}],"name":"Query","kind":"OBJECT"}
+	],"queryType":{"name":"Query"}}}`
+	if actual := fingerprint(reordered); actual != expected {
+		t.Errorf("expected reordering to keep fingerprint %s, got %s", expected, actual)
+	}
+
+	// But a new field isn't...
+	added := strings.Replace(graphQLTestSchema, `{"name":"me","args":[]}`, `{"name":"me","args":[]},{"name":"orders","args":[]}`, 1)
+	if actual := fingerprint(added); actual == expected {
+		t.Errorf("expected a new field to change the fingerprint")
+	}
+
+	// Nor is a change of kind...
+	changed := strings.Replace(graphQLTestSchema, `"kind":"SCALAR"`, `"kind":"ENUM"`, 1)
+	if actual := fingerprint(changed); actual == expected {
+		t.Errorf("expected a change of kind to change the fingerprint")
+	}
+}
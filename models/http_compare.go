@@ -0,0 +1,267 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bodies kept for inspection are capped so a mismatch on a large page doesn't
+// balloon the runner's memory...
+const maxRetainedBodyLength = 64 * 1024
+
+type HTTPCompareResult struct {
+	Elapsed           time.Duration
+	CompareElapsed    time.Duration
+	StatusCode        int
+	CompareStatusCode int
+	Similarity        float64 // Only computed in similarity mode
+	Reasons           []string
+	Body              []byte
+	CompareBody       []byte
+}
+
+// Mismatch reports whether the two responses differed in any compared respect.
+func (r *HTTPCompareResult) Mismatch() bool {
+	return len(r.Reasons) > 0
+}
+
+// HTTPCompareMismatch is the last pair of responses that differed (kept for inspection).
+type HTTPCompareMismatch struct {
+	Time              time.Time `json:"time"`
+	URL               string    `json:"url"`
+	CompareURL        string    `json:"compareURL"`
+	StatusCode        int       `json:"statusCode"`
+	CompareStatusCode int       `json:"compareStatusCode"`
+	Reasons           []string  `json:"reasons"`
+	Body              string    `json:"body"`
+	CompareBody       string    `json:"compareBody"`
+}
+
+// NewHTTPCompareMismatch captures the differing responses of result.
+func NewHTTPCompareMismatch(metric *ConfigMetric, result *HTTPCompareResult) *HTTPCompareMismatch {
+	return &HTTPCompareMismatch{
+		Time:              time.Now().UTC(),
+		URL:               metric.URL,
+		CompareURL:        metric.Compare.URL,
+		StatusCode:        result.StatusCode,
+		CompareStatusCode: result.CompareStatusCode,
+		Reasons:           result.Reasons,
+		Body:              truncateBody(result.Body),
+		CompareBody:       truncateBody(result.CompareBody),
+	}
+}
+
+// QueryHTTPCompareMetric sends the same request to the metric's url and its compare url
+// and reports how the two responses differ.
+func QueryHTTPCompareMetric(metric *ConfigMetric) (*HTTPCompareResult, error) {
+
+	// We can only query metrics of http-compare type...
+	if metric.Type != "http-compare" {
+		return nil, fmt.Errorf("cannot query metric type %s via http-compare", metric.Type)
+	}
+
+	// Send both requests at the same time so they see the same state of the world...
+	type response struct {
+		elapsed time.Duration
+		res     *http.Response
+		body    []byte
+		err     error
+	}
+	primary := make(chan response, 1)
+	compare := make(chan response, 1)
+	go func() {
+		elapsed, res, body, err := doHTTPRequest(metric, metric.URL)
+		primary <- response{elapsed, res, body, err}
+	}()
+	go func() {
+		elapsed, res, body, err := doHTTPRequest(metric, metric.Compare.URL)
+		compare <- response{elapsed, res, body, err}
+	}()
+	a, b := <-primary, <-compare
+
+	if a.err != nil {
+		return nil, fmt.Errorf("error querying %s: %s", metric.URL, a.err)
+	}
+	if b.err != nil {
+		return nil, fmt.Errorf("error querying %s: %s", metric.Compare.URL, b.err)
+	}
+
+	result := &HTTPCompareResult{
+		Elapsed:           a.elapsed,
+		CompareElapsed:    b.elapsed,
+		StatusCode:        a.res.StatusCode,
+		CompareStatusCode: b.res.StatusCode,
+		Body:              a.body,
+		CompareBody:       b.body,
+	}
+
+	// Compare status codes and selected headers...
+	if a.res.StatusCode != b.res.StatusCode {
+		result.Reasons = append(result.Reasons, fmt.Sprintf("status code %d != %d", a.res.StatusCode, b.res.StatusCode))
+	}
+	for _, header := range metric.Compare.Headers {
+		valueA := strings.Join(a.res.Header[http.CanonicalHeaderKey(header)], ", ")
+		valueB := strings.Join(b.res.Header[http.CanonicalHeaderKey(header)], ", ")
+		if valueA != valueB {
+			result.Reasons = append(result.Reasons, fmt.Sprintf("header %s %q != %q", header, valueA, valueB))
+		}
+	}
+
+	// Compare bodies...
+	switch metric.Compare.BodyMode {
+	case "none":
+
+	case "exact":
+		if !bytes.Equal(a.body, b.body) {
+			result.Reasons = append(result.Reasons, "bodies differ")
+		}
+
+	case "json":
+		// A body that isn't json (e.g. an html error page) is a mismatch, not a failed probe...
+		normalizedA, errA := normalizeJSON(a.body, metric.Compare.IgnorePaths)
+		if errA != nil {
+			result.Reasons = append(result.Reasons, fmt.Sprintf("body from %s is not json: %s", metric.URL, errA))
+		}
+		normalizedB, errB := normalizeJSON(b.body, metric.Compare.IgnorePaths)
+		if errB != nil {
+			result.Reasons = append(result.Reasons, fmt.Sprintf("body from %s is not json: %s", metric.Compare.URL, errB))
+		}
+		if errA == nil && errB == nil && !bytes.Equal(normalizedA, normalizedB) {
+			result.Reasons = append(result.Reasons, "json bodies differ")
+		}
+
+	case "similarity":
+		result.Similarity = similarity(string(a.body), string(b.body))
+		if result.Similarity < metric.Compare.MinSimilarity {
+			result.Reasons = append(result.Reasons, fmt.Sprintf("bodies are %.1f%% similar (need %.1f%%)",
+				result.Similarity*100, metric.Compare.MinSimilarity*100))
+		}
+
+	default:
+		return nil, fmt.Errorf("body mode %s is currently not supported", metric.Compare.BodyMode)
+	}
+
+	return result, nil
+}
+
+// normalizeJSON parses body, removes the ignored paths and re-encodes it (which sorts
+// object keys) so that semantically equal documents compare equal byte for byte.
+func normalizeJSON(body []byte, ignorePaths []string) ([]byte, error) {
+
+	var document interface{}
+	err := json.Unmarshal(body, &document)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range ignorePaths {
+		document = removeJSONPath(document, strings.Split(path, "."))
+	}
+
+	return json.Marshal(document)
+}
+
+// removeJSONPath deletes the value at path from document. A "*" segment matches
+// every key of an object or every element of an array.
+func removeJSONPath(document interface{}, path []string) interface{} {
+
+	if len(path) < 1 {
+		return document
+	}
+	segment, rest := path[0], path[1:]
+
+	switch value := document.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			if segment != "*" && segment != key {
+				continue
+			}
+			if len(rest) < 1 {
+				delete(value, key)
+			} else {
+				value[key] = removeJSONPath(child, rest)
+			}
+		}
+		return value
+
+	case []interface{}:
+		if segment == "*" {
+			if len(rest) < 1 {
+				return []interface{}{}
+			}
+			for i, child := range value {
+				value[i] = removeJSONPath(child, rest)
+			}
+			return value
+		}
+		index, err := strconv.Atoi(segment)
+		if err != nil || index < 0 || index >= len(value) {
+			return value
+		}
+		if len(rest) < 1 {
+			return append(value[:index], value[index+1:]...)
+		}
+		value[index] = removeJSONPath(value[index], rest)
+		return value
+
+	default:
+		return document
+	}
+}
+
+// similarity returns a ratio between 0 and 1 of how many lines a and b have in
+// common (2 * longest common subsequence / total lines, like python's difflib).
+func similarity(a, b string) float64 {
+
+	linesA := strings.Split(a, "\n")
+	linesB := strings.Split(b, "\n")
+	if a == b {
+		return 1
+	}
+
+	// Longest common subsequence using two rows of the usual table...
+	previous := make([]int, len(linesB)+1)
+	current := make([]int, len(linesB)+1)
+	for i := 1; i <= len(linesA); i++ {
+		for j := 1; j <= len(linesB); j++ {
+			if linesA[i-1] == linesB[j-1] {
+				current[j] = previous[j-1] + 1
+			} else if previous[j] >= current[j-1] {
+				current[j] = previous[j]
+			} else {
+				current[j] = current[j-1]
+			}
+		}
+		previous, current = current, previous
+	}
+
+	return 2 * float64(previous[len(linesB)]) / float64(len(linesA)+len(linesB))
+}
+
+func truncateBody(body []byte) string {
+	if len(body) > maxRetainedBodyLength {
+		return string(body[:maxRetainedBodyLength])
+	}
+	return string(body)
+}
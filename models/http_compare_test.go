@@ -0,0 +1,180 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type httpCompareTestResponse struct {
+	status  int
+	headers map[string]string
+	body    string
+}
+
+func httpCompareTestServer(t *testing.T, response httpCompareTestResponse) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for key, value := range response.headers {
+			w.Header().Set(key, value)
+		}
+		status := response.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, response.body)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestQueryHTTPCompareMetric(t *testing.T) {
+
+	page := "<html>\n<head>\n<title>Home</title>\n</head>\n<body>\n<p>Hello</p>\n</body>\n</html>"
+
+	for _, test := range []struct {
+		name    string
+		compare ConfigMetricCompare
+		a, b    httpCompareTestResponse
+		reasons []string // Placeholders {a} and {b} are the two urls
+	}{
+		{
+			name:    "exact match",
+			compare: ConfigMetricCompare{BodyMode: "exact"},
+			a:       httpCompareTestResponse{body: "same"},
+			b:       httpCompareTestResponse{body: "same"},
+		},
+		{
+			name:    "exact differs",
+			compare: ConfigMetricCompare{BodyMode: "exact"},
+			a:       httpCompareTestResponse{body: "one"},
+			b:       httpCompareTestResponse{body: "two"},
+			reasons: []string{"bodies differ"},
+		},
+		{
+			name:    "status differs",
+			compare: ConfigMetricCompare{BodyMode: "none"},
+			a:       httpCompareTestResponse{body: "one"},
+			b:       httpCompareTestResponse{status: 503, body: "two"},
+			reasons: []string{"status code 200 != 503"},
+		},
+		{
+			name:    "headers",
+			compare: ConfigMetricCompare{BodyMode: "none", Headers: []string{"x-version", "Content-Type"}},
+			a:       httpCompareTestResponse{headers: map[string]string{"X-Version": "1.2", "Content-Type": "text/plain", "Date-Ish": "a"}},
+			b:       httpCompareTestResponse{headers: map[string]string{"X-Version": "1.3", "Content-Type": "text/plain", "Date-Ish": "b"}},
+			reasons: []string{`header x-version "1.2" != "1.3"`},
+		},
+		{
+			name:    "json key order",
+			compare: ConfigMetricCompare{BodyMode: "json"},
+			a:       httpCompareTestResponse{body: `{"a": 1, "b": [1, 2]}`},
+			b:       httpCompareTestResponse{body: `{"b":[1,2],"a":1.0}`},
+		},
+		{
+			name:    "json differs",
+			compare: ConfigMetricCompare{BodyMode: "json"},
+			a:       httpCompareTestResponse{body: `{"a": 1}`},
+			b:       httpCompareTestResponse{body: `{"a": 2}`},
+			reasons: []string{"json bodies differ"},
+		},
+		{
+			name:    "json ignore paths",
+			compare: ConfigMetricCompare{BodyMode: "json", IgnorePaths: []string{"meta.requestId", "items.*.id", "tags.0"}},
+			a:       httpCompareTestResponse{body: `{"meta":{"requestId":"x1","page":1},"items":[{"id":1,"n":"a"},{"id":2,"n":"b"}],"tags":["x","y"]}`},
+			b:       httpCompareTestResponse{body: `{"meta":{"requestId":"y2","page":1},"items":[{"id":7,"n":"a"},{"id":8,"n":"b"}],"tags":["z","y"]}`},
+		},
+		{
+			name:    "json ignore paths leave the rest",
+			compare: ConfigMetricCompare{BodyMode: "json", IgnorePaths: []string{"items.*.id"}},
+			a:       httpCompareTestResponse{body: `{"items":[{"id":1,"n":"a"}]}`},
+			b:       httpCompareTestResponse{body: `{"items":[{"id":7,"n":"b"}]}`},
+			reasons: []string{"json bodies differ"},
+		},
+		{
+			name:    "json error page",
+			compare: ConfigMetricCompare{BodyMode: "json"},
+			a:       httpCompareTestResponse{body: `{"a": 1}`},
+			b:       httpCompareTestResponse{status: 502, body: "<html>Bad Gateway</html>"},
+			reasons: []string{"status code 200 != 502", "body from {b} is not json: invalid character '<' looking for beginning of value"},
+		},
+		{
+			name:    "similar enough",
+			compare: ConfigMetricCompare{BodyMode: "similarity", MinSimilarity: 0.8},
+			a:       httpCompareTestResponse{body: page},
+			b:       httpCompareTestResponse{body: strings.Replace(page, "Hello", "Hello there", 1)},
+		},
+		{
+			name:    "not similar enough",
+			compare: ConfigMetricCompare{BodyMode: "similarity", MinSimilarity: 0.95},
+			a:       httpCompareTestResponse{body: page},
+			b:       httpCompareTestResponse{body: strings.Replace(page, "Hello", "Hello there", 1)},
+			reasons: []string{"bodies are 87.5% similar (need 95.0%)"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+
+			metric := &ConfigMetric{
+				Type:    "http-compare",
+				Name:    "compare",
+				Method:  "GET",
+				URL:     httpCompareTestServer(t, test.a),
+				Timeout: Duration{5 * time.Second},
+				Compare: test.compare,
+			}
+			metric.Compare.URL = httpCompareTestServer(t, test.b)
+
+			result, err := QueryHTTPCompareMetric(metric)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var expected []string
+			for _, reason := range test.reasons {
+				expected = append(expected, strings.NewReplacer("{a}", metric.URL, "{b}", metric.Compare.URL).Replace(reason))
+			}
+			if !reflect.DeepEqual(result.Reasons, expected) {
+				t.Errorf("expected reasons %q, got %q", expected, result.Reasons)
+			}
+			if result.Mismatch() != (len(expected) > 0) {
+				t.Errorf("unexpected mismatch %v", result.Mismatch())
+			}
+		})
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	for _, test := range []struct {
+		a, b     string
+		expected float64
+	}{
+		{"a\nb\nc", "a\nb\nc", 1},
+		{"a\nb\nc\nd", "a\nx\nc\nd", 0.75},
+		{"a\nb", "c\nd", 0},
+		{"a\nb\nc", "c\nb\na", 1.0 / 3},
+	} {
+		if actual := similarity(test.a, test.b); actual != test.expected {
+			t.Errorf("similarity(%q, %q) = %v, expected %v", test.a, test.b, actual, test.expected)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// imapClient is a minimal imap client, just enough to log in, search a mailbox and delete
+// messages from it. Commands are sent one at a time.
+type imapClient struct {
+	conn         net.Conn
+	r            *bufio.Reader
+	tag          int
+	capabilities map[string]bool
+}
+
+func dialIMAP(server ConfigMetricMailServer, deadline time.Time) (*imapClient, error) {
+
+	address := net.JoinHostPort(server.Host, strconv.Itoa(server.Port))
+	dialer := &net.Dialer{Deadline: deadline}
+	tlsConfig := &tls.Config{ServerName: server.Host}
+
+	var conn net.Conn
+	var err error
+	if server.TLS == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(deadline)
+
+	c := &imapClient{conn: conn, r: bufio.NewReader(conn)}
+
+	greeting, err := c.readLine()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(greeting, "* OK") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected greeting: %s", greeting)
+	}
+
+	if server.TLS == "starttls" {
+		_, err = c.command("STARTTLS")
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		c.conn = tls.Client(conn, tlsConfig)
+		c.r = bufio.NewReader(c.conn)
+	}
+
+	_, err = c.command("LOGIN %s %s", imapQuote(server.Username), imapQuote(server.Password))
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+
+	// Capabilities can change once we're logged in, so ask now...
+	untagged, err := c.command("CAPABILITY")
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	c.capabilities = map[string]bool{}
+	for _, line := range untagged {
+		if strings.HasPrefix(line, "* CAPABILITY ") {
+			for _, capability := range strings.Fields(strings.TrimPrefix(line, "* CAPABILITY ")) {
+				c.capabilities[strings.ToUpper(capability)] = true
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// SetDeadline moves the deadline for the rest of the session.
+func (c *imapClient) SetDeadline(deadline time.Time) error {
+	return c.conn.SetDeadline(deadline)
+}
+
+// readLine reads a response line (with any literals it carries folded in).
+func (c *imapClient) readLine() (string, error) {
+
+	var line string
+	for {
+		part, err := c.r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		part = strings.TrimRight(part, "\r\n")
+		line += part
+
+		// A line ending {n} is followed by n bytes of literal...
+		if !strings.HasSuffix(part, "}") {
+			return line, nil
+		}
+		start := strings.LastIndex(part, "{")
+		if start < 0 {
+			return line, nil
+		}
+		size, err := strconv.Atoi(part[start+1 : len(part)-1])
+		if err != nil {
+			return line, nil
+		}
+		literal := make([]byte, size)
+		_, err = io.ReadFull(c.r, literal)
+		if err != nil {
+			return "", err
+		}
+		line += string(literal)
+	}
+}
+
+// command sends a command and returns its untagged responses, failing unless it completes OK.
+func (c *imapClient) command(format string, args ...interface{}) ([]string, error) {
+
+	c.tag++
+	tag := fmt.Sprintf("a%d", c.tag)
+	command := fmt.Sprintf(format, args...)
+
+	_, err := fmt.Fprintf(c.conn, "%s %s\r\n", tag, command)
+	if err != nil {
+		return nil, err
+	}
+
+	var untagged []string
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(line, tag+" ") {
+			status := strings.TrimPrefix(line, tag+" ")
+			if !strings.HasPrefix(status, "OK") {
+				return nil, fmt.Errorf("%s: %s", strings.Fields(command)[0], status)
+			}
+			return untagged, nil
+		}
+		untagged = append(untagged, line)
+	}
+}
+
+func (c *imapClient) Select(mailbox string) error {
+	_, err := c.command("SELECT %s", imapQuote(mailbox))
+	return err
+}
+
+// SearchSubject returns the uids of messages whose subject contains subject.
+func (c *imapClient) SearchSubject(subject string) ([]string, error) {
+	untagged, err := c.command("UID SEARCH SUBJECT %s", imapQuote(subject))
+	if err != nil {
+		return nil, err
+	}
+	var uids []string
+	for _, line := range untagged {
+		if strings.HasPrefix(line, "* SEARCH") {
+			uids = append(uids, strings.Fields(strings.TrimPrefix(line, "* SEARCH"))...)
+		}
+	}
+	return uids, nil
+}
+
+// Delete flags messages as deleted and, where the server supports UIDPLUS, expunges just
+// those messages. A plain EXPUNGE would take anything else flagged as deleted in the
+// mailbox along with them, so without UIDPLUS they're only flagged (and go whenever the
+// mailbox is next expunged).
+func (c *imapClient) Delete(uids []string) error {
+	if len(uids) < 1 {
+		return nil
+	}
+	set := strings.Join(uids, ",")
+	_, err := c.command("UID STORE %s +FLAGS.SILENT (\\Deleted)", set)
+	if err != nil {
+		return err
+	}
+	if !c.capabilities["UIDPLUS"] {
+		return nil
+	}
+	_, err = c.command("UID EXPUNGE %s", set)
+	return err
+}
+
+func (c *imapClient) Close() error {
+	c.command("LOGOUT")
+	return c.conn.Close()
+}
+
+func imapQuote(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
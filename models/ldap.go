@@ -0,0 +1,463 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	ldapBindRequest           = 0x60
+	ldapBindResponse          = 0x61
+	ldapUnbindRequest         = 0x42
+	ldapSearchRequest         = 0x63
+	ldapSearchResultEntry     = 0x64
+	ldapSearchResultDone      = 0x65
+	ldapSearchResultReference = 0x73
+	ldapExtendedRequest       = 0x77
+	ldapExtendedResponse      = 0x78
+
+	ldapSimpleAuthentication = 0x80
+	ldapExtendedRequestName  = 0x80
+	ldapStartTLSOID          = "1.3.6.1.4.1.1466.20037"
+
+	ldapMaxMessageLength = 16 * 1024 * 1024
+)
+
+var ldapScopes = map[string]int64{
+	"base": 0,
+	"one":  1,
+	"sub":  2,
+}
+
+type LDAPResult struct {
+	ConnectElapsed time.Duration
+	BindElapsed    time.Duration
+	SearchElapsed  time.Duration
+	Results        int
+	Valid          bool
+}
+
+// QueryLDAPMetric connects to the metric's directory (ldap://, ldaps:// or ldap:// with
+// StartTLS), binds and runs its search, checking how many entries came back.
+func QueryLDAPMetric(metric *ConfigMetric) (*LDAPResult, error) {
+
+	// We can only query metrics of ldap type...
+	if metric.Type != "ldap" {
+		return nil, fmt.Errorf("cannot query metric type %s via ldap", metric.Type)
+	}
+
+	scope, ok := ldapScopes[metric.LDAP.Scope]
+	if !ok {
+		return nil, fmt.Errorf("ldap scope %s is currently not supported", metric.LDAP.Scope)
+	}
+	filter, err := ldapFilter(metric.LDAP.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &LDAPResult{}
+
+	// Connect...
+	start := time.Now()
+	conn, err := ldapConnect(metric)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting: %s", err)
+	}
+	defer conn.Close()
+	result.ConnectElapsed = time.Since(start)
+
+	c := &ldapConn{conn: conn}
+
+	// Bind...
+	start = time.Now()
+	err = c.bind(metric.LDAP.BindDN, metric.LDAP.BindPassword)
+	if err != nil {
+		return nil, fmt.Errorf("error binding as %s: %s", metric.LDAP.BindDN, err)
+	}
+	result.BindElapsed = time.Since(start)
+
+	// Search...
+	start = time.Now()
+	result.Results, err = c.search(metric.LDAP.BaseDN, scope, filter)
+	if err != nil {
+		return nil, fmt.Errorf("error searching %s: %s", metric.LDAP.BaseDN, err)
+	}
+	result.SearchElapsed = time.Since(start)
+
+	c.unbind()
+
+	result.Valid = result.Results >= metric.LDAP.MinResults &&
+		(metric.LDAP.MaxResults == 0 || result.Results <= metric.LDAP.MaxResults)
+
+	return result, nil
+}
+
+func ldapConnect(metric *ConfigMetric) (net.Conn, error) {
+
+	u, err := url.Parse(metric.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	host := u.Hostname()
+	port := u.Port()
+	switch u.Scheme {
+	case "ldap":
+		if len(port) < 1 {
+			port = "389"
+		}
+	case "ldaps":
+		if len(port) < 1 {
+			port = "636"
+		}
+	default:
+		return nil, fmt.Errorf("cannot connect to %s (only ldap and ldaps urls are supported)", metric.URL)
+	}
+
+	dialer := &net.Dialer{Timeout: metric.Timeout.Duration}
+	tlsConfig := &tls.Config{ServerName: host}
+
+	if u.Scheme == "ldaps" {
+		conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, port), tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetDeadline(time.Now().Add(metric.Timeout.Duration))
+		return conn, nil
+	}
+
+	conn, err := dialer.Dial("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(metric.Timeout.Duration))
+
+	if !metric.LDAP.StartTLS {
+		return conn, nil
+	}
+
+	// Ask to upgrade the connection, then do the tls handshake over it...
+	c := &ldapConn{conn: conn}
+	err = c.startTLS()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error starting tls: %s", err)
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	err = tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error starting tls: %s", err)
+	}
+
+	return tlsConn, nil
+}
+
+// ldapConn sends requests over an established connection, one at a time.
+type ldapConn struct {
+	conn      net.Conn
+	messageID int64
+}
+
+func (c *ldapConn) send(protocolOp []byte) (int64, error) {
+	c.messageID++
+	_, err := c.conn.Write(berSequence(berInteger(berTagInteger, c.messageID), protocolOp))
+	return c.messageID, err
+}
+
+// receive reads the next message for messageID and returns its protocol op.
+func (c *ldapConn) receive(messageID int64) (berElement, error) {
+
+	for {
+		// Read the tag and length first, then the rest of the message...
+		header := make([]byte, 2)
+		_, err := io.ReadFull(c.conn, header)
+		if err != nil {
+			return berElement{}, err
+		}
+		length := int(header[1])
+		if length&0x80 != 0 {
+			extra := make([]byte, length&0x7f)
+			if len(extra) < 1 || len(extra) > 4 {
+				return berElement{}, fmt.Errorf("malformed message")
+			}
+			_, err = io.ReadFull(c.conn, extra)
+			if err != nil {
+				return berElement{}, err
+			}
+			length = 0
+			for _, b := range extra {
+				length = length<<8 | int(b)
+			}
+		}
+		if header[0] != berTagSequence || length > ldapMaxMessageLength {
+			return berElement{}, fmt.Errorf("malformed message")
+		}
+		content := make([]byte, length)
+		_, err = io.ReadFull(c.conn, content)
+		if err != nil {
+			return berElement{}, err
+		}
+
+		fields, err := berChildren(content)
+		if err != nil || len(fields) < 2 {
+			return berElement{}, fmt.Errorf("malformed message")
+		}
+		if fields[0].Int() == messageID {
+			return fields[1], nil
+		}
+	}
+}
+
+// ldapCheckResult returns an error unless an LDAPResult carries a success result code.
+func ldapCheckResult(op berElement) error {
+	fields, err := berChildren(op.Content)
+	if err != nil || len(fields) < 3 {
+		return fmt.Errorf("malformed result")
+	}
+	if code := fields[0].Int(); code != 0 {
+		if len(fields[2].Content) > 0 {
+			return fmt.Errorf("result code %d (%s)", code, fields[2].Content)
+		}
+		return fmt.Errorf("result code %d", code)
+	}
+	return nil
+}
+
+func (c *ldapConn) startTLS() error {
+
+	messageID, err := c.send(berConstruct(ldapExtendedRequest,
+		berOctetString(ldapExtendedRequestName, []byte(ldapStartTLSOID))))
+	if err != nil {
+		return err
+	}
+
+	op, err := c.receive(messageID)
+	if err != nil {
+		return err
+	}
+	if op.Tag != ldapExtendedResponse {
+		return fmt.Errorf("unexpected response (tag 0x%02x)", op.Tag)
+	}
+
+	return ldapCheckResult(op)
+}
+
+func (c *ldapConn) bind(dn string, password string) error {
+
+	messageID, err := c.send(berConstruct(ldapBindRequest,
+		berInteger(berTagInteger, 3),
+		berOctetString(berTagOctetString, []byte(dn)),
+		berOctetString(ldapSimpleAuthentication, []byte(password))))
+	if err != nil {
+		return err
+	}
+
+	op, err := c.receive(messageID)
+	if err != nil {
+		return err
+	}
+	if op.Tag != ldapBindResponse {
+		return fmt.Errorf("unexpected response (tag 0x%02x)", op.Tag)
+	}
+
+	return ldapCheckResult(op)
+}
+
+// search runs a search (asking for no attributes, we only count entries) and returns
+// the number of entries found.
+func (c *ldapConn) search(baseDN string, scope int64, filter []byte) (int, error) {
+
+	messageID, err := c.send(berConstruct(ldapSearchRequest,
+		berOctetString(berTagOctetString, []byte(baseDN)),
+		berInteger(berTagEnumerated, scope),
+		berInteger(berTagEnumerated, 0), // Never dereference aliases
+		berInteger(berTagInteger, 0),    // No size limit
+		berInteger(berTagInteger, 0),    // No time limit
+		berBoolean(true),                // Types only
+		filter,
+		berSequence(berOctetString(berTagOctetString, []byte("1.1")))))
+	if err != nil {
+		return 0, err
+	}
+
+	entries := 0
+	for {
+		op, err := c.receive(messageID)
+		if err != nil {
+			return 0, err
+		}
+
+		switch op.Tag {
+		case ldapSearchResultEntry:
+			entries++
+		case ldapSearchResultReference:
+		case ldapSearchResultDone:
+			return entries, ldapCheckResult(op)
+		default:
+			return 0, fmt.Errorf("unexpected response (tag 0x%02x)", op.Tag)
+		}
+	}
+}
+
+func (c *ldapConn) unbind() {
+	c.send([]byte{ldapUnbindRequest, 0})
+}
+
+// ldapFilter encodes a string filter (RFC 4515, e.g. "(&(objectClass=person)(uid=bob))").
+// Extensible matches aren't supported.
+func ldapFilter(filter string) ([]byte, error) {
+
+	filter = strings.TrimSpace(filter)
+	if !strings.HasPrefix(filter, "(") {
+		filter = "(" + filter + ")"
+	}
+
+	encoded, rest, err := parseLDAPFilter(filter)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %s: %s", filter, err)
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("invalid filter %s: unexpected %s", filter, rest)
+	}
+
+	return encoded, nil
+}
+
+func parseLDAPFilter(filter string) ([]byte, string, error) {
+
+	if len(filter) < 3 || filter[0] != '(' {
+		return nil, "", fmt.Errorf("expected (")
+	}
+	filter = filter[1:]
+
+	// And, or and not wrap other filters...
+	switch filter[0] {
+	case '&', '|', '!':
+		tags := map[byte]byte{'&': 0xa0, '|': 0xa1, '!': 0xa2}
+		operator := filter[0]
+		tag := tags[operator]
+		filter = filter[1:]
+		var children [][]byte
+		for len(filter) > 0 && filter[0] == '(' {
+			child, rest, err := parseLDAPFilter(filter)
+			if err != nil {
+				return nil, "", err
+			}
+			children = append(children, child)
+			filter = rest
+		}
+		if len(filter) < 1 || filter[0] != ')' || len(children) < 1 || (tag == 0xa2 && len(children) != 1) {
+			return nil, "", fmt.Errorf("malformed %c filter", operator)
+		}
+		return berConstruct(tag, children...), filter[1:], nil
+	}
+
+	// Otherwise it's an attribute, an operator and a value...
+	end := strings.IndexByte(filter, ')')
+	if end < 0 {
+		return nil, "", fmt.Errorf("expected )")
+	}
+	item, rest := filter[:end], filter[end+1:]
+
+	equals := strings.IndexByte(item, '=')
+	if equals < 1 {
+		return nil, "", fmt.Errorf("expected = in %s", item)
+	}
+	attribute, value := item[:equals], item[equals+1:]
+
+	var tag byte = 0xa3 // Equality
+	switch attribute[len(attribute)-1] {
+	case '>':
+		tag = 0xa5
+	case '<':
+		tag = 0xa6
+	case '~':
+		tag = 0xa8
+	case ':':
+		return nil, "", fmt.Errorf("extensible matches are currently not supported")
+	}
+	if tag != 0xa3 {
+		attribute = attribute[:len(attribute)-1]
+	}
+
+	// Presence and substrings are special cases of equality...
+	if tag == 0xa3 && value == "*" {
+		return berOctetString(0x87, []byte(attribute)), rest, nil
+	}
+	if tag == 0xa3 && strings.Contains(value, "*") {
+		parts := strings.Split(value, "*")
+		var substrings [][]byte
+		for i, part := range parts {
+			if len(part) < 1 {
+				continue
+			}
+			unescaped, err := ldapUnescape(part)
+			if err != nil {
+				return nil, "", err
+			}
+			switch i {
+			case 0:
+				substrings = append(substrings, berOctetString(0x80, unescaped)) // Initial
+			case len(parts) - 1:
+				substrings = append(substrings, berOctetString(0x82, unescaped)) // Final
+			default:
+				substrings = append(substrings, berOctetString(0x81, unescaped)) // Any
+			}
+		}
+		return berConstruct(0xa4,
+			berOctetString(berTagOctetString, []byte(attribute)),
+			berSequence(substrings...)), rest, nil
+	}
+
+	unescaped, err := ldapUnescape(value)
+	if err != nil {
+		return nil, "", err
+	}
+	return berConstruct(tag,
+		berOctetString(berTagOctetString, []byte(attribute)),
+		berOctetString(berTagOctetString, unescaped)), rest, nil
+}
+
+// ldapUnescape decodes the \XX hex escapes in a filter value.
+func ldapUnescape(value string) ([]byte, error) {
+	var unescaped []byte
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			unescaped = append(unescaped, value[i])
+			continue
+		}
+		if i+2 >= len(value) {
+			return nil, fmt.Errorf("truncated escape in %s", value)
+		}
+		b, err := hex.DecodeString(value[i+1 : i+3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid escape in %s", value)
+		}
+		unescaped = append(unescaped, b...)
+		i += 2
+	}
+	return unescaped, nil
+}
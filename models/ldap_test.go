@@ -0,0 +1,73 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLDAPFilter(t *testing.T) {
+
+	valid := []struct {
+		filter  string
+		encoded []byte
+	}{
+		{"uid=bob", []byte{0xa3, 0x0a, 0x04, 0x03, 'u', 'i', 'd', 0x04, 0x03, 'b', 'o', 'b'}},
+		{"(objectClass=*)", append([]byte{0x87, 0x0b}, "objectClass"...)},
+		{"(!(a=b))", []byte{0xa2, 0x08, 0xa3, 0x06, 0x04, 0x01, 'a', 0x04, 0x01, 'b'}},
+		{"(&(a=b)(c>=d))", []byte{0xa0, 0x10,
+			0xa3, 0x06, 0x04, 0x01, 'a', 0x04, 0x01, 'b',
+			0xa5, 0x06, 0x04, 0x01, 'c', 0x04, 0x01, 'd'}},
+	}
+	for _, test := range valid {
+		encoded, err := ldapFilter(test.filter)
+		if err != nil {
+			t.Errorf("ldapFilter(%q) failed: %s", test.filter, err)
+			continue
+		}
+		if !bytes.Equal(encoded, test.encoded) {
+			t.Errorf("ldapFilter(%q) = % x, expected % x", test.filter, encoded, test.encoded)
+		}
+	}
+
+	malformed := []string{
+		"",
+		"(",
+		"()",
+		"(&",
+		"(&)",
+		"(&(a=b)",
+		"(|(a=b)(c=d)",
+		"(!(a=b)(c=d))",
+		"(!(a=b)",
+		"(&(a=b)x)",
+		"(a=b",
+		"(a)",
+		"(=b)",
+		"(a=\\4)",
+		"(a=\\zz)",
+		"(a:=b)",
+		"(a=b))",
+		"(&(a=b)(&(c=d))",
+	}
+	for _, filter := range malformed {
+		if encoded, err := ldapFilter(filter); err == nil {
+			t.Errorf("ldapFilter(%q) = % x, expected an error", filter, encoded)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type MailResult struct {
+	SubmissionElapsed time.Duration // Connecting to the smtp server until it accepted the message
+	DeliveryElapsed   time.Duration // Connecting to the smtp server until the message showed up over imap
+	Delivered         bool
+	Valid             bool
+	Cleaned           bool  // Whether our messages were deleted afterwards
+	CleanupErr        error // Why they weren't (doesn't affect validity)
+}
+
+// QueryMailRoundtripMetric sends a uniquely tagged message over smtp and polls an imap mailbox
+// until it shows up (or the metric times out), deleting it (and any stragglers from earlier
+// runs) afterwards. Cleaning up has its own timeout, and failing to doesn't fail the run.
+func QueryMailRoundtripMetric(metric *ConfigMetric) (*MailResult, error) {
+
+	// We can only query metrics of mail-roundtrip type...
+	if metric.Type != "mail-roundtrip" {
+		return nil, fmt.Errorf("cannot query metric type %s via mail-roundtrip", metric.Type)
+	}
+
+	tag := make([]byte, 8)
+	_, err := rand.Read(tag)
+	if err != nil {
+		return nil, err
+	}
+	prefix := fmt.Sprintf("[metrics-runner %s]", metric.Name)
+	subject := fmt.Sprintf("%s %s", prefix, hex.EncodeToString(tag))
+
+	result := &MailResult{}
+	deadline := time.Now().Add(metric.Timeout.Duration)
+
+	// Log in to imap first so a broken mailbox doesn't leave us sending mail we can't clean up...
+	imap, err := dialIMAP(metric.Mail.IMAP, deadline)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to imap server: %s", err)
+	}
+	defer imap.Close()
+	err = imap.Select(metric.Mail.Mailbox)
+	if err != nil {
+		return nil, fmt.Errorf("error selecting mailbox %s: %s", metric.Mail.Mailbox, err)
+	}
+
+	// Send...
+	start := time.Now()
+	err = sendMail(metric, subject, deadline)
+	if err != nil {
+		return nil, fmt.Errorf("error sending: %s", err)
+	}
+	result.SubmissionElapsed = time.Since(start)
+
+	// Poll until it arrives (or we run out of time)...
+	for {
+		uids, err := imap.SearchSubject(subject)
+		if err != nil {
+			return nil, fmt.Errorf("error searching mailbox %s: %s", metric.Mail.Mailbox, err)
+		}
+		if len(uids) > 0 {
+			result.DeliveryElapsed = time.Since(start)
+			result.Delivered = true
+			break
+		}
+		if time.Now().Add(metric.Mail.PollInterval.Duration).After(deadline) {
+			break
+		}
+		time.Sleep(metric.Mail.PollInterval.Duration)
+	}
+
+	result.Valid = result.Delivered
+
+	// Clean up ours (and anything from earlier runs that turned up late)...
+	imap.SetDeadline(time.Now().Add(metric.Mail.CleanupTimeout.Duration))
+	uids, err := imap.SearchSubject(prefix)
+	if err == nil {
+		err = imap.Delete(uids)
+	}
+	if err != nil {
+		result.CleanupErr = fmt.Errorf("error cleaning up mailbox %s: %s", metric.Mail.Mailbox, err)
+		return result, nil
+	}
+
+	result.Cleaned = true
+	return result, nil
+}
+
+func sendMail(metric *ConfigMetric, subject string, deadline time.Time) error {
+
+	server := metric.Mail.SMTP
+	address := net.JoinHostPort(server.Host, strconv.Itoa(server.Port))
+	dialer := &net.Dialer{Deadline: deadline}
+	tlsConfig := &tls.Config{ServerName: server.Host}
+
+	var conn net.Conn
+	var err error
+	if server.TLS == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(deadline)
+
+	c, err := smtp.NewClient(conn, server.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if server.TLS == "starttls" {
+		err = c.StartTLS(tlsConfig)
+		if err != nil {
+			return err
+		}
+	}
+	if len(server.Username) > 0 {
+		err = c.Auth(smtp.PlainAuth("", server.Username, server.Password, server.Host))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.Mail(metric.Mail.From)
+	if err != nil {
+		return err
+	}
+	err = c.Rcpt(metric.Mail.To)
+	if err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	message := strings.Join([]string{
+		"From: " + metric.Mail.From,
+		"To: " + metric.Mail.To,
+		"Subject: " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		"Sent by metrics-runner to check mail delivery. It will be deleted once it arrives.",
+		"",
+	}, "\r\n")
+	_, err = w.Write([]byte(message))
+	if err != nil {
+		return err
+	}
+	err = w.Close() // Waits for the server to accept the message
+	if err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
@@ -0,0 +1,375 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type mailTestMessage struct {
+	uid     int
+	subject string
+	deleted bool
+}
+
+// mailTestMailbox is the state shared by the smtp and imap stand-ins (messages accepted
+// over smtp show up in it after delay, or never if drop is set).
+type mailTestMailbox struct {
+	sync.Mutex
+	messages []*mailTestMessage
+	next     int
+	delay    time.Duration
+	drop     bool
+	commands []string // Every imap command we were sent
+}
+
+func (m *mailTestMailbox) deliver(subject string) {
+	if m.drop {
+		return
+	}
+	time.AfterFunc(m.delay, func() {
+		m.Lock()
+		defer m.Unlock()
+		m.next++
+		m.messages = append(m.messages, &mailTestMessage{uid: m.next, subject: subject})
+	})
+}
+
+func (m *mailTestMailbox) subjects() []string {
+	m.Lock()
+	defer m.Unlock()
+	var subjects []string
+	for _, message := range m.messages {
+		subject := message.subject
+		if message.deleted {
+			subject += " (deleted)"
+		}
+		subjects = append(subjects, subject)
+	}
+	return subjects
+}
+
+func mailTestListen(t *testing.T, handle func(net.Conn)) int {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// serveSMTP is just enough of an smtp server for net/smtp to send one message.
+func (m *mailTestMailbox) serveSMTP(conn net.Conn) {
+
+	r := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "220 localhost ESMTP test\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.Fields(line + " x")[0])
+		switch verb {
+		case "EHLO":
+			fmt.Fprintf(conn, "250-localhost\r\n250 8BITMIME\r\n")
+		case "DATA":
+			fmt.Fprintf(conn, "354 go ahead\r\n")
+			subject := ""
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				line = strings.TrimRight(line, "\r\n")
+				if line == "." {
+					break
+				}
+				if strings.HasPrefix(line, "Subject: ") && len(subject) < 1 {
+					subject = strings.TrimPrefix(line, "Subject: ")
+				}
+			}
+			m.deliver(subject)
+			fmt.Fprintf(conn, "250 queued\r\n")
+		case "QUIT":
+			fmt.Fprintf(conn, "221 bye\r\n")
+			return
+		default:
+			fmt.Fprintf(conn, "250 ok\r\n")
+		}
+	}
+}
+
+// mailTestIMAP is just enough of an imap server for imapClient (with or without UIDPLUS, and
+// optionally failing or stalling stores).
+type mailTestIMAP struct {
+	mailbox    *mailTestMailbox
+	uidPlus    bool
+	failStore  bool
+	storeDelay time.Duration
+}
+
+func (s *mailTestIMAP) serve(conn net.Conn) {
+
+	r := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "* OK test imap ready\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		parts := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 2)
+		if len(parts) < 2 {
+			return
+		}
+		tag, command := parts[0], parts[1]
+
+		s.mailbox.Lock()
+		s.mailbox.commands = append(s.mailbox.commands, command)
+		s.mailbox.Unlock()
+
+		fields := strings.Fields(command)
+		verb := strings.ToUpper(fields[0])
+		if verb == "UID" {
+			verb += " " + strings.ToUpper(fields[1])
+		}
+
+		switch verb {
+		case "CAPABILITY":
+			capabilities := "IMAP4rev1"
+			if s.uidPlus {
+				capabilities += " UIDPLUS"
+			}
+			fmt.Fprintf(conn, "* CAPABILITY %s\r\n", capabilities)
+
+		case "UID SEARCH":
+			subject, _ := strconv.Unquote(strings.SplitN(command, "SUBJECT ", 2)[1])
+			var uids []string
+			s.mailbox.Lock()
+			for _, message := range s.mailbox.messages {
+				if strings.Contains(message.subject, subject) {
+					uids = append(uids, strconv.Itoa(message.uid))
+				}
+			}
+			s.mailbox.Unlock()
+			fmt.Fprintf(conn, "* SEARCH %s\r\n", strings.Join(uids, " "))
+
+		case "UID STORE":
+			time.Sleep(s.storeDelay)
+			if s.failStore {
+				fmt.Fprintf(conn, "%s NO mailbox is read-only\r\n", tag)
+				continue
+			}
+			s.update(fields[2], func(message *mailTestMessage) { message.deleted = true })
+
+		case "UID EXPUNGE":
+			s.expunge(func(message *mailTestMessage) bool { return s.inSet(fields[2], message.uid) })
+
+		case "EXPUNGE":
+			s.expunge(func(message *mailTestMessage) bool { return true })
+
+		case "LOGOUT":
+			fmt.Fprintf(conn, "* BYE\r\n%s OK logged out\r\n", tag)
+			return
+		}
+
+		fmt.Fprintf(conn, "%s OK done\r\n", tag)
+	}
+}
+
+func (s *mailTestIMAP) inSet(set string, uid int) bool {
+	for _, member := range strings.Split(set, ",") {
+		if member == strconv.Itoa(uid) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *mailTestIMAP) update(set string, update func(*mailTestMessage)) {
+	s.mailbox.Lock()
+	defer s.mailbox.Unlock()
+	for _, message := range s.mailbox.messages {
+		if s.inSet(set, message.uid) {
+			update(message)
+		}
+	}
+}
+
+func (s *mailTestIMAP) expunge(matches func(*mailTestMessage) bool) {
+	s.mailbox.Lock()
+	defer s.mailbox.Unlock()
+	var kept []*mailTestMessage
+	for _, message := range s.mailbox.messages {
+		if !message.deleted || !matches(message) {
+			kept = append(kept, message)
+		}
+	}
+	s.mailbox.messages = kept
+}
+
+func mailTestMetric(t *testing.T, mailbox *mailTestMailbox, imap *mailTestIMAP, timeout time.Duration) *ConfigMetric {
+
+	imap.mailbox = mailbox
+	server := ConfigMetricMailServer{Host: "127.0.0.1", TLS: "none"}
+
+	metric := &ConfigMetric{
+		Type:    "mail-roundtrip",
+		Name:    "test",
+		Timeout: Duration{timeout},
+		Mail: ConfigMetricMail{
+			SMTP:           server,
+			IMAP:           server,
+			From:           "runner@example.com",
+			To:             "probe@example.com",
+			Mailbox:        "INBOX",
+			PollInterval:   Duration{20 * time.Millisecond},
+			CleanupTimeout: Duration{time.Second},
+		},
+	}
+	metric.Mail.SMTP.Port = mailTestListen(t, mailbox.serveSMTP)
+	metric.Mail.IMAP.Port = mailTestListen(t, imap.serve)
+
+	return metric
+}
+
+// mailTestSeed puts someone else's messages in the mailbox (one of them already flagged for
+// deletion, which isn't ours to expunge).
+func mailTestSeed(mailbox *mailTestMailbox) {
+	mailbox.messages = []*mailTestMessage{
+		{uid: 1, subject: "Quarterly report"},
+		{uid: 2, subject: "Spam", deleted: true},
+	}
+	mailbox.next = 2
+}
+
+func TestQueryMailRoundtripMetric(t *testing.T) {
+
+	mailbox := &mailTestMailbox{delay: 50 * time.Millisecond}
+	mailTestSeed(mailbox)
+	metric := mailTestMetric(t, mailbox, &mailTestIMAP{uidPlus: true}, 2*time.Second)
+
+	result, err := QueryMailRoundtripMetric(metric)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Delivered || !result.Valid || !result.Cleaned || result.CleanupErr != nil {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if result.DeliveryElapsed < 50*time.Millisecond || result.DeliveryElapsed < result.SubmissionElapsed {
+		t.Errorf("unexpected elapsed times %+v", result)
+	}
+
+	// Only our message is expunged (the other deleted one is left for its owner)...
+	subjects := mailbox.subjects()
+	if strings.Join(subjects, ", ") != "Quarterly report, Spam (deleted)" {
+		t.Errorf("unexpected mailbox after cleaning up: %v", subjects)
+	}
+	mailbox.Lock()
+	defer mailbox.Unlock()
+	for _, command := range mailbox.commands {
+		if strings.ToUpper(command) == "EXPUNGE" {
+			t.Errorf("expected no bare EXPUNGE to be sent")
+		}
+	}
+}
+
+func TestQueryMailRoundtripMetricWithoutUIDPlus(t *testing.T) {
+
+	mailbox := &mailTestMailbox{}
+	mailTestSeed(mailbox)
+	metric := mailTestMetric(t, mailbox, &mailTestIMAP{}, 2*time.Second)
+
+	result, err := QueryMailRoundtripMetric(metric)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Valid || !result.Cleaned {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	// Without UIDPLUS ours is only flagged...
+	subjects := mailbox.subjects()
+	if len(subjects) != 3 || subjects[1] != "Spam (deleted)" ||
+		!strings.HasPrefix(subjects[2], "[metrics-runner test] ") || !strings.HasSuffix(subjects[2], " (deleted)") {
+		t.Errorf("unexpected mailbox after cleaning up: %v", subjects)
+	}
+}
+
+func TestQueryMailRoundtripMetricUndelivered(t *testing.T) {
+
+	mailbox := &mailTestMailbox{drop: true}
+	metric := mailTestMetric(t, mailbox, &mailTestIMAP{uidPlus: true}, 200*time.Millisecond)
+
+	result, err := QueryMailRoundtripMetric(metric)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Delivered || result.Valid || !result.Cleaned {
+		t.Errorf("unexpected result %+v", result)
+	}
+}
+
+func TestQueryMailRoundtripMetricCleanup(t *testing.T) {
+
+	// A failed cleanup is reported without failing the round trip...
+	mailbox := &mailTestMailbox{}
+	metric := mailTestMetric(t, mailbox, &mailTestIMAP{uidPlus: true, failStore: true}, 2*time.Second)
+
+	result, err := QueryMailRoundtripMetric(metric)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Delivered || !result.Valid || result.Cleaned || result.CleanupErr == nil {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	// Cleaning up gets its own time, even when delivery used up the metric's timeout...
+	mailbox = &mailTestMailbox{delay: 250 * time.Millisecond}
+	metric = mailTestMetric(t, mailbox, &mailTestIMAP{uidPlus: true, storeDelay: 300 * time.Millisecond}, 300*time.Millisecond)
+
+	result, err = QueryMailRoundtripMetric(metric)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Delivered || !result.Cleaned || result.CleanupErr != nil {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if subjects := mailbox.subjects(); len(subjects) != 0 {
+		t.Errorf("expected the mailbox to be empty, got %v", subjects)
+	}
+}
@@ -65,24 +65,34 @@ func QueryHTTPMetric(metric *ConfigMetric) (time.Duration, int, []byte, bool, er
 		return 0, 0, nil, false, fmt.Errorf("cannot query metric type %s via http", metric.Type)
 	}
 
+	elapsed, res, body, err := doHTTPRequest(metric, metric.URL)
+	if err != nil {
+		return 0, 0, nil, false, err
+	}
+
+	// Check if we're valid...
+	isValid := true
+	if res.StatusCode != 200 {
+		isValid = false
+	}
+	if len(metric.StringToCheck) > 0 && !strings.Contains(string(body), metric.StringToCheck) {
+		isValid = false
+	}
+
+	return elapsed, res.StatusCode, body, isValid, nil
+}
+
+// doHTTPRequest sends the request described by metric (method, data and headers) to
+// the given url and returns how long it took along with the response and its body.
+func doHTTPRequest(metric *ConfigMetric, rawURL string) (time.Duration, *http.Response, []byte, error) {
+
 	// Validate supported methods...
 	validMethods := map[string]bool{
 		"GET":  true,
 		"POST": true,
 	}
 	if !validMethods[metric.Method] {
-		return 0, 0, nil, false, fmt.Errorf("method %s is currently not supported", metric.Method)
-	}
-
-	// Configure transport (allow us to optionally ignore bad certs)...
-	cookieJar, _ := cookiejar.New(nil)
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: false}, // TODO - Pull InsecureSkipVerify from config
-	}
-	client := &http.Client{
-		Jar:       cookieJar,
-		Transport: transport,
-		Timeout:   metric.Timeout.Duration,
+		return 0, nil, nil, fmt.Errorf("method %s is currently not supported", metric.Method)
 	}
 
 	// Bind data map to form data...
@@ -96,10 +106,28 @@ func QueryHTTPMetric(metric *ConfigMetric) (time.Duration, int, []byte, bool, er
 	// Create request...
 	// TODO - Load Content-Type from config and act accordingly here (i.e. we should be able
 	//   to send application/json payloads -- or any payloads for that matter).
-	req, err := http.NewRequest(metric.Method, metric.URL, strings.NewReader(form.Encode()))
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req, err := http.NewRequest(metric.Method, rawURL, strings.NewReader(form.Encode()))
 	if err != nil {
-		return 0, 0, nil, false, err
+		return 0, nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return sendHTTPRequest(metric, req)
+}
+
+// sendHTTPRequest adds the metric's optional headers to req, sends it and reads the
+// whole response body (timing the request from start to finish).
+func sendHTTPRequest(metric *ConfigMetric, req *http.Request) (time.Duration, *http.Response, []byte, error) {
+
+	// Configure transport (allow us to optionally ignore bad certs)...
+	cookieJar, _ := cookiejar.New(nil)
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: false}, // TODO - Pull InsecureSkipVerify from config
+	}
+	client := &http.Client{
+		Jar:       cookieJar,
+		Transport: transport,
+		Timeout:   metric.Timeout.Duration,
 	}
 
 	// Add optional headers...
@@ -112,7 +140,7 @@ func QueryHTTPMetric(metric *ConfigMetric) (time.Duration, int, []byte, bool, er
 	// Make request...
 	res, err := client.Do(req)
 	if err != nil {
-		return 0, 0, nil, false, err
+		return 0, nil, nil, err
 	}
 	defer res.Body.Close()
 
@@ -121,20 +149,9 @@ func QueryHTTPMetric(metric *ConfigMetric) (time.Duration, int, []byte, bool, er
 	if res.Body != nil {
 		body, err = ioutil.ReadAll(res.Body)
 		if err != nil {
-			return 0, 0, nil, false, err
+			return 0, nil, nil, err
 		}
 	}
 
-	elapsed := time.Since(start)
-
-	// Check if we're valid...
-	isValid := true
-	if res.StatusCode != 200 {
-		isValid = false
-	}
-	if len(metric.StringToCheck) > 0 && !strings.Contains(string(body), metric.StringToCheck) {
-		isValid = false
-	}
-
-	return elapsed, res.StatusCode, body, isValid, nil
+	return time.Since(start), res, body, nil
 }
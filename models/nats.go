@@ -0,0 +1,298 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// natsClient is a minimal nats client (core publish / subscribe over a single connection).
+type natsClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+type natsMessage struct {
+	Subject string
+	SID     string
+	Status  string // From the headers (e.g. 503 when a request had no responders)
+	Payload []byte
+}
+
+func queryNATS(metric *ConfigMetric, u *url.URL, id string, result *BrokerResult) error {
+
+	deadline := time.Now().Add(metric.Timeout.Duration)
+
+	// Connect...
+	start := time.Now()
+	c, err := dialNATS(u, deadline)
+	if err != nil {
+		return fmt.Errorf("error connecting: %s", err)
+	}
+	defer c.conn.Close()
+	result.ConnectElapsed = time.Since(start)
+
+	// Subscribe (and make sure the server has the subscription before we publish)...
+	subject := brokerRoutingKey(metric)
+	err = c.send("SUB %s 1\r\nPING\r\n", subject)
+	if err != nil {
+		return err
+	}
+	_, err = c.read()
+	if err != nil {
+		return err
+	}
+
+	// Round trip...
+	start = time.Now()
+	err = c.send("PUB %s %d\r\n%s\r\n", subject, len(id), id)
+	if err != nil {
+		return err
+	}
+	for !result.Received {
+		message, err := c.read()
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			result.Errors = append(result.Errors, "timed out waiting for our message")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if message != nil && message.SID == "1" && string(message.Payload) == id {
+			result.Elapsed = time.Since(start)
+			result.Received = true
+		}
+	}
+	err = c.send("UNSUB 1\r\n")
+	if err != nil {
+		return err
+	}
+
+	// Check named streams (nats itself has no queues but jetstream streams keep messages)...
+	for i, name := range metric.Broker.Queues {
+		depth, err := c.streamMessages(name, fmt.Sprintf("_INBOX.%s.%d", id, i), strconv.Itoa(i+2))
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("error checking stream %s: %s", name, err))
+			continue
+		}
+		result.Depths[name] = depth
+	}
+
+	return nil
+}
+
+func dialNATS(u *url.URL, deadline time.Time) (*natsClient, error) {
+
+	port := u.Port()
+	if len(port) < 1 {
+		port = "4222"
+	}
+	conn, err := (&net.Dialer{Deadline: deadline}).Dial("tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(deadline)
+	c := &natsClient{conn: conn, r: bufio.NewReader(conn)}
+
+	// The server speaks first...
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected greeting: %s", strings.TrimSpace(line))
+	}
+	info := struct {
+		TLSRequired bool `json:"tls_required"`
+	}{}
+	err = json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error parsing server info: %s", err)
+	}
+
+	if info.TLSRequired || u.Scheme == "tls" {
+		c.conn = tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		c.r = bufio.NewReader(c.conn)
+	}
+
+	// Introduce ourselves (with a user and password or a token from the url), asking to be told
+	// when a request has no responders...
+	options := map[string]interface{}{
+		"verbose":       false,
+		"pedantic":      false,
+		"name":          "metrics-runner",
+		"lang":          "go",
+		"protocol":      1,
+		"headers":       true,
+		"no_responders": true,
+	}
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			options["user"] = u.User.Username()
+			options["pass"] = password
+		} else {
+			options["auth_token"] = u.User.Username()
+		}
+	}
+	connect, err := json.Marshal(options)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	err = c.send("CONNECT %s\r\nPING\r\n", connect)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_, err = c.read() // Errors (e.g. bad credentials) arrive before our pong
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *natsClient) send(format string, args ...interface{}) error {
+	_, err := fmt.Fprintf(c.conn, format, args...)
+	return err
+}
+
+// read returns the next message (or nil for a PONG), answering pings along the way.
+func (c *natsClient) read() (*natsMessage, error) {
+
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		fields := strings.Fields(line)
+		if len(fields) < 1 {
+			continue
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "PING":
+			err = c.send("PONG\r\n")
+			if err != nil {
+				return nil, err
+			}
+
+		case "PONG":
+			return nil, nil
+
+		case "-ERR":
+			return nil, fmt.Errorf("server error: %s", strings.TrimSpace(strings.TrimPrefix(line, fields[0])))
+
+		case "MSG":
+			// MSG <subject> <sid> [reply-to] <size>...
+			if len(fields) < 4 || len(fields) > 5 {
+				return nil, fmt.Errorf("malformed message: %s", line)
+			}
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || size < 0 {
+				return nil, fmt.Errorf("malformed message: %s", line)
+			}
+			payload := make([]byte, size+2) // Plus the trailing \r\n
+			_, err = io.ReadFull(c.r, payload)
+			if err != nil {
+				return nil, err
+			}
+			return &natsMessage{Subject: fields[1], SID: fields[2], Payload: payload[:size]}, nil
+
+		case "HMSG":
+			// HMSG <subject> <sid> [reply-to] <header size> <total size>...
+			if len(fields) < 5 || len(fields) > 6 {
+				return nil, fmt.Errorf("malformed message: %s", line)
+			}
+			headerSize, err := strconv.Atoi(fields[len(fields)-2])
+			if err != nil || headerSize < 0 {
+				return nil, fmt.Errorf("malformed message: %s", line)
+			}
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || size < headerSize {
+				return nil, fmt.Errorf("malformed message: %s", line)
+			}
+			payload := make([]byte, size+2)
+			_, err = io.ReadFull(c.r, payload)
+			if err != nil {
+				return nil, err
+			}
+
+			// The headers start with a version line that may carry a status (NATS/1.0 503)...
+			message := &natsMessage{Subject: fields[1], SID: fields[2], Payload: payload[headerSize:size]}
+			status := strings.Fields(strings.SplitN(string(payload[:headerSize]), "\r\n", 2)[0])
+			if len(status) > 1 {
+				message.Status = status[1]
+			}
+			return message, nil
+		}
+	}
+}
+
+// streamMessages asks jetstream how many messages a stream is holding.
+func (c *natsClient) streamMessages(stream string, inbox string, sid string) (float64, error) {
+
+	err := c.send("SUB %s %s\r\nPUB $JS.API.STREAM.INFO.%s %s 0\r\n\r\n", inbox, sid, stream, inbox)
+	if err != nil {
+		return 0, err
+	}
+	defer c.send("UNSUB %s\r\n", sid)
+
+	for {
+		message, err := c.read()
+		if err != nil {
+			return 0, err
+		}
+		if message == nil || message.SID != sid {
+			continue
+		}
+
+		info := struct {
+			State struct {
+				Messages float64 `json:"messages"`
+			} `json:"state"`
+			Error *struct {
+				Description string `json:"description"`
+			} `json:"error"`
+		}{}
+		if message.Status == "503" {
+			return 0, fmt.Errorf("no responders (is jetstream enabled?)")
+		}
+		err = json.Unmarshal(message.Payload, &info)
+		if err != nil {
+			return 0, err
+		}
+		if info.Error != nil {
+			return 0, fmt.Errorf("%s", info.Error.Description)
+		}
+		return info.State.Messages, nil
+	}
+}
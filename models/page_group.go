@@ -0,0 +1,56 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+)
+
+// PageGroups matches page paths against the configured page groups.
+type PageGroups struct {
+	names    []string
+	patterns []*regexp.Regexp
+}
+
+func NewPageGroups(groups []ConfigPageGroup) (*PageGroups, error) {
+	p := &PageGroups{}
+	for _, group := range groups {
+		re, err := regexp.Compile(group.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling pattern for page group %s: %s", group.Name, err)
+		}
+		p.names = append(p.names, group.Name)
+		p.patterns = append(p.patterns, re)
+	}
+	return p, nil
+}
+
+// Match returns the name of the first page group matching the page's url ("other" if none do).
+func (p *PageGroups) Match(pageURL string) string {
+	path := "/"
+	if u, err := url.Parse(pageURL); err == nil && len(u.Path) > 0 {
+		path = u.Path
+	}
+	for i, re := range p.patterns {
+		if re.MatchString(path) {
+			return p.names[i]
+		}
+	}
+	return "other"
+}
@@ -0,0 +1,61 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"time"
+)
+
+// RunResult describes the outcome of the most recent run of a metrics runner.
+type RunResult struct {
+	Name    string                 `json:"name"`
+	Type    string                 `json:"type"`
+	Started time.Time              `json:"started"`
+	Elapsed Duration               `json:"elapsed"`
+	Valid   bool                   `json:"valid"`
+	Error   string                 `json:"error,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// NewRunResult starts a result for the given metric (the caller fills in the rest).
+func NewRunResult(metric *ConfigMetric) *RunResult {
+	return &RunResult{
+		Name:    metric.Name,
+		Type:    metric.Type,
+		Started: time.Now().UTC(),
+		Details: map[string]interface{}{},
+	}
+}
+
+// Finish records how long the run took, its validity and any error.
+func (r *RunResult) Finish(valid bool, err error) {
+	r.Elapsed = Duration{Duration: time.Since(r.Started)}
+	r.Valid = valid
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// Copy returns a shallow copy of the result (details map included) that's safe to hand out.
+func (r *RunResult) Copy() *RunResult {
+	c := *r
+	c.Details = map[string]interface{}{}
+	for key, value := range r.Details {
+		c.Details[key] = value
+	}
+	return &c
+}
@@ -0,0 +1,585 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The phases of a transfer round trip (in order)...
+var transferPhases = []string{"connect", "login", "upload", "list", "download", "delete"}
+
+// transferFileSize is how much (random) data we upload and expect to get back.
+const transferFileSize = 1024
+
+type TransferPhase struct {
+	Name    string
+	Elapsed time.Duration
+}
+
+type TransferResult struct {
+	Phases      []TransferPhase // Only the phases that completed
+	FailedPhase string          // Empty when every phase completed
+	Err         error
+	Valid       bool
+}
+
+// FailedPhaseIndex returns the one based position of the failed phase (zero if none failed).
+func (r *TransferResult) FailedPhaseIndex() int {
+	for i, phase := range transferPhases {
+		if phase == r.FailedPhase {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// transferSession is a logged in sftp or ftp session, working in the metric's directory.
+type transferSession interface {
+	Upload(name string, data []byte) error
+	List() ([]string, error)
+	Download(name string) ([]byte, error)
+	Delete(name string) error
+	Close() error
+}
+
+// QuerySFTPMetric round trips a small, uniquely named file through the metric's server
+// (sftp://, ftp:// or ftps:// url), timing each phase.
+func QuerySFTPMetric(metric *ConfigMetric) (*TransferResult, error) {
+
+	// We can only query metrics of sftp type...
+	if metric.Type != "sftp" {
+		return nil, fmt.Errorf("cannot query metric type %s via sftp", metric.Type)
+	}
+
+	u, err := url.Parse(metric.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "sftp" && u.Scheme != "ftp" && u.Scheme != "ftps" {
+		return nil, fmt.Errorf("cannot transfer via %s (only sftp, ftp and ftps urls are supported)", metric.URL)
+	}
+
+	// Make up a file nobody else will be using...
+	data := make([]byte, transferFileSize)
+	_, err = rand.Read(data)
+	if err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("metrics-runner-%s-%s.tmp", metric.Name, hex.EncodeToString(data[:8]))
+
+	result := &TransferResult{}
+	deadline := time.Now().Add(metric.Timeout.Duration)
+
+	// phase times fn as the next phase, returning false (and recording why) if it failed...
+	phase := func(fn func() error) bool {
+		name := transferPhases[len(result.Phases)]
+		start := time.Now()
+		err := fn()
+		if err != nil {
+			result.FailedPhase = name
+			result.Err = fmt.Errorf("error during %s: %s", name, err)
+			return false
+		}
+		result.Phases = append(result.Phases, TransferPhase{Name: name, Elapsed: time.Since(start)})
+		return true
+	}
+
+	var conn net.Conn
+	ok := phase(func() error {
+		conn, err = net.DialTimeout("tcp", transferAddress(u, metric), metric.Timeout.Duration)
+		if err != nil {
+			return err
+		}
+		return conn.SetDeadline(deadline)
+	})
+	if !ok {
+		return result, nil
+	}
+	defer conn.Close()
+
+	var session transferSession
+	ok = phase(func() error {
+		if u.Scheme == "sftp" {
+			session, err = newSFTPSession(conn, u, metric)
+		} else {
+			session, err = newFTPSession(conn, u, metric)
+		}
+		return err
+	})
+	if !ok {
+		return result, nil
+	}
+	defer session.Close()
+
+	uploaded := false
+	ok = phase(func() error {
+		err := session.Upload(name, data)
+		uploaded = err == nil
+		return err
+	}) && phase(func() error {
+		names, err := session.List()
+		if err != nil {
+			return err
+		}
+		for _, n := range names {
+			if path.Base(n) == name {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s missing from listing (%d entries)", name, len(names))
+	}) && phase(func() error {
+		downloaded, err := session.Download(name)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(downloaded, data) {
+			return fmt.Errorf("downloaded %d bytes that don't match the %d uploaded", len(downloaded), len(data))
+		}
+		return nil
+	}) && phase(func() error {
+		err := session.Delete(name)
+		if err == nil {
+			uploaded = false
+		}
+		return err
+	})
+
+	// Don't leave our file behind when something in the middle failed...
+	if uploaded {
+		session.Delete(name)
+	}
+
+	result.Valid = ok
+	return result, nil
+}
+
+func transferAddress(u *url.URL, metric *ConfigMetric) string {
+	port := u.Port()
+	if len(port) < 1 {
+		switch {
+		case u.Scheme == "sftp":
+			port = "22"
+		case u.Scheme == "ftps" && metric.SFTP.ImplicitTLS:
+			port = "990"
+		default:
+			port = "21"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// transferPassword returns the configured password (falling back to the url's).
+func transferPassword(u *url.URL, metric *ConfigMetric) string {
+	if len(metric.SFTP.Password) > 0 {
+		return metric.SFTP.Password
+	}
+	password, _ := u.User.Password()
+	return password
+}
+
+const (
+	sftpVersion = 3
+
+	sftpInit            = 1
+	sftpVersionResponse = 2
+	sftpOpen            = 3
+	sftpClose           = 4
+	sftpRead            = 5
+	sftpWrite           = 6
+	sftpOpenDir         = 11
+	sftpReadDir         = 12
+	sftpRemove          = 13
+	sftpStatus          = 101
+	sftpHandle          = 102
+	sftpData            = 103
+	sftpName            = 104
+
+	sftpFlagRead     = 0x01
+	sftpFlagWrite    = 0x02
+	sftpFlagCreate   = 0x08
+	sftpFlagTruncate = 0x10
+
+	sftpStatusOK  = 0
+	sftpStatusEOF = 1
+
+	sftpChunkSize     = 32 * 1024
+	sftpMaxPacketSize = 256 * 1024
+)
+
+// sftpSession is a minimal (version 3) sftp client. Requests are sent one at a time.
+type sftpSession struct {
+	client    *ssh.Client
+	session   *ssh.Session
+	w         io.WriteCloser
+	r         io.Reader
+	directory string
+	requestID uint32
+}
+
+func newSFTPSession(conn net.Conn, u *url.URL, metric *ConfigMetric) (*sftpSession, error) {
+
+	if len(metric.SFTP.HostKey) < 1 {
+		return nil, fmt.Errorf("no host key configured")
+	}
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(metric.SFTP.HostKey))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing host key: %s", err)
+	}
+
+	var auth []ssh.AuthMethod
+	if len(metric.SFTP.PrivateKey) > 0 {
+		key, err := ioutil.ReadFile(metric.SFTP.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing private key: %s", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if password := transferPassword(u, metric); len(password) > 0 {
+		auth = append(auth, ssh.Password(password))
+	}
+
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, conn.RemoteAddr().String(), &ssh.ClientConfig{
+		User:            u.User.Username(),
+		Auth:            auth,
+		HostKeyCallback: ssh.FixedHostKey(hostKey),
+		Timeout:         metric.Timeout.Duration,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s := &sftpSession{client: ssh.NewClient(sshConn, channels, requests), directory: u.Path}
+
+	s.session, err = s.client.NewSession()
+	if err != nil {
+		s.client.Close()
+		return nil, err
+	}
+	s.w, _ = s.session.StdinPipe()
+	s.r, _ = s.session.StdoutPipe()
+	err = s.session.RequestSubsystem("sftp")
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	// Say hello (we don't use any extensions so the server's version is all we care about)...
+	err = s.send(sftpInit, sftpUint32(sftpVersion))
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	packetType, payload, err := s.receive()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	if packetType != sftpVersionResponse || len(payload) < 4 || binary.BigEndian.Uint32(payload) < sftpVersion {
+		s.Close()
+		return nil, fmt.Errorf("server doesn't speak sftp version %d", sftpVersion)
+	}
+
+	return s, nil
+}
+
+func (s *sftpSession) send(packetType byte, fields ...[]byte) error {
+	packet := []byte{packetType}
+	for _, field := range fields {
+		packet = append(packet, field...)
+	}
+	_, err := s.w.Write(append(sftpUint32(uint32(len(packet))), packet...))
+	return err
+}
+
+func (s *sftpSession) receive() (byte, []byte, error) {
+	header := make([]byte, 4)
+	_, err := io.ReadFull(s.r, header)
+	if err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length < 1 || length > sftpMaxPacketSize {
+		return 0, nil, fmt.Errorf("malformed packet")
+	}
+	packet := make([]byte, length)
+	_, err = io.ReadFull(s.r, packet)
+	if err != nil {
+		return 0, nil, err
+	}
+	return packet[0], packet[1:], nil
+}
+
+// request sends a request and returns the matching response's type and payload (past the id).
+func (s *sftpSession) request(packetType byte, fields ...[]byte) (byte, []byte, error) {
+
+	s.requestID++
+	err := s.send(packetType, append([][]byte{sftpUint32(s.requestID)}, fields...)...)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	responseType, payload, err := s.receive()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(payload) < 4 || binary.BigEndian.Uint32(payload) != s.requestID {
+		return 0, nil, fmt.Errorf("unexpected response")
+	}
+
+	return responseType, payload[4:], nil
+}
+
+// sftpStatusError returns nil for an ok status and the server's message (as an error)
+// otherwise. Anything other than a status is unexpected. It takes a request's results
+// whole, passing any error straight through.
+func sftpStatusError(responseType byte, payload []byte, err error) error {
+	if err != nil {
+		return err
+	}
+	if responseType != sftpStatus || len(payload) < 4 {
+		return fmt.Errorf("unexpected response (type %d)", responseType)
+	}
+	code := binary.BigEndian.Uint32(payload)
+	if code == sftpStatusOK {
+		return nil
+	}
+	message, _, _ := sftpString(payload[4:])
+	return fmt.Errorf("status %d (%s)", code, message)
+}
+
+func sftpHandleFrom(responseType byte, payload []byte, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	if responseType != sftpHandle {
+		return nil, sftpStatusError(responseType, payload, nil)
+	}
+	handle, _, err := sftpString(payload)
+	return handle, err
+}
+
+func (s *sftpSession) path(name string) string {
+	if len(s.directory) < 1 {
+		return name
+	}
+	return path.Join(s.directory, name)
+}
+
+func (s *sftpSession) closeHandle(handle []byte) error {
+	return sftpStatusError(s.request(sftpClose, sftpBytes(handle)))
+}
+
+func (s *sftpSession) Upload(name string, data []byte) error {
+
+	handle, err := sftpHandleFrom(s.request(sftpOpen, sftpBytes([]byte(s.path(name))),
+		sftpUint32(sftpFlagWrite|sftpFlagCreate|sftpFlagTruncate), sftpUint32(0)))
+	if err != nil {
+		return err
+	}
+
+	for offset := 0; offset < len(data); offset += sftpChunkSize {
+		end := offset + sftpChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		err = sftpStatusError(s.request(sftpWrite, sftpBytes(handle), sftpUint64(uint64(offset)),
+			sftpBytes(data[offset:end])))
+		if err != nil {
+			s.closeHandle(handle)
+			return err
+		}
+	}
+
+	return s.closeHandle(handle)
+}
+
+func (s *sftpSession) List() ([]string, error) {
+
+	directory := s.directory
+	if len(directory) < 1 {
+		directory = "."
+	}
+	handle, err := sftpHandleFrom(s.request(sftpOpenDir, sftpBytes([]byte(directory))))
+	if err != nil {
+		return nil, err
+	}
+	defer s.closeHandle(handle)
+
+	var names []string
+	for {
+		responseType, payload, err := s.request(sftpReadDir, sftpBytes(handle))
+		if err != nil {
+			return nil, err
+		}
+		if responseType == sftpStatus && len(payload) >= 4 && binary.BigEndian.Uint32(payload) == sftpStatusEOF {
+			return names, nil
+		}
+		if responseType != sftpName {
+			return nil, sftpStatusError(responseType, payload, nil)
+		}
+
+		// Each entry is a filename, a long (ls -l style) name and attributes...
+		if len(payload) < 4 {
+			return nil, fmt.Errorf("malformed name response")
+		}
+		count := binary.BigEndian.Uint32(payload)
+		payload = payload[4:]
+		for i := uint32(0); i < count; i++ {
+			var name []byte
+			name, payload, err = sftpString(payload)
+			if err == nil {
+				_, payload, err = sftpString(payload)
+			}
+			if err == nil {
+				payload, err = sftpSkipAttributes(payload)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("malformed name response")
+			}
+			names = append(names, string(name))
+		}
+	}
+}
+
+func (s *sftpSession) Download(name string) ([]byte, error) {
+
+	handle, err := sftpHandleFrom(s.request(sftpOpen, sftpBytes([]byte(s.path(name))), sftpUint32(sftpFlagRead), sftpUint32(0)))
+	if err != nil {
+		return nil, err
+	}
+	defer s.closeHandle(handle)
+
+	var data []byte
+	for {
+		responseType, payload, err := s.request(sftpRead, sftpBytes(handle), sftpUint64(uint64(len(data))),
+			sftpUint32(sftpChunkSize))
+		if err != nil {
+			return nil, err
+		}
+		if responseType == sftpStatus && len(payload) >= 4 && binary.BigEndian.Uint32(payload) == sftpStatusEOF {
+			return data, nil
+		}
+		if responseType != sftpData {
+			return nil, sftpStatusError(responseType, payload, nil)
+		}
+		chunk, _, err := sftpString(payload)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+	}
+}
+
+func (s *sftpSession) Delete(name string) error {
+	return sftpStatusError(s.request(sftpRemove, sftpBytes([]byte(s.path(name)))))
+}
+
+func (s *sftpSession) Close() error {
+	if s.session != nil {
+		s.session.Close()
+	}
+	return s.client.Close()
+}
+
+func sftpUint32(value uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, value)
+	return b
+}
+
+func sftpUint64(value uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, value)
+	return b
+}
+
+func sftpBytes(value []byte) []byte {
+	return append(sftpUint32(uint32(len(value))), value...)
+}
+
+// sftpString reads a length prefixed string off the front of payload.
+func sftpString(payload []byte) ([]byte, []byte, error) {
+	if len(payload) < 4 {
+		return nil, nil, fmt.Errorf("malformed string")
+	}
+	length := binary.BigEndian.Uint32(payload)
+	if uint32(len(payload)-4) < length {
+		return nil, nil, fmt.Errorf("malformed string")
+	}
+	return payload[4 : 4+length], payload[4+length:], nil
+}
+
+// sftpSkipAttributes skips over file attributes (we never need them).
+func sftpSkipAttributes(payload []byte) ([]byte, error) {
+
+	if len(payload) < 4 {
+		return nil, fmt.Errorf("malformed attributes")
+	}
+	flags := binary.BigEndian.Uint32(payload)
+	payload = payload[4:]
+
+	skip := 0
+	if flags&0x01 != 0 { // Size
+		skip += 8
+	}
+	if flags&0x02 != 0 { // Uid and gid
+		skip += 8
+	}
+	if flags&0x04 != 0 { // Permissions
+		skip += 4
+	}
+	if flags&0x08 != 0 { // Access and modification times
+		skip += 8
+	}
+	if len(payload) < skip {
+		return nil, fmt.Errorf("malformed attributes")
+	}
+	payload = payload[skip:]
+
+	if flags&0x80000000 != 0 { // Extended pairs
+		if len(payload) < 4 {
+			return nil, fmt.Errorf("malformed attributes")
+		}
+		count := binary.BigEndian.Uint32(payload)
+		payload = payload[4:]
+		for i := uint32(0); i < count*2; i++ {
+			var err error
+			_, payload, err = sftpString(payload)
+			if err != nil {
+				return nil, fmt.Errorf("malformed attributes")
+			}
+		}
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,802 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	snmpGetRequest     = 0xa0
+	snmpGetResponse    = 0xa2
+	snmpGetBulkRequest = 0xa5
+	snmpReport         = 0xa8
+
+	snmpCounter32      = 0x41
+	snmpGauge32        = 0x42
+	snmpTimeTicks      = 0x43
+	snmpCounter64      = 0x46
+	snmpNoSuchObject   = 0x80
+	snmpNoSuchInstance = 0x81
+	snmpEndOfMibView   = 0x82
+
+	snmpMaxMessageSize  = 65507
+	snmpMaxRepetitions  = 20
+	snmpMaxWalkRequests = 1000 // Keeps a misbehaving agent from walking us forever
+	snmpAuthParamLength = 12   // HMAC-MD5-96 and HMAC-SHA-96 both truncate to 96 bits
+
+	snmpFlagAuth       = 0x01
+	snmpFlagPriv       = 0x02
+	snmpFlagReportable = 0x04
+)
+
+// sysUpTime, which we get along with every poll (to tell when the agent's restarted)...
+const snmpSysUpTimeOID = "1.3.6.1.2.1.1.3.0"
+
+// USM report oids (what went wrong with a v3 request)...
+var snmpReportReasons = map[string]string{
+	"1.3.6.1.6.3.15.1.1.1.0": "unsupported security level",
+	"1.3.6.1.6.3.15.1.1.2.0": "not in time window",
+	"1.3.6.1.6.3.15.1.1.3.0": "unknown user name",
+	"1.3.6.1.6.3.15.1.1.4.0": "unknown engine id",
+	"1.3.6.1.6.3.15.1.1.5.0": "wrong digest (check the auth protocol and password)",
+	"1.3.6.1.6.3.15.1.1.6.0": "decryption error (check the priv protocol and password)",
+}
+
+type snmpVariable struct {
+	OID   string
+	Value berElement
+}
+
+// SNMPCounterSample is the last value we saw of a counter (used to work out its rate).
+type SNMPCounterSample struct {
+	Value  uint64
+	Type   byte
+	Time   time.Time
+	Uptime uint64 // The agent's sysUpTime (in timeticks) when we saw it, zero if unknown
+}
+
+// SNMPCounters remembers counter samples between polls (keyed by value name).
+type SNMPCounters map[string]SNMPCounterSample
+
+type SNMPResult struct {
+	Elapsed time.Duration
+	Valid   bool
+	Values  map[string]float64 // Gauges as is, counters as per-second rates
+	Errors  []string
+}
+
+// QuerySNMPMetric polls the metric's agent for its configured oids (walking subtrees
+// where asked to). Counters are reported as rates against the samples in counters
+// (which is updated for next time), so the first poll of a counter has no value (and
+// neither does the first poll after the agent restarts).
+func QuerySNMPMetric(metric *ConfigMetric, counters SNMPCounters) (*SNMPResult, error) {
+
+	// We can only query metrics of snmp type...
+	if metric.Type != "snmp" {
+		return nil, fmt.Errorf("cannot query metric type %s via snmp", metric.Type)
+	}
+
+	start := time.Now()
+
+	client, err := newSNMPClient(metric)
+	if err != nil {
+		return nil, err
+	}
+	defer client.close()
+
+	result := &SNMPResult{
+		Valid:  true,
+		Values: map[string]float64{},
+	}
+
+	// Get the single oids in one request (along with sysUpTime)...
+	names := make([]string, 0, len(metric.SNMP.Get))
+	oids := make([]string, 0, len(metric.SNMP.Get)+1)
+	for name, oid := range metric.SNMP.Get {
+		names = append(names, name)
+		oids = append(oids, strings.TrimPrefix(oid, "."))
+	}
+	variables, err := client.get(append(oids, snmpSysUpTimeOID))
+	if err != nil {
+		return nil, err
+	}
+	var uptime uint64
+	if len(variables) > len(names) && variables[len(names)].Value.Tag == snmpTimeTicks {
+		uptime = variables[len(names)].Value.Uint()
+	}
+	for i, variable := range variables {
+		if i < len(names) {
+			result.record(names[i], variable, counters, uptime)
+		}
+	}
+
+	// Walk the subtrees (values are named after the walk plus the index within it)...
+	for name, root := range metric.SNMP.Walk {
+		root = strings.TrimPrefix(root, ".")
+		variables, err := client.walk(root)
+		if err != nil {
+			return nil, fmt.Errorf("error walking %s (%s): %s", name, root, err)
+		}
+		if len(variables) < 1 {
+			result.Valid = false
+			result.Errors = append(result.Errors, fmt.Sprintf("%s (%s) is empty", name, root))
+		}
+		for _, variable := range variables {
+			result.record(fmt.Sprintf("%s.%s", name, strings.TrimPrefix(variable.OID, root+".")), variable, counters, uptime)
+		}
+	}
+
+	result.Elapsed = time.Since(start)
+	return result, nil
+}
+
+// record adds variable to the result's values (converting counters to rates, given the
+// agent's uptime).
+func (r *SNMPResult) record(name string, variable snmpVariable, counters SNMPCounters, uptime uint64) {
+
+	now := time.Now()
+
+	switch variable.Value.Tag {
+	case berTagInteger:
+		r.Values[name] = float64(variable.Value.Int())
+
+	case snmpGauge32, snmpTimeTicks:
+		r.Values[name] = float64(variable.Value.Uint())
+
+	case snmpCounter32, snmpCounter64:
+		current := SNMPCounterSample{Value: variable.Value.Uint(), Type: variable.Value.Tag, Time: now, Uptime: uptime}
+		previous, ok := counters[name]
+		counters[name] = current
+
+		// If sysUpTime went backwards the agent restarted (and its counters started over), which
+		// would otherwise look like a wrap and a huge rate...
+		restarted := previous.Uptime > 0 && current.Uptime > 0 && current.Uptime < previous.Uptime
+		if ok && !restarted && previous.Type == current.Type && current.Time.After(previous.Time) {
+			r.Values[name] = snmpCounterRate(previous, current)
+		}
+
+	case berTagOctetString:
+		// Some devices (looking at you, UPS units) report numbers as strings...
+		value, err := strconv.ParseFloat(strings.TrimSpace(string(variable.Value.Content)), 64)
+		if err != nil {
+			r.Valid = false
+			r.Errors = append(r.Errors, fmt.Sprintf("%s (%s) is not numeric", name, variable.OID))
+			return
+		}
+		r.Values[name] = value
+
+	case snmpNoSuchObject, snmpNoSuchInstance, snmpEndOfMibView:
+		r.Valid = false
+		r.Errors = append(r.Errors, fmt.Sprintf("%s (%s) does not exist", name, variable.OID))
+
+	default:
+		r.Valid = false
+		r.Errors = append(r.Errors, fmt.Sprintf("%s (%s) is not numeric (type 0x%02x)", name, variable.OID, variable.Value.Tag))
+	}
+}
+
+// snmpCounterRate works out the per-second rate between two samples of a counter,
+// allowing for it having wrapped around since the previous sample.
+func snmpCounterRate(previous SNMPCounterSample, current SNMPCounterSample) float64 {
+	var delta uint64
+	if current.Type == snmpCounter32 {
+		delta = uint64(uint32(current.Value) - uint32(previous.Value))
+	} else {
+		delta = current.Value - previous.Value
+	}
+	return float64(delta) / current.Time.Sub(previous.Time).Seconds()
+}
+
+type snmpClient struct {
+	config    *ConfigMetricSNMP
+	conn      net.Conn
+	timeout   time.Duration
+	requestID int32
+
+	// Version 3 (user-based security model) state...
+	authHash     func() hash.Hash
+	engineID     []byte
+	engineBoots  int64
+	engineTime   int64
+	discovered   time.Time
+	authKey      []byte
+	privKey      []byte
+	privSalt     uint64
+	securityFlag byte
+}
+
+func newSNMPClient(metric *ConfigMetric) (*snmpClient, error) {
+
+	config := &metric.SNMP
+	if config.Version != "2c" && config.Version != "3" {
+		return nil, fmt.Errorf("snmp version %s is currently not supported", config.Version)
+	}
+
+	conn, err := net.Dial("udp", net.JoinHostPort(config.Host, strconv.Itoa(config.Port)))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &snmpClient{
+		config:    config,
+		conn:      conn,
+		timeout:   metric.Timeout.Duration,
+		requestID: rand.Int31(),
+	}
+
+	if config.Version == "3" {
+		err = c.configureSecurity()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (c *snmpClient) close() {
+	c.conn.Close()
+}
+
+// get fetches the given oids (in a single request).
+func (c *snmpClient) get(oids []string) ([]snmpVariable, error) {
+	return c.request(snmpGetRequest, oids, 0, 0)
+}
+
+// walk fetches every variable under root (using get-bulk to save round trips).
+func (c *snmpClient) walk(root string) ([]snmpVariable, error) {
+
+	var variables []snmpVariable
+	next := root
+	for i := 0; i < snmpMaxWalkRequests; i++ {
+
+		response, err := c.request(snmpGetBulkRequest, []string{next}, 0, snmpMaxRepetitions)
+		if err != nil {
+			return nil, err
+		}
+		if len(response) < 1 {
+			return variables, nil
+		}
+
+		for _, variable := range response {
+			if variable.Value.Tag == snmpEndOfMibView || !strings.HasPrefix(variable.OID, root+".") {
+				return variables, nil
+			}
+			if variable.OID == next {
+				return nil, fmt.Errorf("agent returned oids out of order at %s", next)
+			}
+			variables = append(variables, variable)
+			next = variable.OID
+		}
+	}
+
+	return nil, fmt.Errorf("gave up walking after %d requests", snmpMaxWalkRequests)
+}
+
+// request sends a pdu for oids and returns the variables from the response. For
+// get-bulk requests nonRepeaters and maxRepetitions are sent in place of error
+// status and index.
+func (c *snmpClient) request(pduType byte, oids []string, nonRepeaters int, maxRepetitions int) ([]snmpVariable, error) {
+
+	var varbinds [][]byte
+	for _, oid := range oids {
+		encodedOID, err := berOID(oid)
+		if err != nil {
+			return nil, err
+		}
+		varbinds = append(varbinds, berSequence(encodedOID, berNull()))
+	}
+
+	c.requestID++
+	requestID := c.requestID
+	pdu := berConstruct(pduType,
+		berInteger(berTagInteger, int64(requestID)),
+		berInteger(berTagInteger, int64(nonRepeaters)),
+		berInteger(berTagInteger, int64(maxRepetitions)),
+		berSequence(varbinds...))
+
+	// Try again (with the fresh clock we picked up from the report) if the agent told
+	//  us we're out of its time window...
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+
+		var response berElement
+		response, err = c.exchange(requestID, pdu)
+		if err != nil {
+			if _, ok := err.(snmpTimeWindowError); ok {
+				continue
+			}
+			return nil, err
+		}
+
+		return c.parseResponse(response)
+	}
+
+	return nil, err
+}
+
+// exchange sends pdu (wrapped up for our version) and waits for the matching response pdu.
+func (c *snmpClient) exchange(requestID int32, pdu []byte) (berElement, error) {
+
+	var message []byte
+	var err error
+	if c.config.Version == "3" {
+		message, err = c.encodeV3(requestID, pdu, c.securityFlag|snmpFlagReportable)
+	} else {
+		message = berSequence(
+			berInteger(berTagInteger, 1), // Version 2c
+			berOctetString(berTagOctetString, []byte(c.config.Community)),
+			pdu)
+	}
+	if err != nil {
+		return berElement{}, err
+	}
+
+	deadline := time.Now().Add(c.timeout)
+	c.conn.SetDeadline(deadline)
+	_, err = c.conn.Write(message)
+	if err != nil {
+		return berElement{}, err
+	}
+
+	buffer := make([]byte, snmpMaxMessageSize)
+	for {
+		n, err := c.conn.Read(buffer)
+		if err != nil {
+			return berElement{}, err
+		}
+
+		var response berElement
+		if c.config.Version == "3" {
+			response, err = c.decodeV3(buffer[:n])
+		} else {
+			response, err = c.decodeV2c(buffer[:n])
+		}
+		if err != nil {
+			return berElement{}, err
+		}
+
+		// Skip late responses to earlier requests...
+		fields, err := berChildren(response.Content)
+		if err != nil || len(fields) != 4 {
+			return berElement{}, fmt.Errorf("malformed response pdu")
+		}
+		if int32(fields[0].Int()) != requestID {
+			continue
+		}
+
+		if response.Tag == snmpReport {
+			return berElement{}, c.reportError(fields[3])
+		}
+
+		return response, nil
+	}
+}
+
+func (c *snmpClient) parseResponse(response berElement) ([]snmpVariable, error) {
+
+	if response.Tag != snmpGetResponse {
+		return nil, fmt.Errorf("unexpected pdu type 0x%02x", response.Tag)
+	}
+
+	fields, _ := berChildren(response.Content)
+	if errorStatus := fields[1].Int(); errorStatus != 0 {
+		return nil, fmt.Errorf("agent returned error status %d (at index %d)", errorStatus, fields[2].Int())
+	}
+
+	varbinds, err := berChildren(fields[3].Content)
+	if err != nil {
+		return nil, err
+	}
+
+	variables := make([]snmpVariable, 0, len(varbinds))
+	for _, varbind := range varbinds {
+		parts, err := berChildren(varbind.Content)
+		if err != nil || len(parts) != 2 || parts[0].Tag != berTagOID {
+			return nil, fmt.Errorf("malformed variable binding")
+		}
+		variables = append(variables, snmpVariable{OID: parts[0].OID(), Value: parts[1]})
+	}
+
+	return variables, nil
+}
+
+func (c *snmpClient) decodeV2c(message []byte) (berElement, error) {
+
+	envelope, _, err := berDecode(message)
+	if err != nil {
+		return berElement{}, err
+	}
+	fields, err := berChildren(envelope.Content)
+	if err != nil || len(fields) != 3 {
+		return berElement{}, fmt.Errorf("malformed snmp message")
+	}
+
+	return fields[2], nil
+}
+
+// snmpTimeWindowError means our idea of the agent's clock was off (we've resynced
+// from the report, so it's worth trying again).
+type snmpTimeWindowError struct{}
+
+func (e snmpTimeWindowError) Error() string {
+	return "not in time window"
+}
+
+func (c *snmpClient) reportError(varbinds berElement) error {
+
+	reports, _ := berChildren(varbinds.Content)
+	for _, report := range reports {
+		parts, err := berChildren(report.Content)
+		if err != nil || len(parts) != 2 {
+			continue
+		}
+		oid := parts[0].OID()
+		if oid == "1.3.6.1.6.3.15.1.1.2.0" {
+			return snmpTimeWindowError{}
+		}
+		if reason, ok := snmpReportReasons[oid]; ok {
+			return fmt.Errorf("agent reported %s", reason)
+		}
+		return fmt.Errorf("agent reported %s", oid)
+	}
+
+	return fmt.Errorf("agent sent an empty report")
+}
+
+// configureSecurity discovers the agent's engine (id, boots and time) and localizes
+// our keys to it.
+func (c *snmpClient) configureSecurity() error {
+
+	switch strings.ToUpper(c.config.AuthProtocol) {
+	case "":
+	case "MD5":
+		c.authHash = md5.New
+		c.securityFlag = snmpFlagAuth
+	case "SHA":
+		c.authHash = sha1.New
+		c.securityFlag = snmpFlagAuth
+	default:
+		return fmt.Errorf("snmp auth protocol %s is currently not supported", c.config.AuthProtocol)
+	}
+
+	switch strings.ToUpper(c.config.PrivProtocol) {
+	case "":
+	case "DES", "AES":
+		if c.authHash == nil {
+			return fmt.Errorf("snmp privacy requires an auth protocol")
+		}
+		c.securityFlag |= snmpFlagPriv
+	default:
+		return fmt.Errorf("snmp priv protocol %s is currently not supported", c.config.PrivProtocol)
+	}
+
+	// An unauthenticated, empty request gets us a report with the engine details...
+	c.requestID++
+	pdu := berConstruct(snmpGetRequest,
+		berInteger(berTagInteger, int64(c.requestID)),
+		berInteger(berTagInteger, 0),
+		berInteger(berTagInteger, 0),
+		berSequence())
+	message, err := c.encodeV3(c.requestID, pdu, snmpFlagReportable)
+	if err != nil {
+		return err
+	}
+
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	_, err = c.conn.Write(message)
+	if err != nil {
+		return err
+	}
+	buffer := make([]byte, snmpMaxMessageSize)
+	n, err := c.conn.Read(buffer)
+	if err != nil {
+		return fmt.Errorf("error discovering engine id: %s", err)
+	}
+	_, err = c.decodeV3(buffer[:n])
+	if err != nil {
+		return fmt.Errorf("error discovering engine id: %s", err)
+	}
+	if len(c.engineID) < 1 {
+		return fmt.Errorf("error discovering engine id: agent didn't send one")
+	}
+
+	if c.authHash != nil {
+		c.authKey = snmpLocalizedKey(c.config.AuthPassword, c.engineID, c.authHash)
+	}
+	if c.securityFlag&snmpFlagPriv != 0 {
+		c.privKey = snmpLocalizedKey(c.config.PrivPassword, c.engineID, c.authHash)
+		c.privSalt = rand.Uint64()
+	}
+
+	return nil
+}
+
+// snmpLocalizedKey turns a password into a key localized to an engine (RFC 3414 A.2).
+func snmpLocalizedKey(password string, engineID []byte, newHash func() hash.Hash) []byte {
+
+	h := newHash()
+	if len(password) > 0 {
+		buffer := make([]byte, 64)
+		index := 0
+		for count := 0; count < 1048576; count += len(buffer) {
+			for i := range buffer {
+				buffer[i] = password[index%len(password)]
+				index++
+			}
+			h.Write(buffer)
+		}
+	}
+	key := h.Sum(nil)
+
+	h = newHash()
+	h.Write(key)
+	h.Write(engineID)
+	h.Write(key)
+	return h.Sum(nil)
+}
+
+// encodeV3 wraps pdu in a v3 message (encrypting and signing it according to flags).
+func (c *snmpClient) encodeV3(messageID int32, pdu []byte, flags byte) ([]byte, error) {
+
+	engineTime := c.engineTime
+	if !c.discovered.IsZero() {
+		engineTime += int64(time.Since(c.discovered) / time.Second)
+	}
+
+	user := []byte(c.config.Username)
+	if flags&(snmpFlagAuth|snmpFlagPriv) == 0 && len(c.engineID) < 1 {
+		user = nil // Discovery
+	}
+
+	scopedPDU := berSequence(
+		berOctetString(berTagOctetString, c.engineID),
+		berOctetString(berTagOctetString, []byte(c.config.ContextName)),
+		pdu)
+
+	var privParams []byte
+	if flags&snmpFlagPriv != 0 {
+		var err error
+		scopedPDU, privParams, err = c.encrypt(scopedPDU, engineTime)
+		if err != nil {
+			return nil, err
+		}
+		scopedPDU = berOctetString(berTagOctetString, scopedPDU)
+	}
+
+	var authParams []byte
+	if flags&snmpFlagAuth != 0 {
+		authParams = make([]byte, snmpAuthParamLength)
+	}
+
+	securityParams := berSequence(
+		berOctetString(berTagOctetString, c.engineID),
+		berInteger(berTagInteger, c.engineBoots),
+		berInteger(berTagInteger, engineTime),
+		berOctetString(berTagOctetString, user),
+		berOctetString(berTagOctetString, authParams),
+		berOctetString(berTagOctetString, privParams))
+
+	message := berSequence(
+		berInteger(berTagInteger, 3),
+		berSequence(
+			berInteger(berTagInteger, int64(messageID)),
+			berInteger(berTagInteger, snmpMaxMessageSize),
+			berOctetString(berTagOctetString, []byte{flags}),
+			berInteger(berTagInteger, 3)), // User-based security model
+		berOctetString(berTagOctetString, securityParams),
+		scopedPDU)
+
+	// Sign the message (the signature goes where the zeroed auth params are)...
+	if flags&snmpFlagAuth != 0 {
+		_, _, authParams, _, err := splitV3(message)
+		if err != nil {
+			return nil, err
+		}
+		copy(authParams, c.sign(message))
+	}
+
+	return message, nil
+}
+
+// decodeV3 verifies (and decrypts) a v3 message, returning its pdu. Engine details
+// are picked up from every authentic message so we stay in sync with the agent's
+// clock (once we have keys, unauthenticated messages can't move it).
+func (c *snmpClient) decodeV3(message []byte) (berElement, error) {
+
+	flags, securityParams, authParams, data, err := splitV3(message)
+	if err != nil {
+		return berElement{}, err
+	}
+
+	if len(securityParams) < 6 {
+		return berElement{}, fmt.Errorf("malformed security parameters")
+	}
+	engineBoots := securityParams[1].Int()
+	engineTime := securityParams[2].Int()
+
+	// Check the signature...
+	if flags&snmpFlagAuth != 0 {
+		if c.authKey == nil {
+			return berElement{}, fmt.Errorf("unexpected authenticated message")
+		}
+		signature := append([]byte{}, authParams...)
+		for i := range authParams {
+			authParams[i] = 0
+		}
+		if !hmac.Equal(signature, c.sign(message)) {
+			return berElement{}, fmt.Errorf("response failed authentication")
+		}
+	}
+
+	if flags&snmpFlagAuth != 0 || c.authKey == nil {
+		c.engineID = append([]byte{}, securityParams[0].Content...)
+		c.engineBoots = engineBoots
+		c.engineTime = engineTime
+		c.discovered = time.Now()
+	}
+
+	// Decrypt...
+	if flags&snmpFlagPriv != 0 {
+		if data.Tag != berTagOctetString {
+			return berElement{}, fmt.Errorf("malformed encrypted pdu")
+		}
+		plaintext, err := c.decrypt(data.Content, securityParams[5].Content, engineBoots, engineTime)
+		if err != nil {
+			return berElement{}, err
+		}
+		data, _, err = berDecode(plaintext)
+		if err != nil {
+			return berElement{}, fmt.Errorf("error decrypting pdu: %s", err)
+		}
+	}
+
+	scoped, err := berChildren(data.Content)
+	if err != nil || len(scoped) != 3 {
+		return berElement{}, fmt.Errorf("malformed scoped pdu")
+	}
+
+	return scoped[2], nil
+}
+
+// splitV3 breaks a v3 message into its flags, security parameters, auth parameters
+// (which slice into message, so they can be filled in or zeroed in place) and data.
+func splitV3(message []byte) (byte, []berElement, []byte, berElement, error) {
+
+	envelope, _, err := berDecode(message)
+	if err != nil {
+		return 0, nil, nil, berElement{}, err
+	}
+	fields, err := berChildren(envelope.Content)
+	if err != nil || len(fields) != 4 || fields[0].Int() != 3 {
+		return 0, nil, nil, berElement{}, fmt.Errorf("malformed snmp v3 message")
+	}
+
+	header, err := berChildren(fields[1].Content)
+	if err != nil || len(header) != 4 || len(header[2].Content) != 1 {
+		return 0, nil, nil, berElement{}, fmt.Errorf("malformed snmp v3 header")
+	}
+
+	usm, _, err := berDecode(fields[2].Content)
+	if err != nil {
+		return 0, nil, nil, berElement{}, err
+	}
+	securityParams, err := berChildren(usm.Content)
+	if err != nil || len(securityParams) != 6 {
+		return 0, nil, nil, berElement{}, fmt.Errorf("malformed security parameters")
+	}
+
+	return header[2].Content[0], securityParams, securityParams[4].Content, fields[3], nil
+}
+
+func (c *snmpClient) sign(message []byte) []byte {
+	mac := hmac.New(c.authHash, c.authKey)
+	mac.Write(message)
+	return mac.Sum(nil)[:snmpAuthParamLength]
+}
+
+// encrypt encrypts a scoped pdu with DES-CBC (RFC 3414 8.1.1) or AES-128-CFB
+// (RFC 3826 3.1.2), returning the ciphertext and the salt to send along with it.
+func (c *snmpClient) encrypt(plaintext []byte, engineTime int64) ([]byte, []byte, error) {
+
+	c.privSalt++
+	salt := make([]byte, 8)
+
+	if strings.ToUpper(c.config.PrivProtocol) == "DES" {
+		binary.BigEndian.PutUint32(salt, uint32(c.engineBoots))
+		binary.BigEndian.PutUint32(salt[4:], uint32(c.privSalt))
+
+		block, err := des.NewCipher(c.privKey[:8])
+		if err != nil {
+			return nil, nil, err
+		}
+		iv := make([]byte, 8)
+		for i := range iv {
+			iv[i] = c.privKey[8+i] ^ salt[i]
+		}
+		if padding := len(plaintext) % 8; padding != 0 {
+			plaintext = append(plaintext, make([]byte, 8-padding)...)
+		}
+		ciphertext := make([]byte, len(plaintext))
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+		return ciphertext, salt, nil
+	}
+
+	binary.BigEndian.PutUint64(salt, c.privSalt)
+	block, err := aes.NewCipher(c.privKey[:16])
+	if err != nil {
+		return nil, nil, err
+	}
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCFBEncrypter(block, snmpAESIV(c.engineBoots, engineTime, salt)).XORKeyStream(ciphertext, plaintext)
+	return ciphertext, salt, nil
+}
+
+func (c *snmpClient) decrypt(ciphertext []byte, salt []byte, engineBoots int64, engineTime int64) ([]byte, error) {
+
+	if len(salt) != 8 {
+		return nil, fmt.Errorf("malformed privacy parameters")
+	}
+
+	if strings.ToUpper(c.config.PrivProtocol) == "DES" {
+		if len(ciphertext)%8 != 0 {
+			return nil, fmt.Errorf("malformed encrypted pdu")
+		}
+		block, err := des.NewCipher(c.privKey[:8])
+		if err != nil {
+			return nil, err
+		}
+		iv := make([]byte, 8)
+		for i := range iv {
+			iv[i] = c.privKey[8+i] ^ salt[i]
+		}
+		plaintext := make([]byte, len(ciphertext))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+		return plaintext, nil
+	}
+
+	block, err := aes.NewCipher(c.privKey[:16])
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCFBDecrypter(block, snmpAESIV(engineBoots, engineTime, salt)).XORKeyStream(plaintext, ciphertext)
+	return plaintext, nil
+}
+
+func snmpAESIV(engineBoots int64, engineTime int64, salt []byte) []byte {
+	iv := make([]byte, 16)
+	binary.BigEndian.PutUint32(iv, uint32(engineBoots))
+	binary.BigEndian.PutUint32(iv[4:], uint32(engineTime))
+	copy(iv[8:], salt)
+	return iv
+}
@@ -0,0 +1,572 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"hash"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// snmpTestAgent is a tiny in-process agent that answers get and get-bulk requests for a
+// fixed set of variables, over v2c or v3 (using its own client-side codec for the usm
+// signing and encryption, keyed to the agent's engine).
+type snmpTestAgent struct {
+	conn      net.PacketConn
+	community string
+	engineID  []byte
+	codec     *snmpClient
+	values    map[string][]byte // Oid to encoded value
+}
+
+func newSNMPTestAgent(t *testing.T, config ConfigMetricSNMP, values map[string][]byte) *snmpTestAgent {
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &snmpTestAgent{
+		conn:      conn,
+		community: config.Community,
+		engineID:  []byte{0x80, 0x00, 0x1f, 0x88, 0x04, 't', 'e', 's', 't'},
+		values:    values,
+	}
+
+	// The agent's codec is the same usm code the client uses, seen from the agent's side...
+	a.codec = &snmpClient{
+		config:      &config,
+		engineID:    a.engineID,
+		engineBoots: 7,
+		engineTime:  1000,
+		discovered:  time.Now(),
+	}
+	switch strings.ToUpper(config.AuthProtocol) {
+	case "MD5":
+		a.codec.authHash = md5.New
+	case "SHA":
+		a.codec.authHash = sha1.New
+	}
+	if a.codec.authHash != nil {
+		a.codec.authKey = snmpLocalizedKey(config.AuthPassword, a.engineID, a.codec.authHash)
+		if len(config.PrivProtocol) > 0 {
+			a.codec.privKey = snmpLocalizedKey(config.PrivPassword, a.engineID, a.codec.authHash)
+		}
+	}
+
+	go a.serve()
+	return a
+}
+
+func (a *snmpTestAgent) port() int {
+	return a.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func (a *snmpTestAgent) close() {
+	a.conn.Close()
+}
+
+func (a *snmpTestAgent) serve() {
+	buffer := make([]byte, snmpMaxMessageSize)
+	for {
+		n, addr, err := a.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		message := append([]byte{}, buffer[:n]...)
+
+		envelope, _, err := berDecode(message)
+		if err != nil {
+			continue
+		}
+		fields, err := berChildren(envelope.Content)
+		if err != nil || len(fields) < 3 {
+			continue
+		}
+
+		var response []byte
+		if fields[0].Int() == 1 {
+			response = a.handleV2c(fields)
+		} else {
+			response = a.handleV3(message)
+		}
+		if response != nil {
+			a.conn.WriteTo(response, addr)
+		}
+	}
+}
+
+func (a *snmpTestAgent) handleV2c(fields []berElement) []byte {
+	if string(fields[1].Content) != a.community {
+		return nil // Real agents stay quiet about bad communities too
+	}
+	return berSequence(
+		berInteger(berTagInteger, 1),
+		berOctetString(berTagOctetString, fields[1].Content),
+		a.respond(fields[2]))
+}
+
+func (a *snmpTestAgent) handleV3(message []byte) []byte {
+
+	flags, securityParams, authParams, data, err := splitV3(message)
+	if err != nil {
+		return nil
+	}
+	envelope, _, _ := berDecode(message)
+	fields, _ := berChildren(envelope.Content)
+	header, _ := berChildren(fields[1].Content)
+	messageID := int32(header[0].Int())
+
+	// Discovery gets an unauthenticated report carrying our engine details...
+	if len(securityParams[0].Content) < 1 {
+		return a.report(messageID, "1.3.6.1.6.3.15.1.1.4.0", 0)
+	}
+
+	if flags&snmpFlagAuth != 0 {
+		signature := append([]byte{}, authParams...)
+		for i := range authParams {
+			authParams[i] = 0
+		}
+		if a.codec.authKey == nil || !bytes.Equal(signature, a.codec.sign(message)) {
+			return a.report(messageID, "1.3.6.1.6.3.15.1.1.5.0", 0)
+		}
+	}
+	if flags&snmpFlagPriv != 0 {
+		plaintext, err := a.codec.decrypt(data.Content, securityParams[5].Content, securityParams[1].Int(), securityParams[2].Int())
+		if err != nil {
+			return nil
+		}
+		data, _, err = berDecode(plaintext)
+		if err != nil {
+			return a.report(messageID, "1.3.6.1.6.3.15.1.1.6.0", flags&snmpFlagAuth)
+		}
+	}
+
+	scoped, err := berChildren(data.Content)
+	if err != nil || len(scoped) != 3 {
+		return a.report(messageID, "1.3.6.1.6.3.15.1.1.6.0", flags&snmpFlagAuth)
+	}
+
+	response, err := a.codec.encodeV3(messageID, a.respond(scoped[2]), flags&(snmpFlagAuth|snmpFlagPriv))
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+func (a *snmpTestAgent) report(messageID int32, oid string, flags byte) []byte {
+	encodedOID, _ := berOID(oid)
+	pdu := berConstruct(snmpReport,
+		berInteger(berTagInteger, int64(messageID)),
+		berInteger(berTagInteger, 0),
+		berInteger(berTagInteger, 0),
+		berSequence(berSequence(encodedOID, berUnsigned(snmpCounter32, 1))))
+	report, _ := a.codec.encodeV3(messageID, pdu, flags)
+	return report
+}
+
+// respond answers a get or get-bulk pdu.
+func (a *snmpTestAgent) respond(request berElement) []byte {
+
+	fields, _ := berChildren(request.Content)
+	varbinds, _ := berChildren(fields[3].Content)
+
+	var oids []string
+	for _, varbind := range varbinds {
+		parts, _ := berChildren(varbind.Content)
+		oids = append(oids, parts[0].OID())
+	}
+
+	var responses [][]byte
+	switch request.Tag {
+	case snmpGetRequest:
+		for _, oid := range oids {
+			value, ok := a.values[oid]
+			if !ok {
+				value = berEncode(snmpNoSuchInstance, nil)
+			}
+			encodedOID, _ := berOID(oid)
+			responses = append(responses, berSequence(encodedOID, value))
+		}
+
+	case snmpGetBulkRequest:
+		sorted := make([]string, 0, len(a.values))
+		for oid := range a.values {
+			sorted = append(sorted, oid)
+		}
+		sort.Slice(sorted, func(i, j int) bool { return snmpTestOIDLess(sorted[i], sorted[j]) })
+
+		next := oids[0]
+		for i := 0; i < int(fields[2].Int()); i++ {
+			index := sort.Search(len(sorted), func(j int) bool { return snmpTestOIDLess(next, sorted[j]) })
+			encodedOID, _ := berOID(next)
+			if index >= len(sorted) {
+				responses = append(responses, berSequence(encodedOID, berEncode(snmpEndOfMibView, nil)))
+				break
+			}
+			next = sorted[index]
+			encodedOID, _ = berOID(next)
+			responses = append(responses, berSequence(encodedOID, a.values[next]))
+		}
+	}
+
+	return berConstruct(snmpGetResponse,
+		berInteger(berTagInteger, fields[0].Int()),
+		berInteger(berTagInteger, 0),
+		berInteger(berTagInteger, 0),
+		berSequence(responses...))
+}
+
+func snmpTestOIDLess(a string, b string) bool {
+	aArcs, bArcs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(aArcs) && i < len(bArcs); i++ {
+		aArc, _ := strconv.ParseUint(aArcs[i], 10, 64)
+		bArc, _ := strconv.ParseUint(bArcs[i], 10, 64)
+		if aArc != bArc {
+			return aArc < bArc
+		}
+	}
+	return len(aArcs) < len(bArcs)
+}
+
+func snmpTestValues() map[string][]byte {
+	return map[string][]byte{
+		"1.3.6.1.2.1.1.3.0":           berUnsigned(snmpTimeTicks, 123456),
+		"1.3.6.1.2.1.1.7.0":           berInteger(berTagInteger, -72),
+		"1.3.6.1.4.1.318.1.1.1.2.2.1": berOctetString(berTagOctetString, []byte(" 98.5 ")),
+		"1.3.6.1.2.1.2.2.1.10.1":      berUnsigned(snmpCounter32, 4294967000),
+		"1.3.6.1.2.1.2.2.1.10.2":      berUnsigned(snmpCounter32, 10),
+		"1.3.6.1.2.1.25.2.3.1.6.1":    berUnsigned(snmpGauge32, 4000000000),
+	}
+}
+
+func snmpTestMetric(config ConfigMetricSNMP, port int) *ConfigMetric {
+	config.Host = "127.0.0.1"
+	config.Port = port
+	return &ConfigMetric{
+		Type:    "snmp",
+		Name:    "test",
+		Timeout: Duration{time.Second},
+		SNMP:    config,
+	}
+}
+
+func TestQuerySNMPMetricV2c(t *testing.T) {
+
+	config := ConfigMetricSNMP{
+		Version:   "2c",
+		Community: "secret",
+		Get: map[string]string{
+			"uptime":   ".1.3.6.1.2.1.1.3.0",
+			"services": "1.3.6.1.2.1.1.7.0",
+			"battery":  "1.3.6.1.4.1.318.1.1.1.2.2.1",
+			"used":     "1.3.6.1.2.1.25.2.3.1.6.1",
+		},
+		Walk: map[string]string{
+			"octets": "1.3.6.1.2.1.2.2.1.10",
+		},
+	}
+	agent := newSNMPTestAgent(t, config, snmpTestValues())
+	defer agent.close()
+
+	counters := SNMPCounters{}
+	result, err := QuerySNMPMetric(snmpTestMetric(config, agent.port()), counters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Valid {
+		t.Errorf("expected a valid result, got errors %v", result.Errors)
+	}
+
+	expected := map[string]float64{"uptime": 123456, "services": -72, "battery": 98.5, "used": 4000000000}
+	for name, value := range expected {
+		if result.Values[name] != value {
+			t.Errorf("expected %s to be %v, got %v", name, value, result.Values[name])
+		}
+	}
+
+	// Counters only have a value from the second poll on...
+	if _, ok := result.Values["octets.1"]; ok {
+		t.Errorf("expected no rate for octets.1 on the first poll")
+	}
+	if counters["octets.1"].Value != 4294967000 || counters["octets.2"].Value != 10 {
+		t.Errorf("expected both walked counters to be remembered, got %v", counters)
+	}
+}
+
+func TestQuerySNMPMetricMissingOID(t *testing.T) {
+
+	config := ConfigMetricSNMP{
+		Version:   "2c",
+		Community: "public",
+		Get:       map[string]string{"missing": "1.3.6.1.2.1.1.99.0"},
+	}
+	agent := newSNMPTestAgent(t, config, snmpTestValues())
+	defer agent.close()
+
+	result, err := QuerySNMPMetric(snmpTestMetric(config, agent.port()), SNMPCounters{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Valid || len(result.Errors) != 1 {
+		t.Errorf("expected an invalid result with one error, got %v %v", result.Valid, result.Errors)
+	}
+}
+
+func TestQuerySNMPMetricV3(t *testing.T) {
+
+	levels := []ConfigMetricSNMP{
+		{AuthProtocol: "MD5", AuthPassword: "maplesyrup"},
+		{AuthProtocol: "SHA", AuthPassword: "maplesyrup", PrivProtocol: "DES", PrivPassword: "pancakes!"},
+		{AuthProtocol: "SHA", AuthPassword: "maplesyrup", PrivProtocol: "AES", PrivPassword: "pancakes!"},
+	}
+	for _, config := range levels {
+		config.Version = "3"
+		config.Username = "runner"
+		config.Get = map[string]string{"uptime": "1.3.6.1.2.1.1.3.0"}
+		config.Walk = map[string]string{"octets": "1.3.6.1.2.1.2.2.1.10"}
+
+		agent := newSNMPTestAgent(t, config, snmpTestValues())
+
+		result, err := QuerySNMPMetric(snmpTestMetric(config, agent.port()), SNMPCounters{})
+		if err != nil {
+			t.Errorf("%s/%s: %s", config.AuthProtocol, config.PrivProtocol, err)
+		} else if result.Values["uptime"] != 123456 || !result.Valid {
+			t.Errorf("%s/%s: unexpected result %+v", config.AuthProtocol, config.PrivProtocol, result)
+		}
+
+		// A wrong password is reported by the agent as a wrong digest...
+		wrong := config
+		wrong.AuthPassword = "pancakes?"
+		_, err = QuerySNMPMetric(snmpTestMetric(wrong, agent.port()), SNMPCounters{})
+		if err == nil || !strings.Contains(err.Error(), "wrong digest") {
+			t.Errorf("%s/%s: expected a wrong digest error, got %v", config.AuthProtocol, config.PrivProtocol, err)
+		}
+
+		agent.close()
+	}
+}
+
+func TestSNMPUnauthenticatedEngineChange(t *testing.T) {
+
+	config := ConfigMetricSNMP{Version: "3", Username: "runner", AuthProtocol: "SHA", AuthPassword: "maplesyrup"}
+	agent := newSNMPTestAgent(t, config, snmpTestValues())
+	defer agent.close()
+
+	client, err := newSNMPClient(snmpTestMetric(config, agent.port()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.close()
+
+	// Anyone can send an unauthenticated message claiming a new engine, it mustn't stick...
+	forger := &snmpClient{config: &config, engineID: []byte("forged"), engineBoots: 99, engineTime: 5}
+	pdu := berConstruct(snmpReport,
+		berInteger(berTagInteger, 1),
+		berInteger(berTagInteger, 0),
+		berInteger(berTagInteger, 0),
+		berSequence())
+	message, err := forger.encodeV3(1, pdu, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.decodeV3(message)
+
+	if !bytes.Equal(client.engineID, agent.engineID) || client.engineBoots != 7 {
+		t.Errorf("expected engine %x (boots 7), got %x (boots %d)", agent.engineID, client.engineID, client.engineBoots)
+	}
+	variables, err := client.get([]string{"1.3.6.1.2.1.1.3.0"})
+	if err != nil || len(variables) != 1 {
+		t.Errorf("expected the client to still work, got %v %v", variables, err)
+	}
+}
+
+func TestSNMPLocalizedKey(t *testing.T) {
+
+	// RFC 3414 A.3.1 and A.3.2...
+	engineID, _ := hex.DecodeString("000000000000000000000002")
+	md5Key := hex.EncodeToString(snmpLocalizedKey("maplesyrup", engineID, md5.New))
+	if md5Key != "526f5eed9fcce26f8964c2930787d82b" {
+		t.Errorf("unexpected md5 key %s", md5Key)
+	}
+	shaKey := hex.EncodeToString(snmpLocalizedKey("maplesyrup", engineID, sha1.New))
+	if shaKey != "6695febc9288e36282235fc7151f128497b38f3f" {
+		t.Errorf("unexpected sha key %s", shaKey)
+	}
+}
+
+func TestSNMPCounterRateWraparound(t *testing.T) {
+
+	now := time.Now()
+	tests := []struct {
+		previous SNMPCounterSample
+		current  SNMPCounterSample
+		rate     float64
+	}{
+		{
+			SNMPCounterSample{Value: 100, Type: snmpCounter32, Time: now.Add(-10 * time.Second)},
+			SNMPCounterSample{Value: 600, Type: snmpCounter32, Time: now},
+			50,
+		},
+		{
+			SNMPCounterSample{Value: math.MaxUint32 - 99, Type: snmpCounter32, Time: now.Add(-10 * time.Second)},
+			SNMPCounterSample{Value: 400, Type: snmpCounter32, Time: now},
+			50,
+		},
+		{
+			SNMPCounterSample{Value: math.MaxUint64 - 199, Type: snmpCounter64, Time: now.Add(-4 * time.Second)},
+			SNMPCounterSample{Value: 200, Type: snmpCounter64, Time: now},
+			100,
+		},
+	}
+	for _, test := range tests {
+		if rate := snmpCounterRate(test.previous, test.current); rate != test.rate {
+			t.Errorf("expected %v -> %v to be %v/s, got %v", test.previous.Value, test.current.Value, test.rate, rate)
+		}
+	}
+}
+
+func TestQuerySNMPMetricCounterWraparound(t *testing.T) {
+
+	config := ConfigMetricSNMP{
+		Version:   "2c",
+		Community: "public",
+		Get:       map[string]string{"octets": "1.3.6.1.2.1.2.2.1.10.1"},
+	}
+	values := snmpTestValues()
+	values["1.3.6.1.2.1.2.2.1.10.1"] = berUnsigned(snmpCounter32, 704)
+	agent := newSNMPTestAgent(t, config, values)
+	defer agent.close()
+
+	// The previous poll (ten seconds ago) was just short of the counter wrapping...
+	counters := SNMPCounters{
+		"octets": {Value: 4294967000, Type: snmpCounter32, Time: time.Now().Add(-10 * time.Second)},
+	}
+	result, err := QuerySNMPMetric(snmpTestMetric(config, agent.port()), counters)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rate, ok := result.Values["octets"]
+	if !ok || rate < 99 || rate > 100.1 {
+		t.Errorf("expected a rate of about 100/s across the wrap, got %v", rate)
+	}
+	if counters["octets"].Value != 704 {
+		t.Errorf("expected the counter to be remembered, got %v", counters["octets"])
+	}
+}
+
+func TestQuerySNMPMetricCounterRestart(t *testing.T) {
+
+	config := ConfigMetricSNMP{
+		Version:   "2c",
+		Community: "public",
+		Get:       map[string]string{"octets": "1.3.6.1.2.1.2.2.1.10.1"},
+	}
+	values := snmpTestValues()
+	values["1.3.6.1.2.1.2.2.1.10.1"] = berUnsigned(snmpCounter32, 1704)
+	agent := newSNMPTestAgent(t, config, values)
+	defer agent.close()
+
+	for _, test := range []struct {
+		name   string
+		uptime uint64
+		rate   bool
+	}{
+		{"running", 120456, true},
+		{"restarted", 9000000, false}, // sysUpTime is now 123456, so the counter started over
+		{"uptime unknown", 0, true},
+	} {
+		counters := SNMPCounters{
+			"octets": {Value: 704, Type: snmpCounter32, Time: time.Now().Add(-10 * time.Second), Uptime: test.uptime},
+		}
+		result, err := QuerySNMPMetric(snmpTestMetric(config, agent.port()), counters)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rate, ok := result.Values["octets"]
+		if ok != test.rate || (ok && (rate < 99 || rate > 100.1)) {
+			t.Errorf("%s: expected a rate (%v) of about 100/s, got %v", test.name, test.rate, rate)
+		}
+		if counters["octets"].Value != 1704 || counters["octets"].Uptime != 123456 {
+			t.Errorf("%s: expected the counter and uptime to be remembered, got %v", test.name, counters["octets"])
+		}
+	}
+}
+
+func TestSNMPUSMVectors(t *testing.T) {
+
+	// A get of sysUpTime scoped to RFC 3414 A.3's engine, signed and encrypted with keys from
+	// A.3.1 and A.3.2 ("maplesyrup"). The expected values come from python's hmac and openssl
+	// (des-cbc and aes-128-cfb) following RFC 3414 6 and 8 and RFC 3826 3, not from this codec...
+	engineID, _ := hex.DecodeString("000000000000000000000002")
+	plaintext, _ := hex.DecodeString("302b040c0000000000000000000000020400a019020101020100020100300e300c06082b060102010103000500")
+
+	for _, test := range []struct {
+		authProtocol string
+		authHash     func() hash.Hash
+		digest       string
+	}{
+		{"MD5", md5.New, "29b2e8633d68b43c0dc72024"},
+		{"SHA", sha1.New, "981bb753047e0aea9d8a5c8e"},
+	} {
+		c := &snmpClient{authHash: test.authHash, authKey: snmpLocalizedKey("maplesyrup", engineID, test.authHash)}
+		if digest := hex.EncodeToString(c.sign(plaintext)); digest != test.digest {
+			t.Errorf("%s: expected digest %s, got %s", test.authProtocol, test.digest, digest)
+		}
+	}
+
+	for _, test := range []struct {
+		privProtocol string
+		salt         string
+		ciphertext   string
+	}{
+		{"DES", "000000070000000b", "471bf0d4c124935ba5798f3829fed6a55bc8cf8473f435fbc8cf0c65d1a7d65015b46cf46c433d19a40eb0add187f3a8"},
+		{"AES", "000000000000000b", "cf7be46866adacc49d83f71949fdd59cb7b27504346ae2c9f0b2bd60b18413022f42e32313f5c6326e1841c31e"},
+	} {
+		c := &snmpClient{
+			config:      &ConfigMetricSNMP{PrivProtocol: test.privProtocol},
+			privKey:     snmpLocalizedKey("maplesyrup", engineID, sha1.New),
+			privSalt:    10,
+			engineBoots: 7,
+		}
+		ciphertext, salt, err := c.encrypt(append([]byte{}, plaintext...), 12345)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(salt) != test.salt || hex.EncodeToString(ciphertext) != test.ciphertext {
+			t.Errorf("%s: expected %s (salt %s), got %x (salt %x)", test.privProtocol, test.ciphertext, test.salt, ciphertext, salt)
+		}
+
+		// DES pads to its block size (the scoped pdu's own length tells the agent where it ends)...
+		expected, _ := hex.DecodeString(test.ciphertext)
+		decrypted, err := c.decrypt(expected, salt, 7, 12345)
+		if err != nil || !bytes.Equal(decrypted[:len(plaintext)], plaintext) {
+			t.Errorf("%s: expected %x decrypted, got %x (%v)", test.privProtocol, plaintext, decrypted, err)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type TSDBResult struct {
+	Elapsed time.Duration
+	Value   float64 // The reduced value (only meaningful when there's data)
+	NoData  bool    // The query came back empty (or all nulls)
+	Series  int
+	Valid   bool
+}
+
+// tsdbPoint is a single (non-null) value from a query result.
+type tsdbPoint struct {
+	Time  float64
+	Value float64
+}
+
+// QueryTSDBMetric runs a graphite target or promql instant query against the metric's url,
+// reduces whatever comes back to a single value and checks it against the thresholds.
+func QueryTSDBMetric(metric *ConfigMetric) (*TSDBResult, error) {
+
+	// We can only query metrics of tsdb-query type...
+	if metric.Type != "tsdb-query" {
+		return nil, fmt.Errorf("cannot query metric type %s via tsdb-query", metric.Type)
+	}
+
+	var elapsed time.Duration
+	var series [][]tsdbPoint
+	var err error
+	switch metric.TSDB.Backend {
+	case "graphite":
+		elapsed, series, err = queryGraphite(metric)
+	case "prometheus":
+		elapsed, series, err = queryPrometheus(metric)
+	default:
+		return nil, fmt.Errorf("tsdb backend %s is currently not supported", metric.TSDB.Backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := &TSDBResult{Elapsed: elapsed, Series: len(series)}
+
+	value, ok, err := reduceTSDBPoints(series, metric.TSDB.Reduce)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		result.NoData = true
+		result.Valid = metric.TSDB.NoDataValid
+		return result, nil
+	}
+
+	result.Value = value
+	result.Valid = (metric.TSDB.Min == nil || value >= *metric.TSDB.Min) &&
+		(metric.TSDB.Max == nil || value <= *metric.TSDB.Max)
+
+	return result, nil
+}
+
+// reduceTSDBPoints reduces every point across every series to one value (returning false
+// if there weren't any). For last, that's the most recent point.
+func reduceTSDBPoints(series [][]tsdbPoint, reduce string) (float64, bool, error) {
+
+	count := 0
+	var value, sum float64
+	var latest float64
+	for _, points := range series {
+		for _, point := range points {
+			switch reduce {
+			case "last":
+				if count == 0 || point.Time >= latest {
+					value, latest = point.Value, point.Time
+				}
+			case "avg", "sum":
+				sum += point.Value
+			case "max":
+				if count == 0 || point.Value > value {
+					value = point.Value
+				}
+			case "min":
+				if count == 0 || point.Value < value {
+					value = point.Value
+				}
+			default:
+				return 0, false, fmt.Errorf("reduce %s is currently not supported", reduce)
+			}
+			count++
+		}
+	}
+
+	if count == 0 {
+		return 0, false, nil
+	}
+	switch reduce {
+	case "avg":
+		value = sum / float64(count)
+	case "sum":
+		value = sum
+	}
+	return value, true, nil
+}
+
+func tsdbGet(metric *ConfigMetric, rawURL string) (time.Duration, []byte, error) {
+
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	elapsed, res, body, err := sendHTTPRequest(metric, req)
+	if err != nil {
+		return 0, nil, err
+	}
+	if res.StatusCode != 200 {
+		return 0, nil, fmt.Errorf("unexpected status code %d: %.256s", res.StatusCode, body)
+	}
+
+	return elapsed, body, nil
+}
+
+func queryGraphite(metric *ConfigMetric) (time.Duration, [][]tsdbPoint, error) {
+
+	query := url.Values{}
+	query.Set("target", metric.TSDB.Query)
+	query.Set("format", "json")
+	query.Set("from", metric.TSDB.From)
+
+	elapsed, body, err := tsdbGet(metric, strings.TrimSuffix(metric.URL, "/")+"/render?"+query.Encode())
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// e.g. [{"target": "errors", "datapoints": [[1.0, 1554000000], [null, 1554000060]]}]...
+	var response []struct {
+		Target     string       `json:"target"`
+		Datapoints [][]*float64 `json:"datapoints"`
+	}
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error parsing render response: %s", err)
+	}
+
+	var series [][]tsdbPoint
+	for _, s := range response {
+		var points []tsdbPoint
+		for _, datapoint := range s.Datapoints {
+			if len(datapoint) != 2 || datapoint[0] == nil || datapoint[1] == nil {
+				continue // Graphite fills gaps with nulls
+			}
+			points = append(points, tsdbPoint{Time: *datapoint[1], Value: *datapoint[0]})
+		}
+		series = append(series, points)
+	}
+
+	return elapsed, series, nil
+}
+
+func queryPrometheus(metric *ConfigMetric) (time.Duration, [][]tsdbPoint, error) {
+
+	query := url.Values{}
+	query.Set("query", metric.TSDB.Query)
+
+	elapsed, body, err := tsdbGet(metric, strings.TrimSuffix(metric.URL, "/")+"/api/v1/query?"+query.Encode())
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var response struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Data   struct {
+			ResultType string          `json:"resultType"`
+			Result     json.RawMessage `json:"result"`
+		} `json:"data"`
+	}
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error parsing query response: %s", err)
+	}
+	if response.Status != "success" {
+		return 0, nil, fmt.Errorf("query failed: %s", response.Error)
+	}
+
+	var series [][]tsdbPoint
+	switch response.Data.ResultType {
+	case "scalar":
+		// e.g. [1554000000, "1.5"]...
+		var sample []interface{}
+		err = json.Unmarshal(response.Data.Result, &sample)
+		if err != nil {
+			return 0, nil, fmt.Errorf("error parsing scalar result: %s", err)
+		}
+		series = append(series, prometheusPoints([][]interface{}{sample}))
+
+	case "vector", "matrix":
+		// e.g. [{"metric": {...}, "value": [1554000000, "1.5"]}] (or "values" for a matrix)...
+		var results []struct {
+			Value  []interface{}   `json:"value"`
+			Values [][]interface{} `json:"values"`
+		}
+		err = json.Unmarshal(response.Data.Result, &results)
+		if err != nil {
+			return 0, nil, fmt.Errorf("error parsing %s result: %s", response.Data.ResultType, err)
+		}
+		for _, result := range results {
+			if result.Value != nil {
+				series = append(series, prometheusPoints([][]interface{}{result.Value}))
+			} else {
+				series = append(series, prometheusPoints(result.Values))
+			}
+		}
+
+	default:
+		return 0, nil, fmt.Errorf("result type %s is currently not supported", response.Data.ResultType)
+	}
+
+	return elapsed, series, nil
+}
+
+// prometheusPoints converts [time, "value"] samples (skipping NaNs, which we treat like
+// graphite's nulls).
+func prometheusPoints(samples [][]interface{}) []tsdbPoint {
+	var points []tsdbPoint
+	for _, sample := range samples {
+		if len(sample) != 2 {
+			continue
+		}
+		t, ok := sample[0].(float64)
+		raw, isString := sample[1].(string)
+		if !ok || !isString {
+			continue
+		}
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil || math.IsNaN(value) {
+			continue
+		}
+		points = append(points, tsdbPoint{Time: t, Value: value})
+	}
+	return points
+}
@@ -0,0 +1,236 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReduceTSDBPoints(t *testing.T) {
+
+	series := [][]tsdbPoint{
+		{{Time: 100, Value: 4}, {Time: 160, Value: -2}},
+		{},
+		{{Time: 130, Value: 10}, {Time: 220, Value: 3}, {Time: 190, Value: 7}}, // Not necessarily in order
+	}
+
+	for _, test := range []struct {
+		reduce string
+		series [][]tsdbPoint
+		value  float64
+		ok     bool
+	}{
+		{"last", series, 3, true},
+		{"avg", series, 4.4, true},
+		{"max", series, 10, true},
+		{"min", series, -2, true},
+		{"sum", series, 22, true},
+		{"max", [][]tsdbPoint{{{Time: 1, Value: -5}, {Time: 2, Value: -3}}}, -3, true},
+		{"min", [][]tsdbPoint{{{Time: 1, Value: 5}, {Time: 2, Value: 3}}}, 3, true},
+		{"last", [][]tsdbPoint{{{Time: 1, Value: 5}}, {{Time: 1, Value: 6}}}, 6, true}, // Ties go to the later series
+		{"sum", [][]tsdbPoint{{{Time: 1, Value: 0}}}, 0, true},
+
+		// Nothing (graphite's nulls and prometheus' NaNs never make it this far)...
+		{"last", nil, 0, false},
+		{"avg", [][]tsdbPoint{{}, nil}, 0, false},
+		{"sum", [][]tsdbPoint{{}}, 0, false},
+	} {
+		value, ok, err := reduceTSDBPoints(test.series, test.reduce)
+		if err != nil {
+			t.Errorf("%s of %v: %s", test.reduce, test.series, err)
+			continue
+		}
+		if value != test.value || ok != test.ok {
+			t.Errorf("%s of %v: expected %v (%v), got %v (%v)", test.reduce, test.series, test.value, test.ok, value, ok)
+		}
+	}
+
+	if _, _, err := reduceTSDBPoints(series, "median"); err == nil {
+		t.Errorf("expected an unsupported reduce to fail")
+	}
+}
+
+// tsdbTestServer answers every request with body (after checking it was sent query).
+func tsdbTestServer(t *testing.T, path string, query url.Values, status int, body string) *ConfigMetric {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path || !reflect.DeepEqual(r.URL.Query(), query) {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(server.Close)
+
+	return &ConfigMetric{
+		Type:    "tsdb-query",
+		Name:    "tsdb",
+		URL:     server.URL + "/",
+		Timeout: Duration{5 * time.Second},
+		TSDB:    ConfigMetricTSDB{Backend: "graphite", Query: "sumSeries(app.*.errors)", From: "-10min", Reduce: "last"},
+	}
+}
+
+func TestQueryGraphite(t *testing.T) {
+
+	query := url.Values{"target": {"sumSeries(app.*.errors)"}, "format": {"json"}, "from": {"-10min"}}
+	for _, test := range []struct {
+		name   string
+		status int
+		body   string
+		series [][]tsdbPoint
+		err    string
+	}{
+		{
+			name:   "series",
+			status: 200,
+			body: `[{"target": "a", "datapoints": [[1.5, 1554000000], [null, 1554000060], [2, 1554000120]]},
+				{"target": "b", "datapoints": [[null, 1554000000], [3, null], [4]]}]`,
+			series: [][]tsdbPoint{{{Time: 1554000000, Value: 1.5}, {Time: 1554000120, Value: 2}}, nil},
+		},
+		{
+			name:   "empty",
+			status: 200,
+			body:   `[]`,
+		},
+		{
+			name:   "not json",
+			status: 200,
+			body:   `<html>`,
+			err:    "error parsing render response",
+		},
+		{
+			name:   "error",
+			status: 500,
+			body:   `Traceback (most recent call last)`,
+			err:    "unexpected status code 500: Traceback (most recent call last)",
+		},
+	} {
+		metric := tsdbTestServer(t, "/render", query, test.status, test.body)
+		_, series, err := queryGraphite(metric)
+		if len(test.err) > 0 {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(series, test.series) {
+			t.Errorf("%s: expected %v, got %v (%v)", test.name, test.series, series, err)
+		}
+	}
+}
+
+func TestQueryPrometheus(t *testing.T) {
+
+	query := url.Values{"query": {"sumSeries(app.*.errors)"}}
+	for _, test := range []struct {
+		name   string
+		body   string
+		series [][]tsdbPoint
+		err    string
+	}{
+		{
+			name:   "scalar",
+			body:   `{"status": "success", "data": {"resultType": "scalar", "result": [1554000000.5, "1.5"]}}`,
+			series: [][]tsdbPoint{{{Time: 1554000000.5, Value: 1.5}}},
+		},
+		{
+			name: "vector",
+			body: `{"status": "success", "data": {"resultType": "vector", "result": [
+				{"metric": {"job": "a"}, "value": [1554000000, "2"]},
+				{"metric": {"job": "b"}, "value": [1554000000, "NaN"]},
+				{"metric": {"job": "c"}, "value": [1554000000, "+Inf"]}]}}`,
+			series: [][]tsdbPoint{{{Time: 1554000000, Value: 2}}, nil, {{Time: 1554000000, Value: math.Inf(1)}}},
+		},
+		{
+			name: "matrix",
+			body: `{"status": "success", "data": {"resultType": "matrix", "result": [
+				{"metric": {}, "values": [[1554000000, "1"], [1554000060, "NaN"], [1554000120, "3"], [1554000180, 4]]}]}}`,
+			series: [][]tsdbPoint{{{Time: 1554000000, Value: 1}, {Time: 1554000120, Value: 3}}},
+		},
+		{
+			name: "empty",
+			body: `{"status": "success", "data": {"resultType": "vector", "result": []}}`,
+		},
+		{
+			name: "failed",
+			body: `{"status": "error", "errorType": "bad_data", "error": "parse error at char 4"}`,
+			err:  "query failed: parse error at char 4",
+		},
+		{
+			name: "string",
+			body: `{"status": "success", "data": {"resultType": "string", "result": [1554000000, "x"]}}`,
+			err:  "result type string is currently not supported",
+		},
+	} {
+		metric := tsdbTestServer(t, "/api/v1/query", query, 200, test.body)
+		_, series, err := queryPrometheus(metric)
+		if len(test.err) > 0 {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(series, test.series) {
+			t.Errorf("%s: expected %v, got %v (%v)", test.name, test.series, series, err)
+		}
+	}
+}
+
+func TestQueryTSDBMetric(t *testing.T) {
+
+	min, max := 1.0, 10.0
+	body := `[{"target": "a", "datapoints": [[5, 1554000000], [12, 1554000060], [null, 1554000120]]}]`
+	empty := `[{"target": "a", "datapoints": [[null, 1554000000]]}]`
+	query := url.Values{"target": {"sumSeries(app.*.errors)"}, "format": {"json"}, "from": {"-10min"}}
+
+	for _, test := range []struct {
+		body        string
+		reduce      string
+		noDataValid bool
+		value       float64
+		noData      bool
+		valid       bool
+	}{
+		{body, "last", false, 12, false, false},
+		{body, "min", false, 5, false, true},
+		{body, "avg", false, 8.5, false, true},
+		{empty, "last", false, 0, true, false},
+		{empty, "last", true, 0, true, true},
+	} {
+		metric := tsdbTestServer(t, "/render", query, 200, test.body)
+		metric.TSDB.Reduce = test.reduce
+		metric.TSDB.Min, metric.TSDB.Max = &min, &max
+		metric.TSDB.NoDataValid = test.noDataValid
+
+		result, err := QueryTSDBMetric(metric)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Series != 1 || result.Value != test.value || result.NoData != test.noData || result.Valid != test.valid {
+			t.Errorf("%s of %s: unexpected %+v", test.reduce, test.body, result)
+		}
+	}
+}
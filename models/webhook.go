@@ -0,0 +1,118 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"regexp"
+	"strings"
+
+	"github.com/jmoiron/jsonq"
+)
+
+// WebhookValues are the metrics mapped out of a single webhook delivery.
+type WebhookValues struct {
+	Segment string             `json:"segment,omitempty"` // From the name path (already sanitized)
+	Values  map[string]float64 `json:"values"`
+	Missing []string           `json:"missing,omitempty"` // Mapped metrics the payload didn't have
+}
+
+// webhookSegmentUnsafe matches anything we don't want in a metric path segment.
+var webhookSegmentUnsafe = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+// VerifyWebhookSignature checks the request's signature header against an hmac of the body
+// (accepting hex or base64, optionally prefixed with the algorithm, e.g. "sha256=...").
+// Receivers without a secret accept everything.
+func VerifyWebhookSignature(webhook *ConfigWebhook, signature string, body []byte) bool {
+
+	if len(webhook.Secret) < 1 {
+		return true
+	}
+
+	var newHash func() hash.Hash
+	switch webhook.Algorithm {
+	case "sha1":
+		newHash = sha1.New
+	case "sha256":
+		newHash = sha256.New
+	case "sha512":
+		newHash = sha512.New
+	default:
+		return false
+	}
+	mac := hmac.New(newHash, []byte(webhook.Secret))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+
+	signature = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(signature), webhook.Algorithm+"="))
+	if actual, err := hex.DecodeString(signature); err == nil && hmac.Equal(actual, expected) {
+		return true
+	}
+	if actual, err := base64.StdEncoding.DecodeString(signature); err == nil && hmac.Equal(actual, expected) {
+		return true
+	}
+	return false
+}
+
+// ExtractWebhookValues maps a webhook's json payload to metric values (numbers, numeric
+// strings and booleans) using the receiver's paths.
+func ExtractWebhookValues(webhook *ConfigWebhook, body []byte) (*WebhookValues, error) {
+
+	data := map[string]interface{}{}
+	err := json.Unmarshal(body, &data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing payload: %s", err)
+	}
+
+	jq := jsonq.NewQuery(data)
+	result := &WebhookValues{Values: map[string]float64{}}
+
+	if len(webhook.NamePath) > 0 {
+		value, err := jq.Interface(strings.Split(webhook.NamePath, ".")...)
+		if err != nil || value == nil {
+			return nil, fmt.Errorf("payload has nothing at %s to name the metrics by", webhook.NamePath)
+		}
+		result.Segment = strings.Trim(webhookSegmentUnsafe.ReplaceAllString(strings.ToLower(fmt.Sprint(value)), "-"), "-")
+		if len(result.Segment) < 1 {
+			return nil, fmt.Errorf("payload value at %s can't be used in a metric name", webhook.NamePath)
+		}
+	}
+
+	for name, path := range webhook.Values {
+		query := strings.Split(path, ".")
+		if value, err := jq.Float(query...); err == nil {
+			result.Values[name] = value
+		} else if value, err := jq.Bool(query...); err == nil {
+			result.Values[name] = 0
+			if value {
+				result.Values[name] = 1
+			}
+		} else {
+			result.Missing = append(result.Missing, name)
+		}
+	}
+
+	return result, nil
+}
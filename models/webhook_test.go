@@ -0,0 +1,134 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestVerifyWebhookSignature(t *testing.T) {
+
+	// GitHub's documented example (secret, payload and X-Hub-Signature-256)...
+	github := &ConfigWebhook{Secret: "It's a Secret to Everybody", Algorithm: "sha256"}
+	body := []byte("Hello, World!")
+
+	for _, test := range []struct {
+		name      string
+		webhook   *ConfigWebhook
+		signature string
+		body      []byte
+		valid     bool
+	}{
+		{"hex", github, "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17", body, true},
+		{"hex without prefix", github, "757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17", body, true},
+		{"hex upper case", github, "sha256=757107EA0EB2509FC211221CCE984B8A37570B6D7586C22C46F4379C8B043E17", body, true},
+		{"base64", github, "dXEH6g6yUJ/CESIczphLijdXC211hsIsRvQ3nIsEPhc=", body, true},
+		{"base64 with prefix", github, " sha256=dXEH6g6yUJ/CESIczphLijdXC211hsIsRvQ3nIsEPhc= ", body, true},
+		{"tampered body", github, "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17", []byte("Hello, World?"), false},
+		{"truncated", github, "sha256=757107ea0eb2509fc211221cce984b8a", body, false},
+		{"wrong secret", &ConfigWebhook{Secret: "It's a secret to everybody", Algorithm: "sha256"},
+			"sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17", body, false},
+		{"wrong algorithm", &ConfigWebhook{Secret: "It's a Secret to Everybody", Algorithm: "sha512"},
+			"sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17", body, false},
+		{"missing", github, "", body, false},
+		{"sha1", &ConfigWebhook{Secret: "secret", Algorithm: "sha1"}, "sha1=f8446672f033e4b2beafc5ca3a71eafcd2cafb6e", []byte(`{"a":1}`), true},
+		{"sha512", &ConfigWebhook{Secret: "secret", Algorithm: "sha512"},
+			"QvCMDaAcmkbU5WY9XyFAUmoBZQfFmBgsZ2nMorz3ukPDlbcZsB0oj1rTIlZNzh1AyijvULh2/EmjPRPWeDEU3Q==", []byte(`{"a":1}`), true},
+		{"no secret", &ConfigWebhook{}, "", body, true},
+	} {
+		if valid := VerifyWebhookSignature(test.webhook, test.signature, test.body); valid != test.valid {
+			t.Errorf("%s: expected %v, got %v", test.name, test.valid, valid)
+		}
+	}
+}
+
+func TestExtractWebhookValues(t *testing.T) {
+
+	webhook := &ConfigWebhook{
+		NamePath: "repository.full_name",
+		Values: map[string]string{
+			"duration": "build.duration",
+			"retries":  "build.retries",
+			"passed":   "build.passed",
+			"first":    "build.stages.0.duration",
+			"missing":  "build.nope",
+			"text":     "build.status",
+		},
+	}
+
+	for _, test := range []struct {
+		name    string
+		webhook *ConfigWebhook
+		body    string
+		result  *WebhookValues
+		err     string
+	}{
+		{
+			name:    "values",
+			webhook: webhook,
+			body: `{"repository": {"full_name": "Acme/Web.App"}, "build": {"duration": 81.5, "retries": "2",
+				"passed": true, "status": "green", "stages": [{"duration": 12}]}}`,
+			result: &WebhookValues{
+				Segment: "acme-web-app",
+				Values:  map[string]float64{"duration": 81.5, "retries": 2, "passed": 1, "first": 12},
+				Missing: []string{"missing", "text"},
+			},
+		},
+		{
+			name:    "false",
+			webhook: &ConfigWebhook{Values: map[string]string{"passed": "passed"}},
+			body:    `{"passed": false}`,
+			result:  &WebhookValues{Values: map[string]float64{"passed": 0}},
+		},
+		{
+			name:    "no name",
+			webhook: webhook,
+			body:    `{"build": {"duration": 1}}`,
+			err:     "payload has nothing at repository.full_name to name the metrics by",
+		},
+		{
+			name:    "unusable name",
+			webhook: webhook,
+			body:    `{"repository": {"full_name": "!!!"}}`,
+			err:     "payload value at repository.full_name can't be used in a metric name",
+		},
+		{
+			name:    "not json",
+			webhook: webhook,
+			body:    `payload=%7B%7D`,
+			err:     "error parsing payload: invalid character 'p' looking for beginning of value",
+		},
+	} {
+		result, err := ExtractWebhookValues(test.webhook, []byte(test.body))
+		if len(test.err) > 0 {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		sort.Strings(result.Missing)
+		if !reflect.DeepEqual(result, test.result) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.result, result)
+		}
+	}
+}
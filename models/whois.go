@@ -0,0 +1,272 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+type DomainExpiryResult struct {
+	Elapsed time.Duration // Zero when the expiry came from the cache
+	Server  string        // The whois server the expiry date came from
+	Expires time.Time
+	Days    float64 // Until expiry (negative once expired)
+	Cached  bool
+	Valid   bool
+}
+
+// DomainExpiryCache remembers the last expiry date we looked up, or why we couldn't (whois
+// servers rate limit aggressively, so we only ask again once it's stale).
+type DomainExpiryCache struct {
+	Server  string
+	Expires time.Time
+	Fetched time.Time
+	Err     error
+}
+
+// whoisMaxResponse caps how much of a response we'll read (real ones are a few KiB).
+const whoisMaxResponse = 1 << 20
+
+// whoisReferralKeys are the fields registries use to point at the next (more specific) server.
+var whoisReferralKeys = []string{
+	"refer",
+	"whois",
+	"registrar whois server",
+	"whois server",
+}
+
+// whoisExpiryKeys are the fields registries and registrars use for the expiry date.
+var whoisExpiryKeys = []string{
+	"registry expiry date",
+	"registrar registration expiration date",
+	"registrar registration expiry date",
+	"domain expiration date",
+	"expiration date",
+	"expiry date",
+	"expire date",
+	"expiration time",
+	"expires on",
+	"expires",
+	"expire",
+	"paid-till",
+	"valid until",
+	"renewal date",
+}
+
+// whoisDateLayouts are the date formats seen in the wild (tried in order). Slashed day first
+// dates are left out as they can't be told apart from month first ones.
+var whoisDateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05 MST",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	"02-Jan-2006 15:04:05 MST",
+	"02-Jan-2006 15:04:05",
+	"02-Jan-2006",
+	"2006.01.02 15:04:05",
+	"2006.01.02",
+	"2006/01/02 15:04:05",
+	"2006/01/02",
+	"02.01.2006 15:04:05",
+	"02.01.2006",
+	"Mon Jan _2 15:04:05 MST 2006",
+	"January _2 2006",
+	"20060102",
+}
+
+// QueryDomainExpiryMetric looks up the domain's expiry date over whois (starting at the
+// configured server and following referrals down to the registrar) and reports the days
+// left. Lookups are cached, so most runs only recompute the days.
+func QueryDomainExpiryMetric(metric *ConfigMetric, cache *DomainExpiryCache) (*DomainExpiryResult, error) {
+
+	// We can only query metrics of domain-expiry type...
+	if metric.Type != "domain-expiry" {
+		return nil, fmt.Errorf("cannot query metric type %s via domain-expiry", metric.Type)
+	}
+	if len(metric.DomainExpiry.Domain) < 1 {
+		return nil, fmt.Errorf("no domain to look up")
+	}
+
+	result := &DomainExpiryResult{}
+
+	cacheFor := metric.DomainExpiry.CacheFor.Duration
+	if cache.Err != nil {
+		cacheFor = metric.DomainExpiry.FailureCacheFor.Duration
+	}
+
+	if cache.Fetched.IsZero() || time.Since(cache.Fetched) >= cacheFor {
+		start := time.Now()
+		server, expires, err := lookupDomainExpiry(metric)
+		if err != nil {
+			*cache = DomainExpiryCache{Fetched: time.Now(), Err: err}
+			return nil, err
+		}
+		result.Elapsed = time.Since(start)
+		*cache = DomainExpiryCache{Server: server, Expires: expires, Fetched: time.Now()}
+	} else if cache.Err != nil {
+		return nil, fmt.Errorf("%s (cached until %s)", cache.Err, cache.Fetched.Add(cacheFor).Format(time.RFC3339))
+	} else {
+		result.Cached = true
+	}
+
+	result.Server = cache.Server
+	result.Expires = cache.Expires
+	result.Days = time.Until(cache.Expires).Hours() / 24
+	result.Valid = result.Days >= float64(metric.DomainExpiry.MinDays)
+
+	return result, nil
+}
+
+// lookupDomainExpiry follows referrals from the configured server, returning the expiry date
+// from the most specific server that had one (registrars sometimes leave it out).
+func lookupDomainExpiry(metric *ConfigMetric) (string, time.Time, error) {
+
+	const maxReferrals = 3
+
+	deadline := time.Now().Add(metric.Timeout.Duration)
+	domain := strings.ToLower(strings.TrimSuffix(metric.DomainExpiry.Domain, "."))
+	server := whoisAddress(metric.DomainExpiry.Server)
+	visited := map[string]bool{}
+
+	var expiresServer string
+	var expires time.Time
+	for i := 0; i <= maxReferrals && len(server) > 0 && !visited[server]; i++ {
+		visited[server] = true
+
+		response, err := queryWHOIS(server, domain, deadline)
+		if err != nil {
+			if expires.IsZero() {
+				return "", time.Time{}, fmt.Errorf("error querying %s: %s", server, err)
+			}
+			break // We already have a date from the registry, the registrar is a bonus
+		}
+
+		fields := parseWHOISFields(response)
+		if value := whoisField(fields, whoisExpiryKeys); len(value) > 0 {
+			date, err := parseWHOISDate(value)
+			if err != nil {
+				if expires.IsZero() {
+					return "", time.Time{}, fmt.Errorf("error parsing expiry date from %s: %s", server, err)
+				}
+				break // Same again, we'll stick with the registry's date
+			}
+			expiresServer, expires = server, date
+		}
+
+		server = whoisAddress(whoisField(fields, whoisReferralKeys))
+	}
+
+	if expires.IsZero() {
+		return "", time.Time{}, fmt.Errorf("no expiry date found for %s", domain)
+	}
+	return expiresServer, expires, nil
+}
+
+// whoisAddress turns a server (e.g. "whois.verisign-grs.com", "whois://whois.example.com" or
+// "localhost:4343") into an address to dial. Web based referrals come back empty.
+func whoisAddress(server string) string {
+	server = strings.TrimSpace(server)
+	server = strings.TrimPrefix(server, "whois://")
+	server = strings.TrimSuffix(server, "/")
+	if len(server) < 1 || strings.Contains(server, "://") || strings.ContainsAny(server, " /") {
+		return ""
+	}
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(server, "43")
+}
+
+func queryWHOIS(address string, domain string, deadline time.Time) (string, error) {
+
+	conn, err := (&net.Dialer{Deadline: deadline}).Dial("tcp", address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	_, err = fmt.Fprintf(conn, "%s\r\n", domain)
+	if err != nil {
+		return "", err
+	}
+
+	// The server closes the connection once it's done...
+	response, err := ioutil.ReadAll(io.LimitReader(conn, whoisMaxResponse))
+	if err != nil {
+		return "", err
+	}
+	return string(response), nil
+}
+
+// parseWHOISFields collects "key: value" lines (keys lowercased, first one wins).
+func parseWHOISFields(response string) map[string]string {
+	fields := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(response))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "%") || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ">>>") {
+			continue // Comments and the "last update" trailer
+		}
+		i := strings.Index(line, ":")
+		if i < 1 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+		if _, ok := fields[key]; !ok && len(value) > 0 {
+			fields[key] = value
+		}
+	}
+	return fields
+}
+
+// whoisField returns the value of the first of keys that's present.
+func whoisField(fields map[string]string, keys []string) string {
+	for _, key := range keys {
+		if value, ok := fields[key]; ok {
+			return value
+		}
+	}
+	return ""
+}
+
+func parseWHOISDate(value string) (time.Time, error) {
+
+	// Drop trailing notes (e.g. "2028-09-14 (YYYY-MM-DD)") and a spelled out utc...
+	if i := strings.Index(value, " ("); i > 0 {
+		value = value[:i]
+	}
+	value = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), " UTC"))
+
+	for _, layout := range whoisDateLayouts {
+		date, err := time.Parse(layout, value)
+		if err == nil {
+			return date, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized date %q", value)
+}
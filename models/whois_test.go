@@ -0,0 +1,228 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// whoisTestServer is a stand-in whois server answering with a canned response per domain.
+type whoisTestServer struct {
+	sync.Mutex
+	listener  net.Listener
+	responses map[string]string
+	queries   int
+}
+
+func newWHOISTestServer(t *testing.T, responses map[string]string) *whoisTestServer {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &whoisTestServer{listener: listener, responses: responses}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			s.Lock()
+			s.queries++
+			response, ok := s.responses[strings.TrimSpace(line)]
+			s.Unlock()
+			if !ok {
+				response = "No match for domain.\r\n"
+			}
+			fmt.Fprint(conn, response)
+			conn.Close()
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+
+	return s
+}
+
+func (s *whoisTestServer) address() string {
+	return s.listener.Addr().String()
+}
+
+func (s *whoisTestServer) queryCount() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.queries
+}
+
+func whoisTestMetric(server string) *ConfigMetric {
+	return &ConfigMetric{
+		Type:    "domain-expiry",
+		Timeout: Duration{time.Second},
+		DomainExpiry: ConfigMetricDomainExpiry{
+			Domain:          "Example.com.",
+			Server:          server,
+			MinDays:         30,
+			CacheFor:        Duration{24 * time.Hour},
+			FailureCacheFor: Duration{time.Hour},
+		},
+	}
+}
+
+// whoisTestChain sets up a root (like whois.iana.org) referring to a registry which refers to
+// a registrar answering with registrarResponse.
+func whoisTestChain(t *testing.T, registrarResponse string) (*whoisTestServer, *whoisTestServer, *whoisTestServer) {
+
+	registrar := newWHOISTestServer(t, map[string]string{"example.com": registrarResponse})
+	registry := newWHOISTestServer(t, map[string]string{"example.com": strings.Join([]string{
+		"   Domain Name: EXAMPLE.COM",
+		"   Registrar WHOIS Server: whois://" + registrar.address(),
+		"   Registry Expiry Date: 2031-08-13T04:00:00Z",
+		">>> Last update of whois database: 2026-10-19T00:00:00Z <<<",
+		"",
+	}, "\r\n")})
+	root := newWHOISTestServer(t, map[string]string{"example.com": strings.Join([]string{
+		"% IANA WHOIS server",
+		"refer:        " + registry.address(),
+		"",
+		"domain:       COM",
+		"",
+	}, "\n")})
+
+	return root, registry, registrar
+}
+
+func TestQueryDomainExpiryMetricReferrals(t *testing.T) {
+
+	root, _, registrar := whoisTestChain(t, strings.Join([]string{
+		"Domain Name: example.com",
+		"Registrar Registration Expiration Date: 2031-08-14T04:00:00Z",
+		"",
+	}, "\r\n"))
+
+	cache := &DomainExpiryCache{}
+	result, err := QueryDomainExpiryMetric(whoisTestMetric(root.address()), cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The registrar is the most specific, so its date wins...
+	if result.Server != registrar.address() || !result.Expires.Equal(time.Date(2031, 8, 14, 4, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the registrar's date, got %s from %s", result.Expires, result.Server)
+	}
+	if !result.Valid || result.Cached || result.Days < 365 {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	// Then we use the cache...
+	result, err = QueryDomainExpiryMetric(whoisTestMetric(root.address()), cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Cached || root.queryCount() != 1 || registrar.queryCount() != 1 {
+		t.Errorf("expected a cached result, got %+v after %d queries", result, root.queryCount())
+	}
+}
+
+func TestQueryDomainExpiryMetricRegistrarIsABonus(t *testing.T) {
+
+	unparseable, _, _ := whoisTestChain(t, "Registrar Registration Expiration Date: sometime next year\r\n")
+	silent, _, _ := whoisTestChain(t, "Domain Name: example.com\r\n")
+
+	for _, root := range []*whoisTestServer{unparseable, silent} {
+		result, err := QueryDomainExpiryMetric(whoisTestMetric(root.address()), &DomainExpiryCache{})
+		if err != nil {
+			t.Errorf("expected the registry's date, got %s", err)
+			continue
+		}
+		if !result.Expires.Equal(time.Date(2031, 8, 13, 4, 0, 0, 0, time.UTC)) {
+			t.Errorf("expected the registry's date, got %s from %s", result.Expires, result.Server)
+		}
+	}
+
+	// A registrar that's gone away is the same...
+	root, _, registrar := whoisTestChain(t, "")
+	registrar.listener.Close()
+	if _, err := QueryDomainExpiryMetric(whoisTestMetric(root.address()), &DomainExpiryCache{}); err != nil {
+		t.Errorf("expected the registry's date, got %s", err)
+	}
+}
+
+func TestQueryDomainExpiryMetricFailureCache(t *testing.T) {
+
+	root := newWHOISTestServer(t, map[string]string{})
+
+	cache := &DomainExpiryCache{}
+	_, err := QueryDomainExpiryMetric(whoisTestMetric(root.address()), cache)
+	if err == nil || !strings.Contains(err.Error(), "no expiry date found") {
+		t.Fatalf("expected no expiry date to be found, got %v", err)
+	}
+
+	// The failure is reused for a while...
+	_, err = QueryDomainExpiryMetric(whoisTestMetric(root.address()), cache)
+	if err == nil || !strings.Contains(err.Error(), "cached until") || root.queryCount() != 1 {
+		t.Errorf("expected a cached failure without asking again, got %v after %d queries", err, root.queryCount())
+	}
+
+	// Then (well before a successful lookup would be) we try again...
+	cache.Fetched = cache.Fetched.Add(-61 * time.Minute)
+	root.Lock()
+	root.responses["example.com"] = "Registry Expiry Date: 2020-01-01T00:00:00Z\n"
+	root.Unlock()
+	result, err := QueryDomainExpiryMetric(whoisTestMetric(root.address()), cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Cached || result.Valid || result.Days > 0 || root.queryCount() != 2 {
+		t.Errorf("expected a fresh (expired) result, got %+v after %d queries", result, root.queryCount())
+	}
+}
+
+func TestParseWHOISDate(t *testing.T) {
+
+	dates := map[string]time.Time{
+		"2028-09-14T04:00:00Z":         time.Date(2028, 9, 14, 4, 0, 0, 0, time.UTC),
+		"2028-09-14T04:00:00.0Z":       time.Date(2028, 9, 14, 4, 0, 0, 0, time.UTC),
+		"2028-09-14T04:00:00+0000":     time.Date(2028, 9, 14, 4, 0, 0, 0, time.UTC),
+		"2028-09-14 04:00:00 UTC":      time.Date(2028, 9, 14, 4, 0, 0, 0, time.UTC),
+		"2028-09-14 (YYYY-MM-DD)":      time.Date(2028, 9, 14, 0, 0, 0, 0, time.UTC),
+		"14-Sep-2028":                  time.Date(2028, 9, 14, 0, 0, 0, 0, time.UTC),
+		"2028.09.14":                   time.Date(2028, 9, 14, 0, 0, 0, 0, time.UTC),
+		"2028/09/14":                   time.Date(2028, 9, 14, 0, 0, 0, 0, time.UTC),
+		"14.09.2028":                   time.Date(2028, 9, 14, 0, 0, 0, 0, time.UTC),
+		"Thu Sep 14 04:00:00 UTC 2028": time.Date(2028, 9, 14, 4, 0, 0, 0, time.UTC),
+		"20280914":                     time.Date(2028, 9, 14, 0, 0, 0, 0, time.UTC),
+	}
+	for value, expected := range dates {
+		date, err := parseWHOISDate(value)
+		if err != nil || !date.Equal(expected) {
+			t.Errorf("parseWHOISDate(%q) = %s, %v (expected %s)", value, date, err, expected)
+		}
+	}
+
+	// Slashed dates could be either way around...
+	for _, value := range []string{"03/04/2028", "14/09/2028", "next tuesday", ""} {
+		if date, err := parseWHOISDate(value); err == nil {
+			t.Errorf("parseWHOISDate(%q) = %s, expected an error", value, date)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package routes
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/bryancallahan/metrics-runner/metricsrouter"
+	"github.com/bryancallahan/metrics-runner/models"
+	"github.com/bryancallahan/metrics-runner/utilities"
+)
+
+// BEACON_MAX_BODY caps the size of a beacon we'll read (in bytes).
+const BEACON_MAX_BODY = 64 << 10
+
+func InitializeBeaconRoutes(version *models.Version, config *models.Config, collector *metricsrouter.BeaconCollector, r *mux.Router) {
+	apiRouter := r.PathPrefix("/api/").Subrouter()
+	apiRouter.HandleFunc("/beacon", newOptionsBeacon(config)).Methods("OPTIONS")
+	apiRouter.HandleFunc("/beacon", newPostBeacon(config, collector)).Methods("POST")
+}
+
+// allowBeaconOrigin adds cors headers for allowed origins (returning false for the rest). Only
+// origins listed by name get credentials, "*" is a plain wildcard (so browsers won't send
+// sendBeacon's cookies to it, e.g. for application/json blobs).
+func allowBeaconOrigin(config *models.Config, w http.ResponseWriter, r *http.Request) bool {
+
+	origin := r.Header.Get("Origin")
+	w.Header().Add("Vary", "Origin")
+	wildcard := false
+	for _, allowed := range config.Beacon.AllowedOrigins {
+		if len(origin) > 0 && allowed == origin {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true") // sendBeacon always includes credentials
+			return true
+		}
+		if allowed == "*" {
+			wildcard = true
+		}
+	}
+	if wildcard {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return true
+	}
+	return false
+}
+
+// newOptionsBeacon answers cors preflights (sendBeacon needs one for application/json blobs).
+func newOptionsBeacon(config *models.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowBeaconOrigin(config, w, r) {
+			utilities.ServeJSON(w, r, http.StatusForbidden, map[string]string{"error": "origin not allowed"})
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Max-Age", "86400")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func newPostBeacon(config *models.Config, collector *metricsrouter.BeaconCollector) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if !allowBeaconOrigin(config, w, r) {
+			utilities.ServeJSON(w, r, http.StatusForbidden, map[string]string{"error": "origin not allowed"})
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, BEACON_MAX_BODY))
+		if err != nil {
+			utilities.ServeJSON(w, r, http.StatusRequestEntityTooLarge, map[string]string{"error": "beacon too large"})
+			return
+		}
+
+		beacon, err := models.ParseBeacon(body)
+		if err != nil {
+			utilities.ServeJSON(w, r, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		collector.Record(beacon)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,60 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bryancallahan/metrics-runner/models"
+)
+
+func TestAllowBeaconOrigin(t *testing.T) {
+
+	requests := []struct {
+		allowed     []string
+		origin      string
+		ok          bool
+		allow       string
+		credentials string
+	}{
+		{[]string{"https://www.example.com"}, "https://www.example.com", true, "https://www.example.com", "true"},
+		{[]string{"https://www.example.com"}, "https://evil.example", false, "", ""},
+		{[]string{"https://www.example.com"}, "", false, "", ""},
+
+		// A wildcard never comes with credentials (unless the origin's also listed)...
+		{[]string{"*"}, "https://evil.example", true, "*", ""},
+		{[]string{"*"}, "", true, "*", ""},
+		{[]string{"*", "https://www.example.com"}, "https://www.example.com", true, "https://www.example.com", "true"},
+	}
+	for _, request := range requests {
+		config := &models.Config{Beacon: models.ConfigBeacon{AllowedOrigins: request.allowed}}
+		r := httptest.NewRequest(http.MethodPost, "/api/beacon", nil)
+		if len(request.origin) > 0 {
+			r.Header.Set("Origin", request.origin)
+		}
+		w := httptest.NewRecorder()
+
+		ok := allowBeaconOrigin(config, w, r)
+		allow, credentials := w.Header().Get("Access-Control-Allow-Origin"), w.Header().Get("Access-Control-Allow-Credentials")
+		if ok != request.ok || allow != request.allow || credentials != request.credentials {
+			t.Errorf("%v from %q: got %t, %q, %q (expected %t, %q, %q)", request.allowed, request.origin,
+				ok, allow, credentials, request.ok, request.allow, request.credentials)
+		}
+	}
+}
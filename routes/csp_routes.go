@@ -0,0 +1,85 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package routes
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/bryancallahan/metrics-runner/metricsrouter"
+	"github.com/bryancallahan/metrics-runner/models"
+	"github.com/bryancallahan/metrics-runner/utilities"
+)
+
+// CSP_MAX_BODY caps the size of a report body we'll read (in bytes).
+const CSP_MAX_BODY = 64 << 10
+
+// InitializeCSPRoutes adds reading back recent violations to the api.
+func InitializeCSPRoutes(version *models.Version, config *models.Config, collector *metricsrouter.CSPCollector, r *mux.Router) {
+	apiRouter := r.PathPrefix("/api/").Subrouter()
+	apiRouter.HandleFunc("/csp-reports", newGetCSPReports(collector)).Methods("GET")
+}
+
+// InitializeCSPReportRoutes adds the (public) routes browsers send reports to.
+func InitializeCSPReportRoutes(version *models.Version, config *models.Config, collector *metricsrouter.CSPCollector, r *mux.Router) {
+	apiRouter := r.PathPrefix("/api/").Subrouter()
+	apiRouter.HandleFunc("/csp-reports", newOptionsCSPReports()).Methods("OPTIONS")
+	apiRouter.HandleFunc("/csp-reports", newPostCSPReports(collector)).Methods("POST")
+}
+
+// newGetCSPReports lists recent distinct violations (most recently seen first).
+func newGetCSPReports(collector *metricsrouter.CSPCollector) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		utilities.ServeJSON(w, r, http.StatusOK, collector.Recent())
+	}
+}
+
+// newOptionsCSPReports answers cors preflights (browsers send reports+json cross origin
+// without credentials, so any origin will do).
+func newOptionsCSPReports() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Max-Age", "86400")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func newPostCSPReports(collector *metricsrouter.CSPCollector) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, CSP_MAX_BODY))
+		if err != nil {
+			utilities.ServeJSON(w, r, http.StatusRequestEntityTooLarge, map[string]string{"error": "report too large"})
+			return
+		}
+
+		violations, err := models.ParseCSPReports(r.Header.Get("Content-Type"), body)
+		if err != nil {
+			utilities.ServeJSON(w, r, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		collector.Record(violations)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,150 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package routes
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/bryancallahan/metrics-runner/metricsrunner"
+	"github.com/bryancallahan/metrics-runner/models"
+)
+
+func InitializePrometheusRoutes(version *models.Version, config *models.Config, metricsRunners []*metricsrunner.MetricsRunner, r *mux.Router) {
+	r.HandleFunc("/metrics", newGetPrometheusMetrics(config, metricsRunners)).Methods("GET")
+}
+
+// prometheusProbe is a metrics runner's labels, stats and last result, as exposed.
+type prometheusProbe struct {
+	labels string
+	stats  *metricsrunner.ProbeStats
+	result *models.RunResult
+}
+
+// newGetPrometheusMetrics exposes every metrics runner's results in prometheus' text format
+// (along the lines of blackbox_exporter's probe_* metrics).
+func newGetPrometheusMetrics(config *models.Config, metricsRunners []*metricsrunner.MetricsRunner) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		var probes []prometheusProbe
+		for _, metricsRunner := range metricsRunners {
+			metric := metricsRunner.Metric()
+			probes = append(probes, prometheusProbe{
+				labels: prometheusLabels([][2]string{
+					{"check", metric.Name},
+					{"type", metric.Type},
+					{"method", metric.Method},
+					{"url", metric.URL},
+					{"env", config.Env},
+				}),
+				stats:  metricsRunner.Stats(),
+				result: metricsRunner.Result(),
+			})
+		}
+
+		var b bytes.Buffer
+		writePrometheusProbes(&b, probes)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b.Bytes())
+	}
+}
+
+func writePrometheusProbes(b *bytes.Buffer, probes []prometheusProbe) {
+
+	writePrometheusHeader(b, "metrics_runner_probe_success", "gauge", "Whether the last run was valid.")
+	for _, p := range probes {
+		if p.result != nil {
+			fmt.Fprintf(b, "metrics_runner_probe_success{%s} %s\n", p.labels, prometheusBool(p.result.Valid))
+		}
+	}
+
+	writePrometheusHeader(b, "metrics_runner_probe_success_total", "counter", "Runs that were valid.")
+	for _, p := range probes {
+		fmt.Fprintf(b, "metrics_runner_probe_success_total{%s} %d\n", p.labels, p.stats.Successes)
+	}
+
+	writePrometheusHeader(b, "metrics_runner_probe_failure_total", "counter", "Runs that were invalid (or failed).")
+	for _, p := range probes {
+		fmt.Fprintf(b, "metrics_runner_probe_failure_total{%s} %d\n", p.labels, p.stats.Failures)
+	}
+
+	writePrometheusHeader(b, "metrics_runner_probe_duration_seconds", "histogram", "How long runs took.")
+	for _, p := range probes {
+		for i, bound := range metricsrunner.ProbeDurationBuckets {
+			fmt.Fprintf(b, "metrics_runner_probe_duration_seconds_bucket{%s,le=\"%s\"} %d\n", p.labels,
+				prometheusFloat(bound), p.stats.DurationBuckets[i])
+		}
+		fmt.Fprintf(b, "metrics_runner_probe_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", p.labels, p.stats.DurationCount)
+		fmt.Fprintf(b, "metrics_runner_probe_duration_seconds_sum{%s} %s\n", p.labels, prometheusFloat(p.stats.DurationSum))
+		fmt.Fprintf(b, "metrics_runner_probe_duration_seconds_count{%s} %d\n", p.labels, p.stats.DurationCount)
+	}
+
+	writePrometheusHeader(b, "metrics_runner_probe_last_run_timestamp_seconds", "gauge", "When the last run finished.")
+	for _, p := range probes {
+		if !p.stats.LastRun.IsZero() {
+			fmt.Fprintf(b, "metrics_runner_probe_last_run_timestamp_seconds{%s} %s\n", p.labels,
+				prometheusFloat(float64(p.stats.LastRun.UnixNano())/1e9))
+		}
+	}
+
+	writePrometheusHeader(b, "metrics_runner_probe_value", "gauge", "The last value of each field a run reported (e.g. elapsed, status-code).")
+	for _, p := range probes {
+		fields := make([]string, 0, len(p.stats.Values))
+		for field := range p.stats.Values {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			fmt.Fprintf(b, "metrics_runner_probe_value{%s,%s} %s\n", p.labels,
+				prometheusLabels([][2]string{{"field", field}}), prometheusFloat(p.stats.Values[field]))
+		}
+	}
+}
+
+func writePrometheusHeader(b *bytes.Buffer, name string, metricType string, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(b, "# TYPE %s %s\n", name, metricType)
+}
+
+// prometheusLabels formats label pairs (escaping backslashes, quotes and newlines).
+func prometheusLabels(labels [][2]string) string {
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", label[0], escaper.Replace(label[1]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func prometheusFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func prometheusBool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
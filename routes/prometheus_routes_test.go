@@ -0,0 +1,150 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package routes
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/bryancallahan/metrics-runner/metricsrouter"
+	"github.com/bryancallahan/metrics-runner/metricsrunner"
+	"github.com/bryancallahan/metrics-runner/models"
+)
+
+func TestPrometheusLabels(t *testing.T) {
+	for _, test := range []struct {
+		labels   [][2]string
+		expected string
+	}{
+		{[][2]string{{"check", "home"}, {"env", "production"}}, `check="home",env="production"`},
+		{[][2]string{{"url", `https://www.example.com/?q="a b"`}}, `url="https://www.example.com/?q=\"a b\""`},
+		{[][2]string{{"check", `C:\probes\home`}}, `check="C:\\probes\\home"`},
+		{[][2]string{{"check", "two\nlines"}}, `check="two\nlines"`},
+		{[][2]string{{"check", `\"` + "\n"}}, `check="\\\"\n"`},
+		{[][2]string{{"method", ""}}, `method=""`},
+	} {
+		if actual := prometheusLabels(test.labels); actual != test.expected {
+			t.Errorf("prometheusLabels(%q) = %s, expected %s", test.labels, actual, test.expected)
+		}
+	}
+}
+
+func TestWritePrometheusProbes(t *testing.T) {
+
+	// Three runs (4ms, 80ms and 3s), each counted in every bucket it fits under...
+	buckets := []uint64{1, 1, 1, 1, 2, 2, 2, 2, 2, 3, 3, 3, 3}
+	stats := &metricsrunner.ProbeStats{
+		Successes:       2,
+		Failures:        1,
+		DurationBuckets: buckets,
+		DurationSum:     3.084,
+		DurationCount:   3,
+		LastRun:         time.Unix(1554000000, 500000000),
+		Values:          map[string]float64{"status-code": 200, "elapsed": 3000},
+	}
+	labels := prometheusLabels([][2]string{{"check", `say "hi"`}})
+
+	var b bytes.Buffer
+	writePrometheusProbes(&b, []prometheusProbe{
+		{labels: labels, stats: stats, result: &models.RunResult{Valid: true}},
+	})
+	exposition := b.String()
+
+	for _, line := range []string{
+		"# HELP metrics_runner_probe_duration_seconds How long runs took.",
+		"# TYPE metrics_runner_probe_duration_seconds histogram",
+		`metrics_runner_probe_success{check="say \"hi\""} 1`,
+		`metrics_runner_probe_success_total{check="say \"hi\""} 2`,
+		`metrics_runner_probe_failure_total{check="say \"hi\""} 1`,
+		`metrics_runner_probe_duration_seconds_bucket{check="say \"hi\"",le="0.005"} 1`,
+		`metrics_runner_probe_duration_seconds_bucket{check="say \"hi\"",le="0.1"} 2`,
+		`metrics_runner_probe_duration_seconds_bucket{check="say \"hi\"",le="2.5"} 2`,
+		`metrics_runner_probe_duration_seconds_bucket{check="say \"hi\"",le="5"} 3`,
+		`metrics_runner_probe_duration_seconds_bucket{check="say \"hi\"",le="60"} 3`,
+		`metrics_runner_probe_duration_seconds_bucket{check="say \"hi\"",le="+Inf"} 3`,
+		`metrics_runner_probe_duration_seconds_sum{check="say \"hi\""} 3.084`,
+		`metrics_runner_probe_duration_seconds_count{check="say \"hi\""} 3`,
+		`metrics_runner_probe_last_run_timestamp_seconds{check="say \"hi\""} 1.5540000005e+09`,
+		`metrics_runner_probe_value{check="say \"hi\"",field="status-code"} 200`,
+	} {
+		if !strings.Contains(exposition, line+"\n") {
+			t.Errorf("expected %q in:\n%s", line, exposition)
+		}
+	}
+
+	// Every bound gets a bucket (in order, ending with +Inf)...
+	var bounds []string
+	for _, line := range strings.Split(exposition, "\n") {
+		if strings.HasPrefix(line, "metrics_runner_probe_duration_seconds_bucket{") {
+			bounds = append(bounds, line[strings.Index(line, "le=")+4:strings.LastIndex(line, `"`)])
+		}
+	}
+	if len(bounds) != len(metricsrunner.ProbeDurationBuckets)+1 || bounds[0] != "0.005" || bounds[len(bounds)-1] != "+Inf" {
+		t.Errorf("unexpected bucket bounds %v", bounds)
+	}
+
+	// Values come out sorted by field...
+	if strings.Index(exposition, `field="elapsed"`) > strings.Index(exposition, `field="status-code"`) {
+		t.Errorf("expected values sorted by field in:\n%s", exposition)
+	}
+}
+
+func TestGetPrometheusMetrics(t *testing.T) {
+
+	config := &models.Config{Name: "metrics-runner", Env: "development"}
+	metricsRouter, err := metricsrouter.NewMetricsRouter(&models.Version{}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metricsRunner := metricsrunner.NewMetricsRunner(&models.Version{}, config, metricsRouter, models.ConfigMetric{
+		Type:   "http-request",
+		Name:   "home",
+		Method: "GET",
+		URL:    "https://www.example.com/search?q=\"x\"",
+	})
+	r := mux.NewRouter()
+	InitializePrometheusRoutes(&models.Version{}, config, []*metricsrunner.MetricsRunner{metricsRunner}, r)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Fatalf("unexpected response %d (%s)", w.Code, w.Header().Get("Content-Type"))
+	}
+	exposition := w.Body.String()
+
+	// Nothing has run yet, so there's no success gauge or last run (but there are zeroed counters)...
+	labels := `check="home",type="http-request",method="GET",url="https://www.example.com/search?q=\"x\"",env="development"`
+	for _, line := range []string{
+		"metrics_runner_probe_success_total{" + labels + "} 0",
+		"metrics_runner_probe_duration_seconds_bucket{" + labels + `,le="+Inf"} 0`,
+		"metrics_runner_probe_duration_seconds_count{" + labels + "} 0",
+	} {
+		if !strings.Contains(exposition, line+"\n") {
+			t.Errorf("expected %q in:\n%s", line, exposition)
+		}
+	}
+	if strings.Contains(exposition, "metrics_runner_probe_success{") || strings.Contains(exposition, "metrics_runner_probe_last_run_timestamp_seconds{") {
+		t.Errorf("unexpected results before any run in:\n%s", exposition)
+	}
+}
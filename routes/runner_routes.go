@@ -0,0 +1,58 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package routes
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/bryancallahan/metrics-runner/metricsrunner"
+	"github.com/bryancallahan/metrics-runner/models"
+	"github.com/bryancallahan/metrics-runner/utilities"
+)
+
+func InitializeRunnerRoutes(version *models.Version, config *models.Config, metricsRunners []*metricsrunner.MetricsRunner, r *mux.Router) {
+	apiRouter := r.PathPrefix("/api/").Subrouter()
+	apiRouter.HandleFunc("/runners", newGetRunners(metricsRunners)).Methods("GET")
+	apiRouter.HandleFunc("/runners/{name}", newGetRunner(metricsRunners)).Methods("GET")
+}
+
+// newGetRunners lists the last run result of every metrics runner (runners that
+// haven't run yet have a nil result).
+func newGetRunners(metricsRunners []*metricsrunner.MetricsRunner) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		results := map[string]*models.RunResult{}
+		for _, metricsRunner := range metricsRunners {
+			results[metricsRunner.Metric().Name] = metricsRunner.Result()
+		}
+		utilities.ServeJSON(w, r, http.StatusOK, results)
+	}
+}
+
+func newGetRunner(metricsRunners []*metricsrunner.MetricsRunner) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		for _, metricsRunner := range metricsRunners {
+			if metricsRunner.Metric().Name == name {
+				utilities.ServeJSON(w, r, http.StatusOK, metricsRunner.Result())
+				return
+			}
+		}
+		utilities.ServeJSON(w, r, http.StatusNotFound, map[string]string{"error": "metrics runner not found"})
+	}
+}
@@ -0,0 +1,88 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package routes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/bryancallahan/metrics-runner/metricsrouter"
+	"github.com/bryancallahan/metrics-runner/models"
+	"github.com/bryancallahan/metrics-runner/utilities"
+)
+
+// WEBHOOK_MAX_BODY caps the size of a webhook payload we'll read (in bytes).
+const WEBHOOK_MAX_BODY = 1 << 20
+
+func InitializeWebhookRoutes(version *models.Version, config *models.Config, metricsRouter *metricsrouter.MetricsRouter, r *mux.Router) {
+	apiRouter := r.PathPrefix("/api/").Subrouter()
+	apiRouter.HandleFunc("/webhooks/{name}", newPostWebhook(config, metricsRouter)).Methods("POST")
+}
+
+// newPostWebhook maps a webhook delivery to metrics using the named receiver's config and
+// writes them through the metrics router.
+func newPostWebhook(config *models.Config, metricsRouter *metricsrouter.MetricsRouter) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		name := mux.Vars(r)["name"]
+		var webhook *models.ConfigWebhook
+		for i := range config.Webhooks {
+			if config.Webhooks[i].Name == name {
+				webhook = &config.Webhooks[i]
+				break
+			}
+		}
+		if webhook == nil {
+			utilities.ServeJSON(w, r, http.StatusNotFound, map[string]string{"error": "webhook not found"})
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, WEBHOOK_MAX_BODY))
+		if err != nil {
+			utilities.ServeJSON(w, r, http.StatusRequestEntityTooLarge, map[string]string{"error": "payload too large"})
+			return
+		}
+
+		if !models.VerifyWebhookSignature(webhook, r.Header.Get(webhook.SignatureHeader), body) {
+			log.Println(fmt.Sprintf("webhook %s - Error: signature mismatch", name))
+			utilities.ServeJSON(w, r, http.StatusUnauthorized, map[string]string{"error": "invalid signature"})
+			return
+		}
+
+		values, err := models.ExtractWebhookValues(webhook, body)
+		if err != nil {
+			log.Println(fmt.Sprintf("webhook %s - Error: %s", name, err))
+			utilities.ServeJSON(w, r, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		prefix := fmt.Sprintf("webhook.%s", name)
+		if len(values.Segment) > 0 {
+			prefix = fmt.Sprintf("%s.%s", prefix, values.Segment)
+		}
+		for metric, value := range values.Values {
+			metricsRouter.Write(fmt.Sprintf("%s.%s", prefix, metric), value)
+		}
+
+		log.Println(fmt.Sprintf("webhook %s - Values: %d, Missing: %d", name, len(values.Values), len(values.Missing)))
+		utilities.ServeJSON(w, r, http.StatusOK, values)
+	}
+}
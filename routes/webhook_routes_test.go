@@ -0,0 +1,88 @@
+// Metrics Runner (a simple data collection tool to gather analytics)
+// Copyright (C) 2019  Bryan C. Callahan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/bryancallahan/metrics-runner/metricsrouter"
+	"github.com/bryancallahan/metrics-runner/models"
+)
+
+func TestPostWebhook(t *testing.T) {
+
+	config := &models.Config{
+		Name: "metrics-runner",
+		Env:  "development",
+		Webhooks: []models.ConfigWebhook{{
+			Name:            "github",
+			Values:          map[string]string{"hello": "hello"},
+			Secret:          "It's a Secret to Everybody",
+			SignatureHeader: "X-Hub-Signature-256",
+			Algorithm:       "sha256",
+		}},
+	}
+	metricsRouter, err := metricsrouter.NewMetricsRouter(&models.Version{}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := mux.NewRouter()
+	InitializeWebhookRoutes(&models.Version{}, config, metricsRouter, r)
+
+	// Signed with the secret from GitHub's documented example...
+	const payload = `{"hello":1}`
+	const signature = "sha256=ddb43ef792f161b42749521ff2cf1f3845c99603f142d4f7f4ef4fc80799479f"
+
+	for _, test := range []struct {
+		name      string
+		path      string
+		body      string
+		signature string
+		status    int
+	}{
+		{"signed", "/api/webhooks/github", payload, signature, http.StatusOK},
+		{"tampered", "/api/webhooks/github", `{"hello":2}`, signature, http.StatusUnauthorized},
+		{"unsigned", "/api/webhooks/github", payload, "", http.StatusUnauthorized},
+		{"unknown", "/api/webhooks/gitlab", payload, signature, http.StatusNotFound},
+	} {
+		req := httptest.NewRequest(http.MethodPost, test.path, strings.NewReader(test.body))
+		if len(test.signature) > 0 {
+			req.Header.Set("X-Hub-Signature-256", test.signature)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d (%s)", test.name, test.status, w.Code, w.Body)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		var values models.WebhookValues
+		err := json.Unmarshal(w.Body.Bytes(), &values)
+		if err != nil || values.Values["hello"] != 1 {
+			t.Errorf("%s: unexpected values %s (%v)", test.name, w.Body, err)
+		}
+	}
+}